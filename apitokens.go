@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- API Tokens ---
+//
+// Scripts authenticate with personal API tokens instead of a session:
+// "Authorization: Bearer ntx_...". A token acts as the user who created
+// it, limited to its scopes. Like session tokens, only a hash is stored;
+// the token itself is shown once, when it is created.
+
+// Token scopes. Each includes the ones before it: write can also read,
+// and admin can do everything, including managing tokens.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// apiTokenScopes lists the scopes in increasing order of power
+var apiTokenScopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// apiTokenPrefix starts every token, so leaked tokens are easy to spot
+const apiTokenPrefix = "ntx_"
+
+// Limits of a token's name, and of a user's number of tokens
+const (
+	maxAPITokenName = 100
+	maxAPITokens    = 50
+)
+
+// scopeRank returns the position of scope in apiTokenScopes, -1 if unknown
+func scopeRank(scope string) int {
+	for i, s := range apiTokenScopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasScope reports whether the token grants scope
+func (t APIToken) HasScope(scope string) bool {
+	want := scopeRank(scope)
+	if want < 0 {
+		return false
+	}
+	for _, s := range t.Scopes {
+		if scopeRank(s) >= want {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIToken returns a new random token and the APIToken to store for it
+func newAPIToken(owner User, name string, scopes []string) (string, APIToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIToken{}, err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return secret, APIToken{
+		UserID:    owner.ID,
+		Name:      name,
+		Hash:      sessionKey(secret),
+		Hint:      secret[:len(apiTokenPrefix)+4],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// errInvalidToken is returned by tokenUser for an Authorization header that
+// doesn't hold a valid token
+var errInvalidToken = errors.New("invalid API token")
+
+// tokenUser returns the user and token of a Bearer Authorization header,
+// recording that the token was used
+func tokenUser(header string) (User, APIToken, error) {
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(secret, apiTokenPrefix) {
+		return User{}, APIToken{}, errInvalidToken
+	}
+	token, err := GetAPITokenByHash(sessionKey(strings.TrimSpace(secret)))
+	if err == mongo.ErrNoDocuments {
+		return User{}, APIToken{}, errInvalidToken
+	}
+	if err != nil {
+		return User{}, APIToken{}, err
+	}
+	user, err := GetUserByID(token.UserID)
+	if err == mongo.ErrNoDocuments {
+		return User{}, APIToken{}, errInvalidToken
+	}
+	if err != nil {
+		return User{}, APIToken{}, err
+	}
+
+	// Written at most once a minute per token, not on every request
+	if now := time.Now(); now.Sub(token.LastUsedAt) > time.Minute {
+		if err := TouchAPIToken(token.ID, now); err != nil {
+			log.Printf("Error recording use of API token %s: %v", token.ID.Hex(), err)
+		}
+		token.LastUsedAt = now
+	}
+	return user, token, nil
+}
+
+type apiTokenKey struct{}
+
+// requestToken returns the API token a request was authenticated with;
+// false for requests with a session
+func requestToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(apiTokenKey{}).(APIToken)
+	return token, ok
+}
+
+// hasScope reports whether the request may act with scope. Sessions have
+// every scope; tokens only their own.
+func hasScope(r *http.Request, scope string) bool {
+	token, ok := requestToken(r)
+	return !ok || token.HasScope(scope)
+}
+
+// requireScope rejects requests whose token lacks scope; it must come
+// after requireUser
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasScope(r, scope) {
+				http.Error(w, "This API token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireMethodScope requires the read scope for safe methods (GET, HEAD,
+// OPTIONS) and the write scope for all others
+func requireMethodScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := ScopeWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			scope = ScopeRead
+		}
+		requireScope(scope)(next).ServeHTTP(w, r)
+	})
+}
+
+// withToken adds the user and token of a token request to its context
+func withToken(ctx context.Context, user User, token APIToken) context.Context {
+	return context.WithValue(context.WithValue(ctx, userKey{}, user), apiTokenKey{}, token)
+}
+
+// --- Handlers ---
+
+// apiTokensView is the data for the API tokens section of the settings
+type apiTokensView struct {
+	Tokens   []APIToken
+	Scopes   []string
+	NewToken string // Secret of the token just created, shown once
+	NewName  string
+	Error    string
+}
+
+// handleGetAPITokens renders the user's API tokens
+func handleGetAPITokens(w http.ResponseWriter, r *http.Request) {
+	renderAPITokens(w, r, apiTokensView{})
+}
+
+// handleCreateAPIToken creates a token with the "name" and "scope" form
+// fields and renders the tokens with the new one shown once
+func handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	scope := r.FormValue("scope")
+	var view apiTokensView
+	switch {
+	case name == "" || len(name) > maxAPITokenName:
+		view.Error = "Give the token a name of at most 100 characters."
+	case scopeRank(scope) < 0:
+		view.Error = "Choose the token's scope."
+	}
+	if view.Error != "" {
+		renderAPITokens(w, r, view)
+		return
+	}
+
+	tokens, err := GetAPITokens(user.ID)
+	if err != nil {
+		log.Printf("Error fetching API tokens of %s: %v", user.Username, err)
+		http.Error(w, "Failed to create the token", http.StatusInternalServerError)
+		return
+	}
+	if len(tokens) >= maxAPITokens {
+		renderAPITokens(w, r, apiTokensView{Error: "Revoke a token before creating another."})
+		return
+	}
+
+	secret, token, err := newAPIToken(user, name, []string{scope})
+	if err == nil {
+		_, err = CreateAPIToken(token)
+	}
+	if err != nil {
+		log.Printf("Error creating API token for %s: %v", user.Username, err)
+		http.Error(w, "Failed to create the token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s created API token %q (%s)", user.Username, name, scope)
+	renderAPITokens(w, r, apiTokensView{NewToken: secret, NewName: name})
+}
+
+// handleRevokeAPIToken deletes the user's token {id}
+func handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	tokenID := chi.URLParam(r, "id")
+	if err := DeleteAPIToken(user.ID, tokenID); err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Error revoking API token %s: %v", tokenID, err)
+		http.Error(w, "Failed to revoke the token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s revoked API token %s", user.Username, tokenID)
+	renderAPITokens(w, r, apiTokensView{})
+}
+
+// renderAPITokens renders the API tokens section with the user's tokens
+func renderAPITokens(w http.ResponseWriter, r *http.Request, view apiTokensView) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store") // May hold a new token
+	renderTemplate(w, "_api_tokens.html", loadAPITokens(r, view))
+}
+
+// loadAPITokens fills in the user's tokens and the scopes to choose from
+func loadAPITokens(r *http.Request, view apiTokensView) apiTokensView {
+	var err error
+	if view.Tokens, err = GetAPITokens(currentUser(r).ID); err != nil {
+		log.Printf("Error fetching API tokens: %v", err)
+		view.Error = "Failed to load the tokens."
+	}
+	view.Scopes = apiTokenScopes
+	return view
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// --- Audit Log ---
+//
+// Handlers record an AuditEvent when a note is created, viewed, edited,
+// shared or deleted, with the request ID of the request log, the user and
+// their IP address. Events are append-only (see db.go). The admin reads
+// them under "Audit Log", filtered by action, user, note and date, and
+// downloads them as CSV.
+
+// auditPageSize is the number of events the audit log shows; the CSV
+// export has all of them
+const auditPageSize = 200
+
+// auditFailures counts events that could not be recorded, published at
+// /debug/vars
+var auditFailures = expvar.NewInt("audit_failures")
+
+// recordAudit records that the user of r did action to note. The request
+// has been served by then, so a failure is logged rather than answered.
+func recordAudit(r *http.Request, action AuditAction, note Note, detail string) {
+	auditorFor(r, action, detail)(note)
+}
+
+// auditorFor returns a function recording that the user of r did action
+// to a note, for work on notes that goes on after r is served, like a
+// bulk re-check
+func auditorFor(r *http.Request, action AuditAction, detail string) func(Note) {
+	user := currentUser(r)
+	requestID := middleware.GetReqID(r.Context())
+	ip := clientIP(r)
+	return func(note Note) {
+		event := AuditEvent{
+			Time:        time.Now(),
+			Action:      action,
+			RequestID:   requestID,
+			UserID:      user.ID,
+			Username:    user.Username,
+			IP:          ip,
+			NoteID:      note.ID,
+			WorkspaceID: note.workspace(),
+			Filename:    note.OriginalFilename,
+			Detail:      detail,
+		}
+		if err := InsertAuditEvent(event); err != nil {
+			auditFailures.Add(1)
+			log.Printf("Error recording audit event %s of note %s (request %s): %v", action, note.ID.Hex(), requestID, err)
+		}
+	}
+}
+
+// auditLogView is the data for _audit_log.html
+type auditLogView struct {
+	Events  []AuditEvent
+	Actions []AuditAction
+	More    bool // More events match than are shown
+
+	// The filter, as entered in the form
+	Action, Username, NoteID, From, To string
+	ExportURL                          string // CSV of the events matching the filter
+	Error                              string
+}
+
+// auditDateLayout is the format of the from and to dates, as sent by
+// <input type="date">
+const auditDateLayout = "2006-01-02"
+
+// auditFilterFromRequest reads the filter from the "action", "user",
+// "note", "from" and "to" query params. The dates are days in the
+// server's time zone; both are included.
+func auditFilterFromRequest(r *http.Request) (AuditFilter, error) {
+	q := r.URL.Query()
+	var filter AuditFilter
+	if action := AuditAction(q.Get("action")); action != "" {
+		known := false
+		for _, a := range auditActions {
+			known = known || a == action
+		}
+		if !known {
+			return filter, fmt.Errorf("unknown action %q", action)
+		}
+		filter.Action = action
+	}
+	filter.Username = strings.ToLower(strings.TrimSpace(q.Get("user")))
+	if note := strings.TrimSpace(q.Get("note")); note != "" {
+		id, err := primitive.ObjectIDFromHex(note)
+		if err != nil {
+			return filter, errors.New("the note ID is not valid")
+		}
+		filter.NoteID = id
+	}
+	var err error
+	if from := q.Get("from"); from != "" {
+		if filter.From, err = time.ParseInLocation(auditDateLayout, from, time.Local); err != nil {
+			return filter, errors.New("dates are YYYY-MM-DD")
+		}
+	}
+	if to := q.Get("to"); to != "" {
+		if filter.To, err = time.ParseInLocation(auditDateLayout, to, time.Local); err != nil {
+			return filter, errors.New("dates are YYYY-MM-DD")
+		}
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// handleAuditLog renders the newest audit events matching the filter of
+// the query params
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	view := auditLogView{
+		Actions:  auditActions,
+		Action:   q.Get("action"),
+		Username: q.Get("user"),
+		NoteID:   q.Get("note"),
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+	}
+	export := url.Values{}
+	for _, param := range []string{"action", "user", "note", "from", "to"} {
+		if value := q.Get(param); value != "" {
+			export.Set(param, value)
+		}
+	}
+	view.ExportURL = "/admin/audit/export?" + export.Encode()
+
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		view.Error = "Invalid filter: " + err.Error() + "."
+	} else {
+		events, err := GetAuditEvents(filter, auditPageSize+1)
+		if err != nil {
+			log.Printf("Error fetching audit events: %v", err)
+			view.Error = "Failed to load the audit log."
+		}
+		if len(events) > auditPageSize {
+			events, view.More = events[:auditPageSize], true
+		}
+		view.Events = events
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, "_audit_log.html", view)
+}
+
+// auditCSVHeader is the header row of the CSV export
+var auditCSVHeader = []string{"time", "action", "request_id", "user_id", "username", "ip", "workspace_id", "note_id", "filename", "detail"}
+
+// handleExportAuditLog downloads all audit events matching the filter of
+// the query params as CSV, oldest first
+func handleExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "notex-audit-"+time.Now().Format("20060102")+".csv"))
+	w.Header().Set("Cache-Control", "no-store")
+	out := csv.NewWriter(w)
+	_ = out.Write(auditCSVHeader)
+	err = EachAuditEvent(filter, func(event AuditEvent) error {
+		return out.Write(auditCSVRecord(event))
+	})
+	out.Flush()
+	if err == nil {
+		err = out.Error()
+	}
+	if err != nil {
+		// Too late for an error status; the download ends early
+		log.Printf("Error exporting audit events: %v", err)
+	}
+}
+
+// auditCSVRecord returns the CSV row of event
+func auditCSVRecord(event AuditEvent) []string {
+	userID := ""
+	if !event.UserID.IsZero() {
+		userID = event.UserID.Hex()
+	}
+	return []string{
+		event.Time.UTC().Format(time.RFC3339),
+		string(event.Action),
+		event.RequestID,
+		userID,
+		csvText(event.Username),
+		event.IP,
+		event.WorkspaceID.Hex(),
+		event.NoteID.Hex(),
+		csvText(event.Filename),
+		csvText(event.Detail),
+	}
+}
+
+// csvText keeps spreadsheets from running user-chosen text (filenames)
+// as a formula, by prefixing the characters that start one with a quote
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditFilterFromRequest(t *testing.T) {
+	filter, err := auditFilterFromRequest(httptest.NewRequest(http.MethodGet, "/admin/audit?action=view&user=+Alice&note=0123456789abcdef01234567&from=2026-01-02&to=2026-01-02", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	if filter.Action != AuditView || filter.Username != "alice" || filter.NoteID.Hex() != "0123456789abcdef01234567" ||
+		!filter.From.Equal(day) || !filter.To.Equal(day.AddDate(0, 0, 1)) {
+		t.Errorf("filter = %+v", filter)
+	}
+
+	for _, query := range []string{"action=bogus", "note=nope", "from=02/01/2026"} {
+		if _, err := auditFilterFromRequest(httptest.NewRequest(http.MethodGet, "/admin/audit?"+query, nil)); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
+
+func TestAuditCSVRecord(t *testing.T) {
+	record := auditCSVRecord(AuditEvent{Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Action: AuditCreate, Filename: "=HYPERLINK(\"x\").md", Detail: "upload"})
+	if record[0] != "2026-01-02T03:04:05Z" || record[3] != "" || record[8] != "'=HYPERLINK(\"x\").md" || record[9] != "upload" {
+		t.Errorf("record = %q", record)
+	}
+	if len(record) != len(auditCSVHeader) {
+		t.Errorf("%d fields, %d columns", len(record), len(auditCSVHeader))
+	}
+}
+
+// auditTestClient starts the app and returns a function making requests as
+// a user, forwarded for 203.0.113.7 by the test, a trusted proxy
+func auditTestClient(t *testing.T) func(user User, method, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	prevProxies := trustedProxies
+	trustedProxies, _ = parseTrustedProxies("127.0.0.1, ::1")
+	t.Cleanup(func() { trustedProxies = prevProxies })
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	sessions := map[string]*http.Cookie{}
+	return func(user User, method, path string, form url.Values) (*http.Response, string) {
+		t.Helper()
+		if sessions[user.Username] == nil {
+			rec := httptest.NewRecorder()
+			if err := startSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), user); err != nil {
+				t.Fatal(err)
+			}
+			sessions[user.Username] = rec.Result().Cookies()[0]
+		}
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.AddCookie(sessions[user.Username])
+		resp, err := http.DefaultClient.Do(withCSRF(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		return resp, body.String()
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, bob := createTestUsers(t)
+	id, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "audited.md", MarkdownContent: "Quarterly numbers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := auditTestClient(t)
+	notePath := "/notes/" + id.Hex()
+	do(alice, http.MethodGet, notePath+"?type=markdown", nil)
+	do(alice, http.MethodPost, notePath+"/shares", url.Values{"expires": {shareExpiries[1].Value()}})
+	do(alice, http.MethodDelete, notePath, nil)
+	do(bob, http.MethodGet, notePath+"?type=markdown", nil) // Not found: not recorded
+
+	events, err := GetAuditEvents(AuditFilter{NoteID: id}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, string(event.Action))
+		if event.Username != "alice" || event.IP != "203.0.113.7" || event.RequestID == "" || event.Filename != "audited.md" {
+			t.Errorf("%s event = %+v", event.Action, event)
+		}
+	}
+	if got := strings.Join(actions, ","); got != "delete,share,view" {
+		t.Errorf("actions, newest first = %s, want delete,share,view", got)
+	}
+
+	// Only the admin reads the log
+	if resp, _ := do(bob, http.MethodGet, "/admin/audit", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bob reading the audit log: status %d, want 403", resp.StatusCode)
+	}
+	if resp, body := do(alice, http.MethodGet, "/admin/audit?action=share", nil); resp.StatusCode != http.StatusOK ||
+		!strings.Contains(body, "audited.md") || strings.Contains(body, "<td>delete</td>") {
+		t.Errorf("filtered audit log: status %d, body %s", resp.StatusCode, body)
+	}
+	resp, body := do(alice, http.MethodGet, "/admin/audit/export?user=alice", nil)
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil || resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" || len(rows) != 4 || rows[1][1] != "view" {
+		t.Errorf("CSV export: %q, %v", rows, err)
+	}
+}
+
+func TestAuditLogExportsRevocationsAndRechecks(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, _ := createTestUsers(t)
+	ids := createRecheckNotes(t, alice.ID, 2)
+	newFakeLanguageTool(t, typoHandler)
+	shareID, err := CreateShare(Share{Token: "audit-test", NoteID: ids[0], WorkspaceID: alice.ID, OwnerID: alice.ID, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := auditTestClient(t)
+
+	do(alice, http.MethodGet, "/notes/export?format=json", nil)
+	do(alice, http.MethodDelete, "/shares/"+shareID.Hex(), nil)
+	do(alice, http.MethodDelete, "/shares/"+shareID.Hex(), nil) // Already revoked: not recorded
+	do(alice, http.MethodPost, "/notes/"+ids[0].Hex()+"/recheck", nil)
+	do(alice, http.MethodPost, "/notes/recheck", nil)
+	waitFor(t, func() bool { return !CurrentRecheckProgress(alice.ID).Running })
+
+	for i, want := range [][]string{
+		{"check re-check", "check re-check of all notes", "share revoke share " + shareID.Hex(), "view export of all notes"},
+		{"check re-check of all notes", "view export of all notes"},
+	} {
+		events, err := GetAuditEvents(AuditFilter{NoteID: ids[i]}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, event := range events {
+			got = append(got, string(event.Action)+" "+event.Detail)
+			if event.Username != "alice" || event.RequestID == "" || event.Filename != fmt.Sprintf("note%d.md", i) {
+				t.Errorf("%s event = %+v", event.Action, event)
+			}
+		}
+		sort.Strings(got) // Events of the same millisecond come in any order
+		if strings.Join(got, "; ") != strings.Join(want, "; ") {
+			t.Errorf("events of note %d = %q, want %q", i, got, want)
+		}
+	}
+}
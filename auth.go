@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- Accounts ---
+//
+// Users sign up with a username and password and get a server-side
+// session, kept in a cookie. All routes except the login pages and static
+// files require a session; handlers find the user with currentUser.
+
+// Errors of signing up and in
+var (
+	errInvalidLogin     = errors.New("invalid username or password")
+	errInvalidUsername  = errors.New("invalid username")
+	errPasswordTooShort = errors.New("password too short")
+	errPasswordTooLong  = errors.New("password too long")
+	errSignupClosed     = errors.New("sign-up is closed")
+	errPasswordMismatch = errors.New("passwords don't match")
+)
+
+// loginMessages are the messages the login and sign-up forms show for
+// those errors
+var loginMessages = map[error]string{
+	errInvalidLogin:     "Invalid username or password.",
+	errInvalidUsername:  "Usernames are 3 to 32 characters: letters, digits, '.', '-' or '_'.",
+	errPasswordTooShort: "Passwords need at least 8 characters.",
+	errPasswordTooLong:  "Passwords can be at most 72 bytes long.",
+	errSignupClosed:     "Sign-up is closed. Ask the administrator for an account.",
+	errPasswordMismatch: "The passwords don't match.",
+	errUsernameTaken:    "That username is taken.",
+}
+
+// Password length limits; bcrypt ignores everything after 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// hashPassword returns the bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errPasswordTooShort
+	}
+	if len(password) > maxPasswordLength {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword reports whether password matches the bcrypt hash
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// dummyPasswordHash is compared against when a username doesn't exist,
+// so that a login takes as long whether the user exists or not
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return string(hash)
+})
+
+// normalizeUsername lowercases a username and checks its characters
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if len(username) < 3 || len(username) > 32 {
+		return "", errInvalidUsername
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return "", errInvalidUsername
+		}
+	}
+	return username, nil
+}
+
+// registerMu serializes sign-ups, so that exactly one first user becomes
+// the admin
+var registerMu sync.Mutex
+
+// RegisterUser creates an account and its personal workspace. The first
+// account is the admin and takes over the notes and settings saved before
+// there were accounts.
+func RegisterUser(username, password string) (User, error) {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	return createAccount(User{Username: username, PasswordHash: hash}, true)
+}
+
+// createAccount saves a new user and creates their personal workspace.
+// With firstIsAdmin, the first account becomes the admin; either way, an
+// admin first account takes over the data from before there were
+// accounts.
+func createAccount(user User, firstIsAdmin bool) (User, error) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	count, err := CountUsers()
+	if err != nil {
+		return User{}, err
+	}
+	user.Admin = user.Admin || (firstIsAdmin && count == 0)
+	if user.ID, err = CreateUser(user); err != nil {
+		return User{}, err
+	}
+	if _, err := EnsurePersonalWorkspace(user); err != nil {
+		log.Printf("Error creating the personal workspace of %s: %v", user.Username, err) // Retried on their first request
+	}
+	if user.Admin && count == 0 {
+		if err := ClaimLegacyData(user.ID); err != nil {
+			log.Printf("Error assigning existing notes to %s: %v", user.Username, err)
+		}
+	}
+	return user, nil
+}
+
+// Authenticate returns the user with the given username and password
+func Authenticate(username, password string) (User, error) {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return User{}, errInvalidLogin
+	}
+	user, err := GetUserByUsername(username)
+	if err == mongo.ErrNoDocuments {
+		checkPassword(dummyPasswordHash(), password)
+		return User{}, errInvalidLogin
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if user.PasswordHash == "" { // Signs in with the OIDC provider only
+		checkPassword(dummyPasswordHash(), password)
+		return User{}, errInvalidLogin
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return User{}, errInvalidLogin
+	}
+	return user, nil
+}
+
+// signupOpen reports whether new accounts may be created: always for the
+// first account, afterwards only with ALLOW_SIGNUP=true. With OIDC_ONLY,
+// accounts are only created by single sign-on.
+func signupOpen() (bool, error) {
+	if passwordLoginDisabled() {
+		return false, nil
+	}
+	if os.Getenv("ALLOW_SIGNUP") == "true" {
+		return true, nil
+	}
+	count, err := CountUsers()
+	return count == 0, err
+}
+
+// --- Sessions ---
+
+// sessionCookieName is the name of the session cookie
+const sessionCookieName = "notex_session"
+
+// sessionTTL is how long a session lasts, read from SESSION_TTL
+// (a duration such as "168h")
+func sessionTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// errNoSession is returned by sessionUser for requests without a valid
+// session
+var errNoSession = errors.New("not signed in")
+
+// sessionKey returns the stored key of a session token
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session for user and sets its cookie
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	session := Session{Key: sessionKey(token), UserID: user.ID, CreatedAt: now, ExpiresAt: now.Add(sessionTTL())}
+	if err := CreateSession(session); err != nil {
+		return err
+	}
+	setSessionCookie(w, r, token, session.ExpiresAt)
+	return nil
+}
+
+// endSession deletes the request's session, if any, and its cookie
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := DeleteSession(sessionKey(cookie.Value)); err != nil {
+			log.Printf("Error deleting session: %v", err)
+		}
+	}
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+}
+
+// secureCookies reports whether cookies should be Secure: over TLS, or
+// behind a TLS proxy with COOKIE_SECURE=true
+func secureCookies(r *http.Request) bool {
+	return r.TLS != nil || os.Getenv("COOKIE_SECURE") == "true"
+}
+
+// setSessionCookie sets the session cookie; an empty token deletes it
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// sessionUser returns the user signed in with the request's session
+func sessionUser(r *http.Request) (User, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return User{}, errNoSession
+	}
+	session, err := GetSession(sessionKey(cookie.Value))
+	if err == mongo.ErrNoDocuments {
+		return User{}, errNoSession
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user, err := GetUserByID(session.UserID)
+	if err == mongo.ErrNoDocuments {
+		return User{}, errNoSession // Account deleted
+	}
+	return user, err
+}
+
+type userKey struct{}
+
+// currentUser returns the signed-in user of a request that went through
+// requireUser. Without one, it returns the zero User, which owns no notes.
+func currentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey{}).(User)
+	return user
+}
+
+// requireUser lets only requests with a valid session or API token
+// through, making the user available to handlers through currentUser.
+// Requests with an invalid token get a 401; others are sent to the login
+// page.
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			user, token, err := tokenUser(header)
+			if err != nil {
+				if err != errInvalidToken {
+					log.Printf("Error checking API token: %v", err)
+					http.Error(w, "Error checking API token", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withToken(r.Context(), user, token)))
+			return
+		}
+
+		user, err := sessionUser(r)
+		if err != nil {
+			if err != errNoSession {
+				log.Printf("Error checking session: %v", err)
+				http.Error(w, "Error checking session", http.StatusInternalServerError)
+				return
+			}
+			redirectToLogin(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// requireAdmin lets only the admin through; it must come after
+// requireUser
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToLogin sends the browser to the login page. HTMX requests get
+// an HX-Redirect, so the whole page changes rather than a fragment.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Header.Get("HX-Request") == "true":
+		w.Header().Set("HX-Redirect", "/login")
+		http.Error(w, "Not signed in", http.StatusUnauthorized)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	default:
+		http.Error(w, "Not signed in", http.StatusUnauthorized)
+	}
+}
+
+// --- Handlers ---
+
+// loginView is the data for the login page
+type loginView struct {
+	Title      string
+	Signup     bool // Show the sign-up form instead of the login form
+	SignupOpen bool
+	Username   string
+	Error      string
+	CSRFToken  string
+	CSPNonce   string
+
+	PasswordLogin bool   // Show the username and password form
+	SSOName       string // Name of the OIDC provider; empty without single sign-on
+}
+
+// handleLoginPage renders the login form, or the sign-up form for
+// /signup
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if _, err := sessionUser(r); err == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	renderLogin(w, r, http.StatusOK, loginView{Signup: r.URL.Path == "/signup"})
+}
+
+// handleLogin signs in with the posted username and password
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if passwordLoginDisabled() {
+		renderLogin(w, r, http.StatusForbidden, loginView{})
+		return
+	}
+	username := r.FormValue("username")
+	user, err := Authenticate(username, r.FormValue("password"))
+	if err == errInvalidLogin {
+		renderLogin(w, r, http.StatusUnauthorized, loginView{Username: username, Error: loginMessages[err]})
+		return
+	}
+	if err != nil {
+		log.Printf("Error signing in %q: %v", username, err)
+		renderLogin(w, r, http.StatusInternalServerError, loginView{Username: username, Error: "Signing in failed, please try again."})
+		return
+	}
+
+	if err := startSession(w, r, user); err != nil {
+		log.Printf("Error starting session for %s: %v", user.Username, err)
+		renderLogin(w, r, http.StatusInternalServerError, loginView{Username: username, Error: "Signing in failed, please try again."})
+		return
+	}
+	log.Printf("User %s signed in", user.Username)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleSignup creates an account from the posted form and signs it in
+func handleSignup(w http.ResponseWriter, r *http.Request) {
+	view := loginView{Signup: true, Username: r.FormValue("username")}
+	open, err := signupOpen()
+	if err != nil {
+		log.Printf("Error counting users: %v", err)
+		http.Error(w, "Sign-up failed", http.StatusInternalServerError)
+		return
+	}
+	if !open {
+		view.Error = loginMessages[errSignupClosed]
+		renderLogin(w, r, http.StatusForbidden, view)
+		return
+	}
+
+	user, err := User{}, errPasswordMismatch
+	if r.FormValue("password") == r.FormValue("confirm") {
+		user, err = RegisterUser(view.Username, r.FormValue("password"))
+	}
+	if message, ok := loginMessages[err]; ok {
+		view.Error = message
+		renderLogin(w, r, http.StatusBadRequest, view)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating user %q: %v", view.Username, err)
+		http.Error(w, "Sign-up failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s signed up (admin: %v)", user.Username, user.Admin)
+
+	if err := startSession(w, r, user); err != nil {
+		log.Printf("Error starting session for %s: %v", user.Username, err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleLogout ends the session and returns to the login page
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	endSession(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// renderLogin renders the login page with the given status
+func renderLogin(w http.ResponseWriter, r *http.Request, status int, view loginView) {
+	open, err := signupOpen()
+	if err != nil {
+		log.Printf("Error counting users: %v", err)
+	}
+	view.SignupOpen = open
+	if view.Signup && !open && view.Error == "" {
+		view.Error = loginMessages[errSignupClosed]
+	}
+	view.Title = "Sign in - NoteX"
+	if view.Signup {
+		view.Title = "Sign up - NoteX"
+	}
+	view.PasswordLogin = !passwordLoginDisabled()
+	if config, ok := oidcConfigFromEnv(); ok {
+		view.SSOName = config.Name
+	}
+	view.CSRFToken = csrfToken(w, r)
+	view.CSPNonce = cspNonce(r)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderPage(w, "login.html", view)
+}
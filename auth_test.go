@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "correct horse") {
+		t.Fatal("hash contains the password")
+	}
+	if !checkPassword(hash, "correct horse") {
+		t.Error("checkPassword rejects the right password")
+	}
+	if checkPassword(hash, "correct horse!") {
+		t.Error("checkPassword accepts a wrong password")
+	}
+
+	if _, err := hashPassword("short"); err != errPasswordTooShort {
+		t.Errorf("short password: %v, want errPasswordTooShort", err)
+	}
+	if _, err := hashPassword(strings.Repeat("a", 73)); err != errPasswordTooLong {
+		t.Errorf("long password: %v, want errPasswordTooLong", err)
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	for input, want := range map[string]string{
+		" Alice ":    "alice",
+		"bob.smith_": "bob.smith_",
+		"ab":         "",
+		"al ice":     "",
+		"élise":      "",
+	} {
+		got, err := normalizeUsername(input)
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("normalizeUsername(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	LoadTemplates()
+	router := newRouter()
+
+	tests := []struct {
+		name       string
+		method     string
+		htmx       bool
+		wantStatus int
+		wantHeader string // Header pointing to the login page
+	}{
+		{"page", http.MethodGet, false, http.StatusSeeOther, "Location"},
+		{"htmx fragment", http.MethodGet, true, http.StatusUnauthorized, "HX-Redirect"},
+		{"form post", http.MethodDelete, false, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/notes/0123456789abcdef01234567", nil)
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, withCSRF(req))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantHeader != "" && rec.Header().Get(tt.wantHeader) != "/login" {
+				t.Errorf("%s = %q, want /login", tt.wantHeader, rec.Header().Get(tt.wantHeader))
+			}
+		})
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	for _, tt := range []struct {
+		scopes []string
+		want   map[string]bool
+	}{
+		{[]string{ScopeRead}, map[string]bool{ScopeRead: true, ScopeWrite: false, ScopeAdmin: false}},
+		{[]string{ScopeWrite}, map[string]bool{ScopeRead: true, ScopeWrite: true, ScopeAdmin: false}},
+		{[]string{ScopeAdmin}, map[string]bool{ScopeRead: true, ScopeWrite: true, ScopeAdmin: true}},
+		{[]string{"bogus"}, map[string]bool{ScopeRead: false, ScopeWrite: false, ScopeAdmin: false}},
+		{nil, map[string]bool{ScopeRead: false, "bogus": false}},
+	} {
+		token := APIToken{Scopes: tt.scopes}
+		for scope, want := range tt.want {
+			if got := token.HasScope(scope); got != want {
+				t.Errorf("%v.HasScope(%q) = %v, want %v", tt.scopes, scope, got, want)
+			}
+		}
+	}
+
+	// requireMethodScope, with the token requireUser would have added
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := requireMethodScope(ok)
+	for _, tt := range []struct {
+		scope, method string
+		wantStatus    int
+	}{
+		{ScopeRead, http.MethodGet, http.StatusOK},
+		{ScopeRead, http.MethodPost, http.StatusForbidden},
+		{ScopeRead, http.MethodDelete, http.StatusForbidden},
+		{ScopeWrite, http.MethodPut, http.StatusOK},
+		{"", http.MethodPost, http.StatusOK}, // A session, not a token
+	} {
+		req := httptest.NewRequest(tt.method, "/notes", nil)
+		if tt.scope != "" {
+			req = req.WithContext(withToken(req.Context(), User{}, APIToken{Scopes: []string{tt.scope}}))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s token, %s: status %d, want %d", tt.scope, tt.method, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+// useTestDB points the collections at a new, empty database on the
+// server in MONGODB_URI, dropped when the test ends. Tests using it are
+// skipped without MONGODB_URI.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testClient, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	db := testClient.Database("notex_test_" + hex.EncodeToString(b))
+
+	collections := []**mongo.Collection{&notesCollection, &settingsCollection, &usersCollection, &sessionsCollection, &apiTokensCollection, &sharesCollection, &workspacesCollection, &invitationsCollection, &auditCollection}
+	saved := make([]*mongo.Collection, len(collections))
+	for i, c := range collections {
+		saved[i] = *c
+	}
+	notesCollection = db.Collection("notes")
+	settingsCollection = db.Collection("settings")
+	usersCollection = db.Collection("users")
+	sessionsCollection = db.Collection("sessions")
+	apiTokensCollection = db.Collection("apiTokens")
+	sharesCollection = db.Collection("shares")
+	workspacesCollection = db.Collection("workspaces")
+	invitationsCollection = db.Collection("invitations")
+	auditCollection = db.Collection("auditEvents")
+	t.Cleanup(func() {
+		for i, c := range collections {
+			*c = saved[i]
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		testClient.Disconnect(ctx)
+	})
+
+	if err := createIndexes(ctx); err != nil {
+		t.Fatalf("Failed to create indexes: %v", err)
+	}
+}
+
+// testCSRFToken is the CSRF token of test requests; see withCSRF
+const testCSRFToken = "test-csrf-token"
+
+// withCSRF adds the CSRF cookie and header a page would send to req
+func withCSRF(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeader, testCSRFToken)
+	return req
+}
+
+// postForm posts form to target like a form on a page would
+func postForm(client *http.Client, target string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(withCSRF(req))
+}
+
+// createTestUsers signs up alice (the admin) and bob
+func createTestUsers(t *testing.T) (alice, bob User) {
+	t.Helper()
+	alice, err := RegisterUser("alice", "alice password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = RegisterUser("bob", "bob password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alice.Admin || bob.Admin {
+		t.Fatalf("admin flags: alice %v, bob %v; want only the first user", alice.Admin, bob.Admin)
+	}
+	return alice, bob
+}
+
+func TestNoteIsolation(t *testing.T) {
+	useTestDB(t)
+	alice, bob := createTestUsers(t)
+
+	if _, err := CreateNote(Note{OriginalFilename: "orphan.md"}); err != errNoOwner {
+		t.Errorf("CreateNote without owner: %v, want errNoOwner", err)
+	}
+	id, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "secret.md", MarkdownContent: "Alice's secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob can't list, read, update or delete it
+	if notes, err := GetAllNotes(bob.ID, NoteFilter{}); err != nil || len(notes) != 0 {
+		t.Errorf("GetAllNotes(bob) = %d notes, %v; want none", len(notes), err)
+	}
+	if ids, err := GetNoteIDs(bob.ID); err != nil || len(ids) != 0 {
+		t.Errorf("GetNoteIDs(bob) = %v, %v; want none", ids, err)
+	}
+	if names, err := GetNoteFilenames(bob.ID); err != nil || len(names) != 0 {
+		t.Errorf("GetNoteFilenames(bob) = %v, %v; want none", names, err)
+	}
+	if _, err := GetNoteByID(bob.ID, id.Hex()); err != mongo.ErrNoDocuments {
+		t.Errorf("GetNoteByID(bob) error %v, want mongo.ErrNoDocuments", err)
+	}
+	stolen := Note{ID: id, OwnerID: bob.ID, MarkdownContent: "Bob was here"}
+	if err := UpdateNoteContent(stolen); err != mongo.ErrNoDocuments {
+		t.Errorf("UpdateNoteContent as bob: %v, want mongo.ErrNoDocuments", err)
+	}
+	if err := DeleteNoteByID(bob.ID, id.Hex()); err != mongo.ErrNoDocuments {
+		t.Errorf("DeleteNoteByID(bob) error %v, want mongo.ErrNoDocuments", err)
+	}
+
+	// Alice still has it, unchanged
+	note, err := GetNoteByID(alice.ID, id.Hex())
+	if err != nil || note.MarkdownContent != "Alice's secret" {
+		t.Fatalf("GetNoteByID(alice) = %q, %v", note.MarkdownContent, err)
+	}
+	if notes, err := GetAllNotes(alice.ID, NoteFilter{}); err != nil || len(notes) != 1 {
+		t.Errorf("GetAllNotes(alice) = %d notes, %v; want 1", len(notes), err)
+	}
+
+	// Settings are per user too
+	if err := AddGrammarSetting(alice.ID, "dictionary", "notex"); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err := GetGrammarSettings(bob.ID); err != nil || len(settings.Dictionary) != 0 {
+		t.Errorf("bob's dictionary = %v, %v; want empty", settings.Dictionary, err)
+	}
+}
+
+func TestNoteIsolationHTTP(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, bob := createTestUsers(t)
+	id, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "secret.md", MarkdownContent: "Alice's secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	login := func(username, password string) *http.Cookie {
+		t.Helper()
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := postForm(client, server.URL+"/login", url.Values{"username": {username}, "password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			if c.Name == sessionCookieName && c.Value != "" {
+				return c
+			}
+		}
+		t.Fatalf("login as %s: status %d, no session cookie", username, resp.StatusCode)
+		return nil
+	}
+	resp, err := postForm(http.DefaultClient, server.URL+"/login", url.Values{"username": {"bob"}, "password": {"alice password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login with the wrong password: status %d, want 401", resp.StatusCode)
+	}
+	bobSession := login(bob.Username, "bob password")
+	aliceSession := login(alice.Username, "alice password")
+
+	do := func(session *http.Cookie, method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.AddCookie(session)
+		req.Header.Set("HX-Request", "true")
+		resp, err := http.DefaultClient.Do(withCSRF(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	notePath := "/notes/" + id.Hex()
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodGet, notePath},
+		{http.MethodGet, notePath + "?type=markdown"},
+		{http.MethodGet, notePath + "/edit"},
+		{http.MethodGet, notePath + "/export"},
+		{http.MethodPost, notePath + "/recheck"},
+	} {
+		if status, body := do(bobSession, tt.method, tt.path); status != http.StatusNotFound || strings.Contains(body, "secret") {
+			t.Errorf("bob %s %s: status %d, want 404 without the note", tt.method, tt.path, status)
+		}
+	}
+	if _, body := do(bobSession, http.MethodGet, "/notes"); strings.Contains(body, "secret.md") {
+		t.Error("bob's note list shows alice's note")
+	}
+	do(bobSession, http.MethodDelete, notePath)
+
+	if status, body := do(aliceSession, http.MethodGet, notePath+"?type=markdown"); status != http.StatusOK || body != "Alice's secret" {
+		t.Errorf("alice reading her note after bob's delete: status %d, body %q", status, body)
+	}
+
+	// The note's HTML on its own is sandboxed, away from the app's origin
+	req, _ := http.NewRequest(http.MethodGet, server.URL+notePath+"?type=html", nil)
+	req.AddCookie(aliceSession)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+		if policy := resp.Header.Get("Content-Security-Policy"); !strings.HasPrefix(policy, "sandbox;") {
+			t.Errorf("CSP of the note's HTML: %q", policy)
+		}
+	}
+
+	// After logging out, the session is gone
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/logout", nil)
+	req.AddCookie(aliceSession)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if resp, err := client.Do(withCSRF(req)); err == nil {
+		resp.Body.Close()
+	}
+	if status, _ := do(aliceSession, http.MethodGet, notePath); status != http.StatusUnauthorized {
+		t.Errorf("request after logout: status %d, want 401", status)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, bob := createTestUsers(t)
+	id, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "secret.md", MarkdownContent: "Alice's secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken := func(owner User, scope string) (string, APIToken) {
+		t.Helper()
+		secret, token, err := newAPIToken(owner, scope+" token", []string{scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(token.Hash, secret) || token.Hash == "" {
+			t.Fatal("token not hashed")
+		}
+		if token.ID, err = CreateAPIToken(token); err != nil {
+			t.Fatal(err)
+		}
+		return secret, token
+	}
+	readSecret, readToken := newToken(alice, ScopeRead)
+	writeSecret, _ := newToken(alice, ScopeWrite)
+	bobSecret, _ := newToken(bob, ScopeAdmin)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	do := func(secret, method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	notePath := "/notes/" + id.Hex()
+	if status, body := do(readSecret, http.MethodGet, notePath+"?type=markdown"); status != http.StatusOK || body != "Alice's secret" {
+		t.Errorf("read token GET: status %d, body %q", status, body)
+	}
+	if status, _ := do(bobSecret, http.MethodGet, notePath+"?type=markdown"); status != http.StatusNotFound {
+		t.Errorf("bob's token reading alice's note: status %d, want 404", status)
+	}
+	if status, _ := do("ntx_wrong", http.MethodGet, "/notes"); status != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d, want 401", status)
+	}
+
+	// Scopes: read can't write, write can't manage tokens
+	if status, _ := do(readSecret, http.MethodDelete, notePath); status != http.StatusForbidden {
+		t.Errorf("read token DELETE: status %d, want 403", status)
+	}
+	if status, _ := do(writeSecret, http.MethodGet, "/settings/tokens"); status != http.StatusForbidden {
+		t.Errorf("write token listing tokens: status %d, want 403", status)
+	}
+	if _, err := GetNoteByID(alice.ID, id.Hex()); err != nil {
+		t.Fatalf("note gone after the read token's DELETE: %v", err)
+	}
+
+	// Use is recorded
+	tokens, err := GetAPITokens(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		if token.ID == readToken.ID && token.LastUsedAt.IsZero() {
+			t.Error("last use of the read token not recorded")
+		}
+	}
+
+	// Revoked tokens stop working; bob can't revoke alice's
+	if status, _ := do(bobSecret, http.MethodDelete, "/settings/tokens/"+readToken.ID.Hex()); status != http.StatusOK {
+		t.Errorf("bob revoking alice's token: status %d", status)
+	}
+	if status, _ := do(readSecret, http.MethodGet, "/notes"); status != http.StatusOK {
+		t.Errorf("alice's token after bob's revoke: status %d, want 200", status)
+	}
+	if err := DeleteAPIToken(alice.ID, readToken.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := do(readSecret, http.MethodGet, "/notes"); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", status)
+	}
+}
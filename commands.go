@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// runCommand runs a command line tool instead of the web server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "recheck":
+		return runRecheck(args)
+	case "export":
+		return runExport(args)
+	case "rotate-keys":
+		return runRotateKeys(args)
+	default:
+		return fmt.Errorf("unknown command (available: recheck, export, rotate-keys)")
+	}
+}
+
+// runRecheck re-checks the notes of all workspaces, or of those of one
+// user, with their current settings and the current checker, logging
+// progress as it goes
+func runRecheck(args []string) error {
+	flags := flag.NewFlagSet("recheck", flag.ContinueOnError)
+	username := flags.String("user", "", "only re-check the notes of the workspaces of this user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ConnectDB()
+	defer DisconnectDB()
+	workspaces, err := commandWorkspaces(*username)
+	if err != nil {
+		return err
+	}
+	InitGrammarChecker()
+	if grammarChecker != nil {
+		defer grammarChecker.StopServer()
+	}
+
+	// Ctrl-C stops the re-check; the note being checked is left as it was
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, ws := range workspaces {
+		log.Printf("Re-checking the notes of %s", ws.Name)
+		err := RecheckAll(ctx, ws.ID, nil, func(p RecheckProgress) {
+			if p.Done > 0 {
+				log.Printf("Re-checked %d/%d notes (%d failed)", p.Done, p.Total, p.Failed)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Re-check complete with %s", CurrentCheckerVersion())
+	return nil
+}
+
+// runExport writes the grammar report of the notes given by ID, or of all
+// notes, to standard output or a file. Issues are exported as stored; run
+// recheck first to refresh them.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "json", "report format: "+strings.Join(exportFormatNames(), ", "))
+	output := flags.String("o", "", "write the report to this file instead of standard output")
+	username := flags.String("user", "", "only export the notes of the workspaces of this user")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: notex export [-format json|sarif|checkstyle] [-o file] [-user name] [note-id ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := exportFormats[*format]; !ok {
+		return fmt.Errorf("unknown report format %q (available: %s)", *format, strings.Join(exportFormatNames(), ", "))
+	}
+
+	ConnectDB()
+	defer DisconnectDB()
+	workspaces, err := commandWorkspaces(*username)
+	if err != nil {
+		return err
+	}
+
+	// Issues are filtered by their workspace's settings here, as
+	// WriteReport takes the settings of a single workspace
+	var notes []Note
+	wanted := map[string]bool{}
+	for _, id := range flags.Args() {
+		wanted[id] = true
+	}
+	for _, ws := range workspaces {
+		wsNotes, err := GetAllNotes(ws.ID, NoteFilter{Sort: "oldest"})
+		if err != nil {
+			return err
+		}
+		settings, err := GetGrammarSettings(ws.ID)
+		if err != nil {
+			log.Printf("Error loading grammar settings of %s, exporting all issues: %v", ws.Name, err)
+		}
+		for _, note := range wsNotes {
+			if len(wanted) > 0 && !wanted[note.ID.Hex()] {
+				continue
+			}
+			delete(wanted, note.ID.Hex())
+			note.GrammarIssues = settings.FilterIssues(note.GrammarIssues)
+			notes = append(notes, note)
+		}
+	}
+	for id := range wanted {
+		return fmt.Errorf("note %s: not found", id)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+	err = WriteReport(w, *format, notes, GrammarSettings{})
+	if err == nil {
+		err = w.Flush()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// runRotateKeys re-encrypts every note not encrypted under the current
+// master key, the first of NOTE_ENCRYPTION_KEY (or the key file), with a
+// new data key. Notes stored in plaintext are encrypted. It can run while
+// the server does; once done, the other keys can be removed.
+func runRotateKeys(args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ConnectDB()
+	defer DisconnectDB()
+	if noteKeys == nil {
+		return fmt.Errorf("no master key configured; set NOTE_ENCRYPTION_KEY or NOTE_ENCRYPTION_KEY_FILE")
+	}
+	ids, err := GetNoteIDsToReseal(noteKeys.current.id)
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C stops the rotation; run it again to finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Re-encrypting %d notes with master key %s", len(ids), noteKeys.current.id)
+	resealed := 0
+	for i, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, err := ResealNote(id)
+		if err != nil {
+			return fmt.Errorf("note %s: %w", id.Hex(), err)
+		}
+		if ok {
+			resealed++
+		}
+		if (i+1)%100 == 0 {
+			log.Printf("Re-encrypted %d/%d notes", i+1, len(ids))
+		}
+	}
+	log.Printf("Rotation complete: %d notes re-encrypted, %d changed or deleted meanwhile", resealed, len(ids)-resealed)
+	return nil
+}
+
+// commandWorkspaces returns the workspaces of the user with the given
+// name, or all workspaces if username is empty
+func commandWorkspaces(username string) ([]Workspace, error) {
+	if username == "" {
+		return GetAllWorkspaces()
+	}
+	user, err := GetUserByUsername(strings.ToLower(username))
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("no user %q", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return GetUserWorkspaces(user.ID)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// --- CSRF Protection ---
+//
+// Requests that change something (anything but GET, HEAD and OPTIONS)
+// must carry the token held in the CSRF cookie, which other sites can
+// neither read nor set. Pages put the token in base.html: htmx sends it
+// in the X-CSRF-Token header (hx-headers on <body>), scripts read it from
+// the csrf-token meta tag, and plain forms post it in the csrf_token
+// field. Requests with an API token are exempt, as browsers never add an
+// Authorization header on their own.
+
+const (
+	csrfCookieName = "notex_csrf"
+	csrfHeader     = "X-CSRF-Token"
+	csrfField      = "csrf_token"
+)
+
+// csrfToken returns the CSRF token of the browser, setting a new one if
+// it has none yet. Handlers rendering pages pass it to base.html.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error creating CSRF token: %v", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true, // Pages get the token from the server, never from the cookie
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// verifyCSRF rejects requests that change something without the
+// browser's CSRF token
+func verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r) // API tokens; see requireUser
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			// Only plain forms post the field. Multipart bodies (uploads)
+			// are left for their handlers to parse with their own limits.
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+				sent = r.PostFormValue(csrfField)
+			}
+		}
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) != 1 {
+			log.Printf("Rejected %s %s: missing or wrong CSRF token", r.Method, r.URL.Path)
+			csrfError(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfError answers a request turned down by verifyCSRF. htmx requests
+// get a message fragment, shown above the page instead of their usual
+// target (see static/app.js).
+func csrfError(w http.ResponseWriter, r *http.Request) {
+	const message = "This page is out of date or was opened from another site, so the request was blocked. Reload the page and try again."
+	if r.Header.Get("HX-Request") != "true" {
+		http.Error(w, "Forbidden: "+message, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("HX-Retarget", "#request-error")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	w.WriteHeader(http.StatusForbidden)
+	renderTemplate(w, "_request_error.html", message)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCSRF(t *testing.T) {
+	LoadTemplates()
+	handler := verifyCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	form := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+		return req
+	}
+	bearer := httptest.NewRequest(http.MethodDelete, "/notes/x", nil)
+	bearer.Header.Set("Authorization", "Bearer ntx_token")
+	noCookie := httptest.NewRequest(http.MethodDelete, "/notes/x", nil)
+	noCookie.Header.Set(csrfHeader, testCSRFToken)
+
+	for _, tt := range []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+	}{
+		{"get", httptest.NewRequest(http.MethodGet, "/notes", nil), http.StatusOK},
+		{"no token", httptest.NewRequest(http.MethodDelete, "/notes/x", nil), http.StatusForbidden},
+		{"no cookie", noCookie, http.StatusForbidden},
+		{"header", withCSRF(httptest.NewRequest(http.MethodDelete, "/notes/x", nil)), http.StatusOK},
+		{"form field", form(testCSRFToken), http.StatusOK},
+		{"wrong form field", form("other"), http.StatusForbidden},
+		{"api token", bearer, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tt.req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+	}
+
+	// htmx gets a fragment for the error area of the page
+	req := httptest.NewRequest(http.MethodPost, "/notes", nil)
+	req.Header.Set("HX-Request", "true")
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeader, "stale")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Header().Get("HX-Retarget") != "#request-error" || !strings.Contains(rec.Body.String(), "Reload the page") {
+		t.Errorf("htmx request with a stale token: status %d, HX-Retarget %q", rec.Code, rec.Header().Get("HX-Retarget"))
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -15,6 +17,15 @@ import (
 
 var client *mongo.Client
 var notesCollection *mongo.Collection
+var settingsCollection *mongo.Collection
+var grammarCacheCollection *mongo.Collection
+var usersCollection *mongo.Collection
+var sessionsCollection *mongo.Collection
+var apiTokensCollection *mongo.Collection
+var sharesCollection *mongo.Collection
+var workspacesCollection *mongo.Collection
+var invitationsCollection *mongo.Collection
+var auditCollection *mongo.Collection
 
 // ConnectDB initializes the MongoDB connection
 func ConnectDB() {
@@ -60,6 +71,61 @@ func ConnectDB() {
 
 	log.Println("Successfully connected to MongoDB!")
 	notesCollection = client.Database(dbName).Collection("notes")
+	settingsCollection = client.Database(dbName).Collection("settings")
+	grammarCacheCollection = client.Database(dbName).Collection("grammarCache")
+	usersCollection = client.Database(dbName).Collection("users")
+	sessionsCollection = client.Database(dbName).Collection("sessions")
+	apiTokensCollection = client.Database(dbName).Collection("apiTokens")
+	sharesCollection = client.Database(dbName).Collection("shares")
+	workspacesCollection = client.Database(dbName).Collection("workspaces")
+	invitationsCollection = client.Database(dbName).Collection("invitations")
+	auditCollection = client.Database(dbName).Collection("auditEvents")
+
+	if err := createIndexes(ctx); err != nil {
+		log.Fatalf("Failed to create MongoDB indexes: %v", err)
+	}
+	if err := migrateWorkspaces(); err != nil {
+		log.Fatalf("Failed to move notes into workspaces: %v", err)
+	}
+	if err := InitNoteEncryption(); err != nil {
+		log.Fatalf("Failed to load the note encryption keys: %v", err)
+	}
+	if noteKeys != nil {
+		log.Printf("Note content is encrypted with master key %s", noteKeys.current.id)
+	}
+}
+
+// createIndexes creates the indexes the queries rely on. Indexes that
+// already exist are left as they are.
+func createIndexes(ctx context.Context) error {
+	indexes := []struct {
+		collection *mongo.Collection
+		model      mongo.IndexModel
+	}{
+		{usersCollection, mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)}},
+		{usersCollection, mongo.IndexModel{Keys: bson.D{{Key: "oidcIssuer", Value: 1}, {Key: "oidcSubject", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"oidcSubject": bson.M{"$exists": true}})}},
+		{sessionsCollection, mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}},
+		{notesCollection, mongo.IndexModel{Keys: bson.D{{Key: "workspaceId", Value: 1}, {Key: "createdAt", Value: -1}}}},
+		{notesCollection, mongo.IndexModel{Keys: bson.D{{Key: "ownerId", Value: 1}}}}, // Storage quotas
+		{apiTokensCollection, mongo.IndexModel{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)}},
+		{apiTokensCollection, mongo.IndexModel{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}}},
+		{sharesCollection, mongo.IndexModel{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)}},
+		{sharesCollection, mongo.IndexModel{Keys: bson.D{{Key: "workspaceId", Value: 1}, {Key: "noteId", Value: 1}}}},
+		{sharesCollection, mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}},
+		{workspacesCollection, mongo.IndexModel{Keys: bson.D{{Key: "members.userId", Value: 1}}}},
+		{invitationsCollection, mongo.IndexModel{Keys: bson.D{{Key: "workspaceId", Value: 1}, {Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)}},
+		{invitationsCollection, mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}}}},
+		{invitationsCollection, mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}},
+		{auditCollection, mongo.IndexModel{Keys: bson.D{{Key: "time", Value: -1}}}},
+		{auditCollection, mongo.IndexModel{Keys: bson.D{{Key: "noteId", Value: 1}, {Key: "time", Value: -1}}}},
+		{auditCollection, mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}, {Key: "time", Value: -1}}}},
+	}
+	for _, index := range indexes {
+		if _, err := index.collection.Indexes().CreateOne(ctx, index.model); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // DisconnectDB closes the MongoDB connection
@@ -76,8 +142,50 @@ func DisconnectDB() {
 }
 
 // --- Database Operations ---
+//
+// Every note query is scoped to the workspace holding the notes: a note
+// of another workspace is reported as not found (mongo.ErrNoDocuments).
+// Whether the user may see or change the workspace's notes is up to the
+// policy layer (policy.go), before these are called.
+
+// errNoOwner is returned when saving a note that has no owner
+var errNoOwner = errors.New("note has no owner")
+
+// workspaceQuery returns the filter for the notes of workspace
+func workspaceQuery(workspace primitive.ObjectID) bson.M {
+	return bson.M{"workspaceId": workspace}
+}
+
+// noteQuery returns the filter for the note with the given ID, if it is
+// in workspace
+func noteQuery(workspace, id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "workspaceId": workspace}
+}
+
+// workspace returns the workspace of the note. Notes without one belong
+// to the personal workspace of their owner.
+func (n Note) workspace() primitive.ObjectID {
+	if n.WorkspaceID.IsZero() {
+		return n.OwnerID
+	}
+	return n.WorkspaceID
+}
 
+// CreateNote saves a new note; note.OwnerID must be set. Without a
+// WorkspaceID, the note goes to its owner's personal workspace.
 func CreateNote(note Note) (primitive.ObjectID, error) {
+	if note.OwnerID.IsZero() {
+		return primitive.NilObjectID, errNoOwner
+	}
+	note.WorkspaceID = note.workspace()
+	if note.ID.IsZero() {
+		note.ID = primitive.NewObjectID() // Sealed content is bound to the ID
+	}
+	note, err := sealNote(note)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -89,14 +197,53 @@ func CreateNote(note Note) (primitive.ObjectID, error) {
 	return result.InsertedID.(primitive.ObjectID), nil
 }
 
-func GetAllNotes() ([]Note, error) {
+// NoteFilter narrows down and orders the notes returned by GetAllNotes
+type NoteFilter struct {
+	SpellingErrors bool   // Only notes with at least one spelling issue
+	Sort           string // One of the noteSorts keys; newest first by default
+}
+
+// noteSorts maps the sort options of the note list to a sort document
+var noteSorts = map[string]bson.D{
+	"newest":      {{Key: "createdAt", Value: -1}},
+	"oldest":      {{Key: "createdAt", Value: 1}},
+	"words":       {{Key: "stats.wordCount", Value: -1}},
+	"readingTime": {{Key: "stats.readingTimeSeconds", Value: -1}},
+	"readability": {{Key: "stats.fleschReadingEase", Value: -1}}, // Easiest first
+	"grade":       {{Key: "stats.fleschKincaidGrade", Value: -1}},
+	"passive":     {{Key: "stats.passiveVoicePercent", Value: -1}},
+	"adverbs":     {{Key: "stats.adverbPercent", Value: -1}},
+}
+
+// sort builds the MongoDB sort document, with creation date as tie-breaker
+func (f NoteFilter) sort() bson.D {
+	sort, ok := noteSorts[f.Sort]
+	if !ok {
+		return noteSorts["newest"]
+	}
+	if sort[0].Key == "createdAt" {
+		return sort
+	}
+	return bson.D{sort[0], {Key: "createdAt", Value: -1}}
+}
+
+// query builds the MongoDB filter document for the notes of workspace
+func (f NoteFilter) query(workspace primitive.ObjectID) bson.M {
+	query := workspaceQuery(workspace)
+	if f.SpellingErrors {
+		query["grammarIssues.category"] = CategorySpelling
+	}
+	return query
+}
+
+// GetAllNotes returns the notes of workspace matching filter
+func GetAllNotes(workspace primitive.ObjectID, filter NoteFilter) ([]Note, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	var notes []Note
-	// Sort by creation date, newest first
-	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
-	cursor, err := notesCollection.Find(ctx, bson.M{}, opts)
+	opts := options.Find().SetSort(filter.sort())
+	cursor, err := notesCollection.Find(ctx, filter.query(workspace), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -105,10 +252,63 @@ func GetAllNotes() ([]Note, error) {
 	if err = cursor.All(ctx, &notes); err != nil {
 		return nil, err
 	}
+	for i := range notes {
+		if err := openNote(&notes[i]); err != nil {
+			return nil, err
+		}
+	}
 	return notes, nil
 }
 
-func GetNoteByID(idHex string) (Note, error) {
+// GetNoteFilenames returns the set of original filenames of the notes of
+// workspace
+func GetNoteFilenames(workspace primitive.ObjectID) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	values, err := notesCollection.Distinct(ctx, "originalFilename", workspaceQuery(workspace))
+	if err != nil {
+		return nil, err
+	}
+	filenames := make(map[string]bool, len(values))
+	for _, v := range values {
+		if name, ok := v.(string); ok {
+			filenames[name] = true
+		}
+	}
+	return filenames, nil
+}
+
+// GetNoteNames returns the filenames of the notes of workspace with the
+// given IDs, by ID
+func GetNoteNames(workspace primitive.ObjectID, ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	names := make(map[primitive.ObjectID]string, len(ids))
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": bson.M{"$in": ids}, "workspaceId": workspace}
+	cursor, err := notesCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"originalFilename": 1}))
+	if err != nil {
+		return names, err
+	}
+	defer cursor.Close(ctx)
+
+	var notes []Note
+	if err = cursor.All(ctx, &notes); err != nil {
+		return names, err
+	}
+	for _, note := range notes {
+		names[note.ID] = note.OriginalFilename
+	}
+	return names, nil
+}
+
+// GetNoteByID returns the note with the given ID, if it is in workspace
+func GetNoteByID(workspace primitive.ObjectID, idHex string) (Note, error) {
 	var note Note
 	objectID, err := primitive.ObjectIDFromHex(idHex)
 	if err != nil {
@@ -118,11 +318,133 @@ func GetNoteByID(idHex string) (Note, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err = notesCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&note)
-	return note, err // err will be mongo.ErrNoDocuments if not found
+	err = notesCollection.FindOne(ctx, noteQuery(workspace, objectID)).Decode(&note)
+	if err != nil {
+		return note, err // err will be mongo.ErrNoDocuments if not found
+	}
+	return note, openNote(&note)
+}
+
+// GetNoteIDs returns the IDs of the notes of workspace, oldest first
+func GetNoteIDs(workspace primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetProjection(bson.M{"_id": 1})
+	cursor, err := notesCollection.Find(ctx, workspaceQuery(workspace), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+// GetStorageUsage returns the storage used by the notes owner created.
+// Encrypted notes count with the size of their plaintext markdown.
+func GetStorageUsage(owner primitive.ObjectID) (StorageUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ownerId": owner}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"notes": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": bson.M{"$ifNull": bson.A{"$encrypted.markdownBytes", bson.M{"$strLenBytes": "$markdownContent"}}}},
+		}}},
+	}
+	cursor, err := notesCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var usage StorageUsage
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&usage); err != nil {
+			return StorageUsage{}, err
+		}
+	}
+	return usage, cursor.Err()
+}
+
+// UpdateNoteCheck saves the results of re-checking a note: its issues,
+// language detection, statistics and checker version. Like all updates,
+// it only applies if the note is in note.WorkspaceID.
+func UpdateNoteCheck(note Note) error {
+	sealed, err := sealCheck(note)
+	if err != nil {
+		return err
+	}
+	return updateNote(note, noteCheckFields(sealed))
+}
+
+// UpdateNoteContent saves an edited note: its markdown, HTML and language
+// together with the results of checking it
+func UpdateNoteContent(note Note) error {
+	sealed, err := sealNote(note)
+	if err != nil {
+		return err
+	}
+	fields := noteCheckFields(sealed)
+	for k, v := range noteContentFields(sealed) {
+		fields[k] = v
+	}
+	fields["language"] = note.Language
+	return updateNote(note, fields)
+}
+
+// noteContentFields returns the fields holding the content of a sealed
+// note, for $set
+func noteContentFields(sealed Note) bson.M {
+	return bson.M{
+		"markdownContent": sealed.MarkdownContent,
+		"htmlContent":     sealed.HTMLContent,
+		"encrypted":       sealed.Encrypted,
+	}
+}
+
+// noteCheckFields returns the fields CheckNote fills in of a note with its
+// check sealed, for $set
+func noteCheckFields(sealed Note) bson.M {
+	return bson.M{
+		"encryptedCheck":     sealed.EncryptedCheck,
+		"grammarIssues":      sealed.GrammarIssues,
+		"detectedLanguage":   sealed.DetectedLanguage,
+		"languageConfidence": sealed.LanguageConfidence,
+		"grammarIncomplete":  sealed.GrammarIncomplete,
+		"stats":              sealed.Stats,
+		"checkerVersion":     sealed.CheckerVersion,
+		"checkedAt":          sealed.CheckedAt,
+	}
+}
+
+// updateNote sets fields of the stored note
+func updateNote(note Note, fields bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := notesCollection.UpdateOne(ctx, noteQuery(note.workspace(), note.ID), bson.M{"$set": fields})
+	if err == nil && result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments // Deleted in the meantime
+	}
+	return err
 }
 
-func DeleteNoteByID(idHex string) error {
+// DeleteNoteByID deletes the note with the given ID, if it is in
+// workspace, along with its shares
+func DeleteNoteByID(workspace primitive.ObjectID, idHex string) error {
 	objectID, err := primitive.ObjectIDFromHex(idHex)
 	if err != nil {
 		return err // Invalid ID format
@@ -131,9 +453,799 @@ func DeleteNoteByID(idHex string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := notesCollection.DeleteOne(ctx, bson.M{"_id": objectID})
+	result, err := notesCollection.DeleteOne(ctx, noteQuery(workspace, objectID))
 	if err == nil && result.DeletedCount == 0 {
 		return mongo.ErrNoDocuments // Indicate that the note wasn't found
 	}
+	if err != nil {
+		return err
+	}
+	return deleteNoteShares(ctx, workspace, objectID)
+}
+
+// --- Note Encryption ---
+
+// GetNoteIDsToReseal returns the IDs of the notes whose content or check
+// is not encrypted under the master key keyID, including those stored in
+// plaintext
+func GetNoteIDsToReseal(keyID string) ([]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := notesCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"encrypted.keyId": bson.M{"$ne": keyID}},
+		bson.M{"encryptedCheck.keyId": bson.M{"$ne": keyID}},
+	}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+// ResealNote stores the note with the given ID the way it would be saved
+// now, under the current master key. It reports false if the note was
+// deleted, or its content or check saved in the meantime; a save seals
+// it anyway.
+func ResealNote(id primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var note Note
+	if err := notesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&note); err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// Only replace the content and check that were read
+	filter := bson.M{"_id": id, "markdownContent": note.MarkdownContent}
+	if note.Encrypted != nil {
+		filter["encrypted.dataKey"] = note.Encrypted.DataKey
+	} else {
+		filter["encrypted"] = nil
+	}
+	if note.EncryptedCheck != nil {
+		filter["encryptedCheck.dataKey"] = note.EncryptedCheck.DataKey
+	} else {
+		filter["encryptedCheck"] = nil
+	}
+	if err := openNote(&note); err != nil {
+		return false, err
+	}
+	sealed, err := sealNote(note)
+	if err != nil {
+		return false, err
+	}
+	fields := noteCheckFields(sealed)
+	for k, v := range noteContentFields(sealed) {
+		fields[k] = v
+	}
+	result, err := notesCollection.UpdateOne(ctx, filter, bson.M{"$set": fields})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// --- Grammar Settings ---
+
+// legacyGrammarSettingsID is the _id of the grammar settings document
+// from before user accounts, see ClaimLegacyData
+const legacyGrammarSettingsID = "grammar"
+
+// GetGrammarSettings loads the grammar settings of workspace, returning
+// empty settings if none have been saved yet
+func GetGrammarSettings(workspace primitive.ObjectID) (GrammarSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settings := GrammarSettings{ID: workspace.Hex()}
+	err := settingsCollection.FindOne(ctx, bson.M{"_id": workspace.Hex()}).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// AddGrammarSetting adds a value to one of the settings lists of
+// workspace (field is the bson name, e.g. "dictionary")
+func AddGrammarSetting(workspace primitive.ObjectID, field, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$addToSet": bson.M{field: value},
+		"$set":      bson.M{"updatedAt": time.Now()},
+	}
+	_, err := settingsCollection.UpdateOne(ctx, bson.M{"_id": workspace.Hex()}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// SetGrammarLanguage sets the default grammar language of workspace; an
+// empty lang goes back to the server default
+func SetGrammarLanguage(workspace primitive.ObjectID, lang string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"language": lang, "updatedAt": time.Now()}}
+	if lang == "" {
+		update = bson.M{"$unset": bson.M{"language": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	_, err := settingsCollection.UpdateOne(ctx, bson.M{"_id": workspace.Hex()}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// RemoveGrammarSetting removes a value from one of the settings lists of
+// workspace
+func RemoveGrammarSetting(workspace primitive.ObjectID, field, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$pull": bson.M{field: value},
+		"$set":  bson.M{"updatedAt": time.Now()},
+	}
+	_, err := settingsCollection.UpdateOne(ctx, bson.M{"_id": workspace.Hex()}, update)
+	return err
+}
+
+// --- Users ---
+
+// errUsernameTaken is returned by CreateUser for a username in use
+var errUsernameTaken = errors.New("username is taken")
+
+// CreateUser saves a new user
+func CreateUser(user User) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user.CreatedAt = time.Now()
+	result, err := usersCollection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, errUsernameTaken
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// GetUserByID returns the user with the given ID
+func GetUserByID(id primitive.ObjectID) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := usersCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	return user, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// GetUserByUsername returns the user with the given (lowercase) username
+func GetUserByUsername(username string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := usersCollection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	return user, err
+}
+
+// GetUserByOIDC returns the single sign-on user with the given subject at
+// issuer
+func GetUserByOIDC(issuer, subject string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := usersCollection.FindOne(ctx, bson.M{"oidcIssuer": issuer, "oidcSubject": subject}).Decode(&user)
+	return user, err
+}
+
+// SetUserAdmin sets whether the user is an admin
+func SetUserAdmin(id primitive.ObjectID, admin bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := usersCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"admin": admin}})
+	return err
+}
+
+// GetAllUsers returns all users, oldest first
+func GetAllUsers() ([]User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var users []User
+	cursor, err := usersCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// CountUsers returns the number of users
+func CountUsers() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return usersCollection.CountDocuments(ctx, bson.M{})
+}
+
+// ClaimLegacyData gives owner (and their personal workspace) the notes
+// and grammar settings saved before there were user accounts. It is
+// called for the first user only.
+func ClaimLegacyData(owner primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"ownerId": owner, "workspaceId": owner}}
+	result, err := notesCollection.UpdateMany(ctx, bson.M{"ownerId": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Assigned %d notes from before user accounts to user %s", result.ModifiedCount, owner.Hex())
+	}
+
+	// Settings are keyed by workspace, so the legacy document is copied
+	var settings GrammarSettings
+	err = settingsCollection.FindOne(ctx, bson.M{"_id": legacyGrammarSettingsID}).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	settings.ID = owner.Hex()
+	if _, err := settingsCollection.ReplaceOne(ctx, bson.M{"_id": settings.ID}, settings, options.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+	_, err = settingsCollection.DeleteOne(ctx, bson.M{"_id": legacyGrammarSettingsID})
+	return err
+}
+
+// --- Workspaces ---
+
+// EnsurePersonalWorkspace returns the personal workspace of user,
+// creating it if needed. It has the ID of the user.
+func EnsurePersonalWorkspace(user User) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	ws := Workspace{
+		ID:        user.ID,
+		Name:      user.Username + "'s notes",
+		Personal:  true,
+		Members:   []Member{{UserID: user.ID, Username: user.Username, Role: RoleAdmin, JoinedAt: now}},
+		CreatedAt: now,
+	}
+	// Upserted, so concurrent first requests create it once
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := workspacesCollection.FindOneAndUpdate(ctx, bson.M{"_id": user.ID}, bson.M{"$setOnInsert": ws}, opts).Decode(&ws)
+	return ws, err
+}
+
+// CreateWorkspace saves a new workspace
+func CreateWorkspace(ws Workspace) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws.CreatedAt = time.Now()
+	result, err := workspacesCollection.InsertOne(ctx, ws)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// GetWorkspace returns the workspace with the given ID
+func GetWorkspace(id primitive.ObjectID) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var ws Workspace
+	err := workspacesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&ws)
+	return ws, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// GetAllWorkspaces returns all workspaces, oldest first
+func GetAllWorkspaces() ([]Workspace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := workspacesCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var workspaces []Workspace
+	if err = cursor.All(ctx, &workspaces); err != nil {
+		return nil, err
+	}
+	return workspaces, nil
+}
+
+// GetUserWorkspaces returns the workspaces userID is a member of, the
+// personal one first
+func GetUserWorkspaces(userID primitive.ObjectID) ([]Workspace, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := workspacesCollection.Find(ctx, bson.M{"members.userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var workspaces []Workspace
+	if err = cursor.All(ctx, &workspaces); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(workspaces, func(i, j int) bool {
+		return workspaces[i].ID == userID && workspaces[j].ID != userID
+	})
+	return workspaces, nil
+}
+
+// AddMember adds a member to a workspace, unless they already are one
+func AddMember(workspace primitive.ObjectID, member Member) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": workspace, "members.userId": bson.M{"$ne": member.UserID}}
+	result, err := workspacesCollection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"members": member}})
+	if err == nil && result.MatchedCount == 0 {
+		return errAlreadyMember
+	}
+	return err
+}
+
+// SetMemberRole changes the role of a member of a workspace
+func SetMemberRole(workspace, userID primitive.ObjectID, role Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": workspace, "members.userId": userID}
+	result, err := workspacesCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"members.$.role": role}})
+	if err == nil && result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// RemoveMember removes a member from a workspace
+func RemoveMember(workspace, userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$pull": bson.M{"members": bson.M{"userId": userID}}}
+	_, err := workspacesCollection.UpdateOne(ctx, bson.M{"_id": workspace}, update)
+	return err
+}
+
+// migrateWorkspaces gives every user a personal workspace, and moves the
+// notes and shares from before workspaces into their owner's one
+func migrateWorkspaces() error {
+	users, err := GetAllUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if _, err := EnsurePersonalWorkspace(user); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"workspaceId": bson.M{"$exists": false}, "ownerId": bson.M{"$exists": true}}
+	update := bson.A{bson.M{"$set": bson.M{"workspaceId": "$ownerId"}}}
+	for _, collection := range []*mongo.Collection{notesCollection, sharesCollection} {
+		result, err := collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Moved %d %s into their owner's personal workspace", result.ModifiedCount, collection.Name())
+		}
+	}
+	return nil
+}
+
+// --- Invitations ---
+
+// errAlreadyInvited is returned by CreateInvitation if the user has a
+// pending invitation to the workspace
+var errAlreadyInvited = errors.New("already invited to the workspace")
+
+// CreateInvitation saves a new invitation
+func CreateInvitation(inv Invitation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := invitationsCollection.InsertOne(ctx, inv)
+	if mongo.IsDuplicateKeyError(err) {
+		return errAlreadyInvited
+	}
+	return err
+}
+
+// GetInvitation returns the unexpired invitation with the given ID
+func GetInvitation(idHex string) (Invitation, error) {
+	var inv Invitation
+	objectID, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return inv, mongo.ErrNoDocuments
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The TTL index removes expired invitations only once a minute
+	filter := bson.M{"_id": objectID, "expiresAt": bson.M{"$gt": time.Now()}}
+	err = invitationsCollection.FindOne(ctx, filter).Decode(&inv)
+	return inv, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// GetInvitations returns the unexpired invitations addressed to username,
+// or to workspace if username is empty, oldest first
+func GetInvitations(username string, workspace primitive.ObjectID) ([]Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"expiresAt": bson.M{"$gt": time.Now()}}
+	if username != "" {
+		filter["username"] = username
+	} else {
+		filter["workspaceId"] = workspace
+	}
+	cursor, err := invitationsCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var invitations []Invitation
+	if err = cursor.All(ctx, &invitations); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// DeleteInvitation deletes the invitation with the given ID
+func DeleteInvitation(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := invitationsCollection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// --- Sessions ---
+
+// CreateSession saves a new session
+func CreateSession(session Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := sessionsCollection.InsertOne(ctx, session)
+	return err
+}
+
+// GetSession returns the unexpired session with the given key
+func GetSession(key string) (Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The TTL index removes expired sessions only once a minute
+	var session Session
+	err := sessionsCollection.FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&session)
+	return session, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// DeleteSession deletes the session with the given key, if it exists
+func DeleteSession(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := sessionsCollection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// --- API Tokens ---
+
+// CreateAPIToken saves a new API token
+func CreateAPIToken(token APIToken) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := apiTokensCollection.InsertOne(ctx, token)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash
+func GetAPITokenByHash(hash string) (APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var token APIToken
+	err := apiTokensCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	return token, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// GetAPITokens returns the API tokens of owner, newest first
+func GetAPITokens(owner primitive.ObjectID) ([]APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := apiTokensCollection.Find(ctx, bson.M{"userId": owner}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []APIToken
+	if err = cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// TouchAPIToken records that the token was used at t
+func TouchAPIToken(id primitive.ObjectID, t time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := apiTokensCollection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"lastUsedAt": t}})
+	return err
+}
+
+// DeleteAPIToken revokes the API token with the given ID, if it belongs
+// to owner
+func DeleteAPIToken(owner primitive.ObjectID, idHex string) error {
+	objectID, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return err // Invalid ID format
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := apiTokensCollection.DeleteOne(ctx, bson.M{"_id": objectID, "userId": owner})
+	if err == nil && result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// --- Shares ---
+
+// activeShareQuery returns the filter for shares that haven't expired.
+// The TTL index removes expired shares only once a minute.
+func activeShareQuery(filter bson.M) bson.M {
+	filter["$or"] = bson.A{
+		bson.M{"expiresAt": bson.M{"$exists": false}},
+		bson.M{"expiresAt": bson.M{"$gt": time.Now()}},
+	}
+	return filter
+}
+
+// CreateShare saves a new share
+func CreateShare(share Share) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := sharesCollection.InsertOne(ctx, share)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// GetShareByToken returns the active share with the given token
+func GetShareByToken(token string) (Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var share Share
+	err := sharesCollection.FindOne(ctx, activeShareQuery(bson.M{"token": token})).Decode(&share)
+	return share, err // err will be mongo.ErrNoDocuments if not found
+}
+
+// GetShares returns the active shares of the notes of workspace, newest
+// first: those of one note, or of all notes if noteID is
+// primitive.NilObjectID
+func GetShares(workspace, noteID primitive.ObjectID) ([]Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"workspaceId": workspace}
+	if !noteID.IsZero() {
+		filter["noteId"] = noteID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := sharesCollection.Find(ctx, activeShareQuery(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var shares []Share
+	if err = cursor.All(ctx, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// DeleteShare revokes the share with the given ID, if it is of a note of
+// workspace, and returns it
+func DeleteShare(workspace primitive.ObjectID, idHex string) (Share, error) {
+	objectID, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return Share{}, err // Invalid ID format
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var share Share
+	err = sharesCollection.FindOneAndDelete(ctx, bson.M{"_id": objectID, "workspaceId": workspace}).Decode(&share)
+	return share, err
+}
+
+// deleteNoteShares revokes all shares of a note
+func deleteNoteShares(ctx context.Context, workspace, noteID primitive.ObjectID) error {
+	_, err := sharesCollection.DeleteMany(ctx, bson.M{"workspaceId": workspace, "noteId": noteID})
+	return err
+}
+
+// --- Audit Events ---
+//
+// The audit log is append-only: there are functions to add events and to
+// read them, but none to change or delete them.
+
+// AuditFilter selects audit events; zero fields match all events
+type AuditFilter struct {
+	Action   AuditAction
+	Username string
+	NoteID   primitive.ObjectID
+	From, To time.Time // Events at or after From, and before To
+}
+
+// query builds the MongoDB filter document of the events
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Action != "" {
+		query["action"] = f.Action
+	}
+	if f.Username != "" {
+		query["username"] = f.Username
+	}
+	if !f.NoteID.IsZero() {
+		query["noteId"] = f.NoteID
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		span := bson.M{}
+		if !f.From.IsZero() {
+			span["$gte"] = f.From
+		}
+		if !f.To.IsZero() {
+			span["$lt"] = f.To
+		}
+		query["time"] = span
+	}
+	return query
+}
+
+// InsertAuditEvent appends event to the audit log
+func InsertAuditEvent(event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := auditCollection.InsertOne(ctx, event)
+	return err
+}
+
+// GetAuditEvents returns the newest limit events matching filter, newest
+// first
+func GetAuditEvents(filter AuditFilter, limit int64) ([]AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit)
+	cursor, err := auditCollection.Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []AuditEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// EachAuditEvent calls fn with every event matching filter, oldest first,
+// without loading them all at once. It stops at the first error of fn.
+func EachAuditEvent(filter AuditFilter, fn func(AuditEvent) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}})
+	cursor, err := auditCollection.Find(ctx, filter.query(), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var event AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// --- Grammar Cache ---
+
+// errNoGrammarCacheStore is returned by the grammar cache functions when
+// there is no database connection, e.g. in tests
+var errNoGrammarCacheStore = errors.New("grammar cache store not connected")
+
+// GetCachedCheck looks up a cached paragraph check by key
+func GetCachedCheck(key string) (CachedCheck, error) {
+	var cached CachedCheck
+	if grammarCacheCollection == nil {
+		return cached, errNoGrammarCacheStore
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := grammarCacheCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&cached)
+	return cached, err // err will be mongo.ErrNoDocuments on a cache miss
+}
+
+// SaveCachedCheck stores a paragraph check, replacing any previous entry
+func SaveCachedCheck(cached CachedCheck) error {
+	if grammarCacheCollection == nil {
+		return errNoGrammarCacheStore
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cached.CreatedAt = time.Now()
+	_, err := grammarCacheCollection.ReplaceOne(ctx, bson.M{"_id": cached.Key}, cached, options.Replace().SetUpsert(true))
 	return err
 }
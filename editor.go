@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- Live Editor ---
+//
+// The editor page checks the note while it is typed. The browser splits
+// the text into paragraphs (like splitParagraphs), remembers the issues
+// of every paragraph it has seen, and after a pause in typing posts only
+// the paragraphs it has no issues for to /editor/check. That endpoint
+// streams one JSON line per paragraph as soon as its check is done.
+//
+// Each editor has a session. A new check request from a session
+// supersedes the previous one: paragraphs the new request still needs
+// keep being checked (and are shared, not checked twice), while checks
+// nobody waits for any more are canceled.
+
+// editorView is the data for the editor template
+type editorView struct {
+	Note            Note // Zero ID for a new note
+	Session         string
+	Languages       []GrammarLanguage
+	DefaultLanguage string
+}
+
+// IsNew reports whether the editor creates a new note
+func (v editorView) IsNew() bool {
+	return v.Note.ID.IsZero()
+}
+
+// handleEditor renders the editor, empty or with the note {id}
+func handleEditor(w http.ResponseWriter, r *http.Request) {
+	settings, err := GetGrammarSettings(currentWorkspace(r))
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+	view := editorView{
+		Session:         newEditorSessionID(),
+		Languages:       grammarLanguages,
+		DefaultLanguage: settings.DefaultLanguage(),
+	}
+
+	if noteID := chi.URLParam(r, "id"); noteID != "" {
+		note, err := GetNoteByID(currentWorkspace(r), noteID)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "Note not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error fetching note %s: %v", noteID, err)
+				http.Error(w, "Error fetching note", http.StatusInternalServerError)
+			}
+			return
+		}
+		view.Note = note
+		if note.Language != "" {
+			view.DefaultLanguage = note.Language
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_editor.html", view)
+}
+
+// handleEditorSave saves the editor's markdown as a new note, or as the
+// note {id}, and renders the note's details. The note list is told to
+// refresh through the "notes-changed" event.
+func handleEditorSave(w http.ResponseWriter, r *http.Request) {
+	markdownContent := r.FormValue("markdown")
+	if strings.TrimSpace(markdownContent) == "" {
+		http.Error(w, "The note is empty.", http.StatusBadRequest)
+		return
+	}
+
+	access := currentAccess(r)
+	note := Note{OwnerID: currentUser(r).ID, WorkspaceID: access.Workspace.ID}
+	if noteID := chi.URLParam(r, "id"); noteID != "" {
+		var err error
+		note, err = GetNoteByID(access.Workspace.ID, noteID)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "Note not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error fetching note %s: %v", noteID, err)
+				http.Error(w, "Error fetching note", http.StatusInternalServerError)
+			}
+			return
+		}
+	} else {
+		filename := filepath.Base(strings.TrimSpace(r.FormValue("filename")))
+		if filename == "." || filename == "/" {
+			filename = "untitled.md"
+		}
+		if !strings.HasSuffix(strings.ToLower(filename), ".md") {
+			filename += ".md"
+		}
+		note.OriginalFilename = filename
+	}
+
+	// New notes count against the user's quota, edits against the author's
+	addNotes, addBytes := int64(0), int64(len(markdownContent)-len(note.MarkdownContent))
+	if note.ID.IsZero() {
+		addNotes = 1
+	}
+	if err := checkQuota(note.OwnerID, addNotes, addBytes); err != nil {
+		quotaError(w, "#request-error", err)
+		return
+	}
+
+	note.MarkdownContent = markdownContent
+	note.HTMLContent = RenderMarkdownToHTML(markdownContent)
+	settings, err := GetGrammarSettings(access.Workspace.ID)
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+	note.Language = ResolveNoteLanguage(markdownContent, r.FormValue("language"), settings.DefaultLanguage())
+	knownFiles, err := GetNoteFilenames(access.Workspace.ID)
+	if err != nil {
+		log.Printf("Error fetching note filenames: %v", err)
+		knownFiles = nil
+	}
+	if err := CheckNote(r.Context(), &note, settings, knownFiles); err != nil {
+		if retry, busy := checkerBusy(err); busy {
+			renderRetryLater(w, http.StatusServiceUnavailable, "#request-error", "The grammar checker is busy, so the note was not saved.", retry)
+			return
+		}
+		// Save with the failure recorded as an issue on the note
+		log.Printf("Grammar check failed for %s: %v", note.OriginalFilename, err)
+	}
+
+	created := note.ID.IsZero()
+	if created {
+		note.ID, err = CreateNote(note)
+		note.CreatedAt = time.Now() // CreateNote only sets it on its copy
+	} else {
+		err = UpdateNoteContent(note)
+	}
+	if err != nil {
+		log.Printf("Error saving note %s: %v", note.OriginalFilename, err)
+		http.Error(w, "Failed to save the note.", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Saved note from editor: %s", note.OriginalFilename)
+	if created {
+		recordAudit(r, AuditCreate, note, "editor")
+	} else {
+		recordAudit(r, AuditEdit, note, "editor")
+	}
+
+	note.GrammarIssues = settings.FilterIssues(note.GrammarIssues)
+	w.Header().Set("HX-Trigger", "notes-changed")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_note_detail.html", noteDetailView{Note: note, AllIssues: note.GrammarIssues, Access: access})
+}
+
+// editorCheckRequest is the body of a live check request
+type editorCheckRequest struct {
+	Session    string            `json:"session"`
+	Language   string            `json:"language"`
+	Paragraphs []editorParagraph `json:"paragraphs"`
+}
+
+// editorParagraph is a paragraph to check, with an ID chosen by the browser
+type editorParagraph struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// editorCheckResult is one line of the streamed response. Issue offsets
+// are relative to the paragraph and, unlike elsewhere, in UTF-16 code
+// units, i.e. JavaScript string indices.
+type editorCheckResult struct {
+	ID       string         `json:"id"`
+	Issues   []GrammarIssue `json:"issues"`
+	Language string         `json:"language,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Limits of a live check request
+const (
+	maxEditorCheckBody       = 1 << 20 // Bytes
+	maxEditorCheckParagraphs = 200
+)
+
+// handleEditorCheck checks the posted paragraphs and streams the results
+// as newline-delimited JSON, in the order the checks finish
+func handleEditorCheck(w http.ResponseWriter, r *http.Request) {
+	var req editorCheckRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditorCheckBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid check request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Session == "" || len(req.Paragraphs) > maxEditorCheckParagraphs {
+		http.Error(w, "Invalid check request", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	settings, err := GetGrammarSettings(currentWorkspace(r))
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+	language := normalizeLanguage(req.Language)
+	if language == "" {
+		language = settings.DefaultLanguage()
+	}
+	opts := settings.CheckOptions(language)
+
+	// Join the checks first, then supersede the session's previous
+	// request: checks it shares with this one keep running. Sessions are
+	// per user, so a session ID alone doesn't give access to another
+	// user's checks.
+	session := editorSessions.get(user.ID.Hex() + "/" + req.Session)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	flights := make([]*checkFlight, len(req.Paragraphs))
+	for i, p := range req.Paragraphs {
+		flights[i] = session.join(p.Text, opts)
+		defer session.leave(flights[i])
+	}
+	session.supersede(cancel)
+
+	results := make(chan editorCheckResult)
+	for i, p := range req.Paragraphs {
+		go func() {
+			result := editorCheckResult{ID: p.ID, Issues: []GrammarIssue{}}
+			grammar, err := flights[i].wait(ctx)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Language = grammar.Language
+				toUTF16 := byteToUTF16Offsets(p.Text)
+				for _, issue := range grammar.Issues {
+					start, end := toUTF16(issue.Offset), toUTF16(issue.Offset+issue.Length)
+					issue.Offset, issue.Length = start, end-start
+					result.Issues = append(result.Issues, issue)
+				}
+			}
+			select {
+			case results <- result:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for range req.Paragraphs {
+		select {
+		case result := <-results:
+			if err := encoder.Encode(result); err != nil {
+				return // The browser went away
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			return // Superseded or disconnected
+		}
+	}
+}
+
+// byteToUTF16Offsets returns a function mapping byte offsets in text to
+// UTF-16 code unit offsets, the inverse of utf16ToByteOffsets
+func byteToUTF16Offsets(text string) func(int) int {
+	unitAt := make([]int, len(text)+1) // Offsets inside a rune map to its start
+	units := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		for j := i; j < i+size; j++ {
+			unitAt[j] = units
+		}
+		if r >= 0x10000 {
+			units += 2 // Surrogate pair
+		} else {
+			units++
+		}
+		i += size
+	}
+	unitAt[len(text)] = units
+
+	return func(offset int) int {
+		if offset < 0 {
+			return 0
+		}
+		if offset > len(text) {
+			return units
+		}
+		return unitAt[offset]
+	}
+}
+
+// --- Editor Sessions ---
+
+// editorSessionTTL is how long an idle editor session is kept
+const editorSessionTTL = 30 * time.Minute
+
+// editorSessions holds the live-check state of open editors
+var editorSessions = &editorSessionStore{sessions: map[string]*editorSession{}}
+
+type editorSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*editorSession
+}
+
+// newEditorSessionID returns a random, unguessable session ID
+func newEditorSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// get returns the session with the given ID, creating it if needed, and
+// drops sessions that have been idle for longer than editorSessionTTL
+func (s *editorSessionStore) get(id string) *editorSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, session := range s.sessions {
+		if session.idleSince(now) > editorSessionTTL {
+			delete(s.sessions, key)
+		}
+	}
+
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &editorSession{flights: map[string]*checkFlight{}}
+		s.sessions[id] = session
+	}
+	session.mu.Lock()
+	session.lastUsed = now
+	session.mu.Unlock()
+	return session
+}
+
+// editorSession tracks the check requests of one editor
+type editorSession struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc      // Cancels the latest request
+	flights  map[string]*checkFlight // Paragraph checks in progress, by cache key
+	lastUsed time.Time
+}
+
+// checkFlight is a paragraph check shared by the requests waiting for it
+type checkFlight struct {
+	key     string        // Cache key of the checked text and options
+	done    chan struct{} // Closed when result and err are set
+	result  GrammarResult
+	err     error
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// idleSince returns how long the session has been unused at now
+func (s *editorSession) idleSince(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.flights) > 0 {
+		return 0
+	}
+	return now.Sub(s.lastUsed)
+}
+
+// supersede makes cancel the way to stop the session's latest request,
+// canceling the request before it
+func (s *editorSession) supersede(cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.cancel = cancel
+}
+
+// join returns the check of text with opts, starting it unless the same
+// check is already in progress. Every join must be paired with a leave.
+func (s *editorSession) join(text string, opts CheckOptions) *checkFlight {
+	// Unlike cached paragraphs, the result is filtered by the dictionary
+	key := opts.cacheKey(text) + "/" + sortedJoin(opts.Dictionary)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flight, ok := s.flights[key]
+	if !ok {
+		// The check runs on its own context, so that it outlives a
+		// superseded request as long as a newer one still waits for it
+		ctx, cancel := context.WithCancel(context.Background())
+		flight = &checkFlight{key: key, done: make(chan struct{}), cancel: cancel}
+		s.flights[key] = flight
+		go func() {
+			defer cancel()
+			flight.result, flight.err = CheckGrammar(ctx, text, opts)
+			close(flight.done)
+
+			s.mu.Lock()
+			if s.flights[key] == flight {
+				delete(s.flights, key)
+			}
+			s.mu.Unlock()
+		}()
+	}
+	flight.waiters++
+	return flight
+}
+
+// leave stops waiting for a check, canceling it if nobody else waits
+func (s *editorSession) leave(flight *checkFlight) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flight.waiters--
+	if flight.waiters == 0 {
+		flight.cancel() // No-op if the check has finished
+		if s.flights[flight.key] == flight {
+			delete(s.flights, flight.key)
+		}
+	}
+}
+
+// wait returns the result of the check, or the error of ctx if it ends
+// first
+func (f *checkFlight) wait(ctx context.Context) (GrammarResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return GrammarResult{}, ctx.Err()
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestByteToUTF16Offsets(t *testing.T) {
+	text := "aé€😀b" // 1, 2, 3 and 4 bytes; 1, 1, 1 and 2 UTF-16 units
+	toUTF16 := byteToUTF16Offsets(text)
+	for _, tt := range []struct{ offset, want int }{
+		{-1, 0},
+		{0, 0},
+		{1, 1},  // é
+		{2, 1},  // Inside é: its start
+		{3, 2},  // €
+		{6, 3},  // 😀
+		{8, 3},  // Inside 😀
+		{10, 5}, // b, after the surrogate pair
+		{11, 6}, // End of text
+		{99, 6},
+	} {
+		if got := toUTF16(tt.offset); got != tt.want {
+			t.Errorf("byte offset %d = UTF-16 offset %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+}
+
+// blockOnSlow wraps typoHandler so that texts containing "slow" are only
+// answered once release is closed. It counts the slow requests started.
+func blockOnSlow(started *atomic.Int32, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.PostForm.Get("text"), "slow") {
+			started.Add(1)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		typoHandler(w, r)
+	}
+}
+
+func TestEditorSessionSharesChecks(t *testing.T) {
+	var started atomic.Int32
+	release := make(chan struct{})
+	fake, _ := newFakeLanguageTool(t, blockOnSlow(&started, release))
+	session := &editorSession{flights: map[string]*checkFlight{}}
+	opts := CheckOptions{Language: "en-US"}
+
+	// A superseded request and the one after it both need the paragraph
+	first := session.join("slow teh", opts)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	session.supersede(cancel1)
+	second := session.join("slow teh", opts)
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	session.supersede(cancel2)
+	if first != second {
+		t.Fatal("the same paragraph got two checks")
+	}
+	if ctx1.Err() == nil || ctx2.Err() != nil {
+		t.Fatalf("after supersede: first request %v, second %v; want only the first canceled", ctx1.Err(), ctx2.Err())
+	}
+	if _, err := first.wait(ctx1); err != context.Canceled {
+		t.Errorf("superseded wait: %v, want context.Canceled", err)
+	}
+	session.leave(first)
+
+	// The check keeps running for the second request
+	waitFor(t, func() bool { return started.Load() == 1 })
+	close(release)
+	result, err := second.wait(ctx2)
+	if err != nil || len(result.Issues) != 1 {
+		t.Fatalf("shared check = %+v, %v", result, err)
+	}
+	session.leave(second)
+	if n := fake.requests.Load(); n != 1 {
+		t.Errorf("%d LanguageTool requests, want 1", n)
+	}
+	if len(session.flights) != 0 {
+		t.Errorf("%d flights left after the last leave", len(session.flights))
+	}
+
+	// A check nobody waits for any more is canceled
+	newFakeLanguageTool(t, func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() })
+	abandoned := session.join("An abandoned paragraph.", opts)
+	session.leave(abandoned)
+	if _, err := abandoned.wait(context.Background()); err == nil {
+		t.Error("abandoned check finished without error")
+	}
+}
+
+// editorTestServer starts the app for alice and returns a function making
+// her requests with the given content type
+func editorTestServer(t *testing.T) (alice User, do func(method, path, contentType, body string) *http.Response) {
+	t.Helper()
+	useTestDB(t)
+	LoadTemplates()
+	alice, _ = createTestUsers(t)
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+
+	rec := httptest.NewRecorder()
+	if err := startSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), alice); err != nil {
+		t.Fatal(err)
+	}
+	session := rec.Result().Cookies()[0]
+	return alice, func(method, path, contentType, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("HX-Request", "true")
+		req.AddCookie(session)
+		resp, err := http.DefaultClient.Do(withCSRF(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+}
+
+// readCheckResults decodes the NDJSON lines of a live check response
+func readCheckResults(t *testing.T, body io.Reader) map[string]editorCheckResult {
+	t.Helper()
+	results := map[string]editorCheckResult{}
+	lines := bufio.NewScanner(body)
+	for lines.Scan() {
+		var result editorCheckResult
+		if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		results[result.ID] = result
+	}
+	return results
+}
+
+func TestEditorCheck(t *testing.T) {
+	_, do := editorTestServer(t)
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+	check := func(paragraphs ...string) map[string]editorCheckResult {
+		t.Helper()
+		req := editorCheckRequest{Session: "s1", Language: "en-US"}
+		for i, text := range paragraphs {
+			req.Paragraphs = append(req.Paragraphs, editorParagraph{ID: string(rune('a' + i)), Text: text})
+		}
+		body, _ := json.Marshal(req)
+		resp := do(http.MethodPost, "/editor/check", "application/json", string(body))
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return readCheckResults(t, resp.Body)
+	}
+
+	results := check("😀 teh cat", "All fine.")
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want one per paragraph: %+v", len(results), results)
+	}
+	// Offsets are UTF-16 units within the paragraph: the emoji counts 2
+	if issues := results["a"].Issues; len(issues) != 1 || issues[0].Offset != 3 || issues[0].Length != 3 || results["a"].Language != "en-US" {
+		t.Errorf("paragraph a = %+v", results["a"])
+	}
+	if b := results["b"]; b.Issues == nil || len(b.Issues) != 0 || b.Error != "" {
+		t.Errorf("paragraph b = %+v, want an empty issue list", b)
+	}
+
+	// The browser only posts changed paragraphs; unchanged text that is
+	// posted again comes from the paragraph cache
+	results = check("All fine.", "A new teh paragraph.")
+	if n := fake.requests.Load(); n != 3 {
+		t.Errorf("%d LanguageTool requests, want 3 (the new paragraph only)", n)
+	}
+	if len(results["a"].Issues) != 0 || len(results["b"].Issues) != 1 {
+		t.Errorf("second check = %+v", results)
+	}
+
+	for _, body := range []string{"not json", `{"paragraphs":[]}`} {
+		if resp := do(http.MethodPost, "/editor/check", "application/json", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("check request %s: status %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestEditorCheckStreams(t *testing.T) {
+	_, do := editorTestServer(t)
+	var started atomic.Int32
+	release := make(chan struct{})
+	newFakeLanguageTool(t, blockOnSlow(&started, release))
+
+	resp := do(http.MethodPost, "/editor/check", "application/json",
+		`{"session":"s1","language":"en-US","paragraphs":[{"id":"slow","text":"A slow teh."},{"id":"fast","text":"A fast teh."}]}`)
+	lines := bufio.NewReader(resp.Body)
+
+	// The fast paragraph's line arrives while the slow one is still checked
+	line, err := lines.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first editorCheckResult
+	if err := json.Unmarshal(line, &first); err != nil || first.ID != "fast" {
+		t.Fatalf("first line %s, %v; want the fast paragraph", line, err)
+	}
+	if started.Load() != 1 {
+		t.Errorf("slow check started %d times, want 1", started.Load())
+	}
+
+	close(release)
+	rest := readCheckResults(t, lines)
+	if len(rest) != 1 || len(rest["slow"].Issues) != 1 {
+		t.Errorf("remaining lines = %+v, want the slow paragraph", rest)
+	}
+}
+
+func TestEditorSave(t *testing.T) {
+	alice, do := editorTestServer(t)
+	newFakeLanguageTool(t, typoHandler)
+	const formType = "application/x-www-form-urlencoded"
+
+	resp := do(http.MethodPost, "/editor", formType, url.Values{"filename": {"../drafts/plan"}, "language": {"en-US"}, "markdown": {"# Plan\n\nFix teh bug."}}.Encode())
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("HX-Trigger") != "notes-changed" {
+		t.Fatalf("save: status %d, HX-Trigger %q", resp.StatusCode, resp.Header.Get("HX-Trigger"))
+	}
+	notes, err := GetAllNotes(alice.ID, NoteFilter{})
+	if err != nil || len(notes) != 1 {
+		t.Fatalf("notes after save = %d, %v", len(notes), err)
+	}
+	note := notes[0]
+	if note.OriginalFilename != "plan.md" || note.Language != "en-US" || len(note.GrammarIssues) != 1 || note.CheckedAt.IsZero() {
+		t.Errorf("saved note %s in %s, checked %v, issues %+v", note.OriginalFilename, note.Language, note.CheckedAt, note.GrammarIssues)
+	}
+
+	// Saving again replaces the content and the check
+	resp = do(http.MethodPut, "/notes/"+note.ID.Hex(), formType, url.Values{"markdown": {"# Plan\n\nFixed the bug."}}.Encode())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: status %d", resp.StatusCode)
+	}
+	note, err = GetNoteByID(alice.ID, note.ID.Hex())
+	if err != nil || !strings.Contains(note.MarkdownContent, "Fixed the bug") || len(note.GrammarIssues) != 0 {
+		t.Errorf("updated note = %q, issues %+v, %v", note.MarkdownContent, note.GrammarIssues, err)
+	}
+
+	// With the checker busy, nothing is saved and the editor is told when
+	// to try again
+	prevQueue := grammarQueue
+	grammarQueue = newCheckQueue(1, 0)
+	t.Cleanup(func() { grammarQueue = prevQueue })
+	release, err := grammarQueue.acquire(context.Background(), laneInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = do(http.MethodPut, "/notes/"+note.ID.Hex(), formType, url.Values{"markdown": {"# Plan\n\nBusy now."}}.Encode())
+	release()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || resp.Header.Get("HX-Retarget") != "#request-error" {
+		t.Errorf("save while busy: status %d, Retry-After %q, HX-Retarget %q", resp.StatusCode, resp.Header.Get("Retry-After"), resp.Header.Get("HX-Retarget"))
+	}
+	if note, err := GetNoteByID(alice.ID, note.ID.Hex()); err != nil || strings.Contains(note.MarkdownContent, "Busy now") {
+		t.Errorf("note after a save while busy = %q, %v", note.MarkdownContent, err)
+	}
+
+	for _, tt := range []struct {
+		method, path, markdown string
+		wantStatus             int
+	}{
+		{http.MethodPost, "/editor", "  \n", http.StatusBadRequest},
+		{http.MethodPut, "/notes/" + note.ID.Hex(), "", http.StatusBadRequest},
+		{http.MethodPut, "/notes/0123456789abcdef01234567", "x", http.StatusNotFound},
+	} {
+		resp := do(tt.method, tt.path, formType, url.Values{"markdown": {tt.markdown}}.Encode())
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s %s with %q: status %d, want %d", tt.method, tt.path, tt.markdown, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
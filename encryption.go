@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// --- Encryption at Rest ---
+//
+// With a master key configured, the markdown and HTML of a note are stored
+// encrypted (envelope encryption): each time a note's content is saved, it
+// is sealed with a new random data key, and the data key is stored wrapped
+// by the master key. The text of the check results, which quotes the note,
+// is sealed the same way whenever they are saved. Notes are decrypted as
+// they are loaded (see db.go), so everything past the database sees the
+// plaintext. Paragraph check results are then not kept in the database
+// (see lookupCachedCheck).
+//
+// Several master keys may be configured: the first wraps new data keys and
+// all of them unwrap. To rotate, put the new key first and run
+// "notex rotate-keys", which re-encrypts every note under it (and encrypts
+// notes stored before encryption was turned on); the old keys can be
+// removed afterwards.
+
+// noteKeys holds the configured master keys; nil when notes are stored in
+// plaintext. Set by InitNoteEncryption.
+var noteKeys *keyring
+
+// errUnknownNoteKey is returned when loading a note wrapped by a master
+// key that is not configured
+var errUnknownNoteKey = errors.New("note is encrypted with a master key that is not configured")
+
+// errNoteEncryptionOff is returned when loading an encrypted note while no
+// master key is configured
+var errNoteEncryptionOff = errors.New("note is encrypted, but no master key is configured")
+
+// masterKeySize is the size of master and data keys (AES-256)
+const masterKeySize = 32
+
+// masterKey is an AES-256-GCM key, identified by a fingerprint stored
+// with the data keys it wraps
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring is the configured master keys, the first being current
+type keyring struct {
+	current masterKey
+	byID    map[string]masterKey
+}
+
+// InitNoteEncryption reads the master keys from NOTE_ENCRYPTION_KEY, or
+// from the file named by NOTE_ENCRYPTION_KEY_FILE: base64-encoded 32-byte
+// keys, separated by commas, spaces or new lines, current first. Without
+// either, notes are stored in plaintext.
+func InitNoteEncryption() error {
+	value, file := os.Getenv("NOTE_ENCRYPTION_KEY"), os.Getenv("NOTE_ENCRYPTION_KEY_FILE")
+	if value != "" && file != "" {
+		return errors.New("set NOTE_ENCRYPTION_KEY or NOTE_ENCRYPTION_KEY_FILE, not both")
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	if strings.TrimSpace(value) == "" {
+		noteKeys = nil
+		return nil
+	}
+	keys, err := parseKeyring(value)
+	if err != nil {
+		return err
+	}
+	noteKeys = keys
+	return nil
+}
+
+// parseKeyring parses a list of base64-encoded master keys, current first.
+// Lines starting with # are comments.
+func parseKeyring(value string) (*keyring, error) {
+	var fields []string
+	for _, line := range strings.Split(value, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields = append(fields, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})...)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no master key")
+	}
+
+	keys := &keyring{byID: map[string]masterKey{}}
+	for i, field := range fields {
+		raw, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(raw) != masterKeySize {
+			return nil, fmt.Errorf("master key %d is not %d base64-encoded bytes", i+1, masterKeySize)
+		}
+		key, err := newMasterKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			keys.current = key
+		}
+		keys.byID[key.id] = key
+	}
+	return keys, nil
+}
+
+// newMasterKey returns the master key with the given bytes. Its ID is a
+// truncated hash of the key, so the same key always has the same ID.
+func newMasterKey(raw []byte) (masterKey, error) {
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return masterKey{}, err
+	}
+	sum := sha256.Sum256(append([]byte("notex master key "), raw...))
+	return masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// newAEAD returns AES-GCM with the given key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends.
+// additional binds the ciphertext to where it is stored (see noteAAD).
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// open decrypts what seal returned
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// noteAAD is the additional data of a note's sealed field, so that data
+// keys and content cannot be moved to another note or field unnoticed
+func noteAAD(note Note, field string) []byte {
+	return append(note.ID[:], field...)
+}
+
+// newDataKey returns a new random data key, and the key wrapped by the
+// current master key for storing in field of note
+func newDataKey(note Note, field string) (cipher.AEAD, []byte, error) {
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(noteKeys.current.aead, dataKey, noteAAD(note, field))
+	return aead, wrapped, err
+}
+
+// openDataKey unwraps a data key stored in field of note, wrapped by the
+// master key keyID
+func openDataKey(note Note, keyID string, wrapped []byte, field string) (cipher.AEAD, error) {
+	if noteKeys == nil {
+		return nil, errNoteEncryptionOff
+	}
+	master, ok := noteKeys.byID[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w (key %s)", errUnknownNoteKey, keyID)
+	}
+	dataKey, err := open(master.aead, wrapped, noteAAD(note, field))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the data key of note %s: %w", note.ID.Hex(), err)
+	}
+	return newAEAD(dataKey)
+}
+
+// sealNote returns note ready for storing: with encryption on, its
+// markdown and HTML are moved into note.Encrypted under a new data key,
+// and the text of its check results is sealed as by sealCheck.
+// note.ID must be set.
+func sealNote(note Note) (Note, error) {
+	if noteKeys == nil {
+		note.Encrypted = nil
+		return sealCheck(note)
+	}
+	if note.ID.IsZero() {
+		return note, errors.New("sealing a note without an ID")
+	}
+
+	content, wrapped, err := newDataKey(note, "dataKey")
+	if err != nil {
+		return note, err
+	}
+	enc := &NoteEncryption{KeyID: noteKeys.current.id, DataKey: wrapped, MarkdownBytes: int64(len(note.MarkdownContent))}
+	if enc.Markdown, err = seal(content, []byte(note.MarkdownContent), noteAAD(note, "markdown")); err != nil {
+		return note, err
+	}
+	if enc.HTML, err = seal(content, []byte(note.HTMLContent), noteAAD(note, "html")); err != nil {
+		return note, err
+	}
+	note.MarkdownContent, note.HTMLContent, note.Encrypted = "", "", enc
+	return sealCheck(note)
+}
+
+// checkText is the text of a note's check results, as sealed in
+// note.EncryptedCheck: everything in them that may quote the note
+type checkText struct {
+	Issues        []issueText
+	RepeatedWords []WordFrequency
+	DoubledWords  []string
+}
+
+// issueText is the text of one grammar issue
+type issueText struct {
+	Message     string
+	Context     string
+	Word        string
+	Suggestions []string
+}
+
+// sealCheck returns note with the text of its check results moved into
+// note.EncryptedCheck under a new data key, if encryption is on. Rule IDs,
+// categories, offsets and the statistics' numbers stay readable, for
+// filtering and sorting. note.ID must be set.
+func sealCheck(note Note) (Note, error) {
+	if noteKeys == nil {
+		note.EncryptedCheck = nil
+		return note, nil
+	}
+	if note.ID.IsZero() {
+		return note, errors.New("sealing a note without an ID")
+	}
+
+	text := checkText{RepeatedWords: note.Stats.RepeatedWords, DoubledWords: note.Stats.DoubledWords}
+	issues := make([]GrammarIssue, len(note.GrammarIssues)) // Don't blank the caller's issues
+	for i, issue := range note.GrammarIssues {
+		text.Issues = append(text.Issues, issueText{issue.Message, issue.Context, issue.Word, issue.Suggestions})
+		issue.Message, issue.Context, issue.Word, issue.Suggestions = "", "", "", nil
+		issues[i] = issue
+	}
+	plaintext, err := json.Marshal(text)
+	if err != nil {
+		return note, err
+	}
+
+	aead, wrapped, err := newDataKey(note, "checkKey")
+	if err != nil {
+		return note, err
+	}
+	sealed := &SealedCheck{KeyID: noteKeys.current.id, DataKey: wrapped}
+	if sealed.Text, err = seal(aead, plaintext, noteAAD(note, "check")); err != nil {
+		return note, err
+	}
+	note.GrammarIssues, note.EncryptedCheck = issues, sealed
+	note.Stats.RepeatedWords, note.Stats.DoubledWords = nil, nil
+	return note, nil
+}
+
+// openNote decrypts the markdown and HTML of a note as loaded from the
+// database, and the text of its check results, if they are encrypted.
+// note.Encrypted and note.EncryptedCheck are kept, to tell which key the
+// note is stored under.
+func openNote(note *Note) error {
+	if enc := note.Encrypted; enc != nil {
+		content, err := openDataKey(*note, enc.KeyID, enc.DataKey, "dataKey")
+		if err != nil {
+			return err
+		}
+		markdown, err := open(content, enc.Markdown, noteAAD(*note, "markdown"))
+		if err != nil {
+			return fmt.Errorf("decrypting note %s: %w", note.ID.Hex(), err)
+		}
+		html, err := open(content, enc.HTML, noteAAD(*note, "html"))
+		if err != nil {
+			return fmt.Errorf("decrypting note %s: %w", note.ID.Hex(), err)
+		}
+		note.MarkdownContent, note.HTMLContent = string(markdown), string(html)
+	}
+	return openCheck(note)
+}
+
+// openCheck restores the text of a note's check results sealed by
+// sealCheck
+func openCheck(note *Note) error {
+	sealed := note.EncryptedCheck
+	if sealed == nil {
+		return nil
+	}
+	aead, err := openDataKey(*note, sealed.KeyID, sealed.DataKey, "checkKey")
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(aead, sealed.Text, noteAAD(*note, "check"))
+	if err != nil {
+		return fmt.Errorf("decrypting the check of note %s: %w", note.ID.Hex(), err)
+	}
+	var text checkText
+	if err := json.Unmarshal(plaintext, &text); err != nil {
+		return fmt.Errorf("decrypting the check of note %s: %w", note.ID.Hex(), err)
+	}
+	if len(text.Issues) != len(note.GrammarIssues) {
+		return fmt.Errorf("decrypting the check of note %s: %d issues sealed, %d stored", note.ID.Hex(), len(text.Issues), len(note.GrammarIssues))
+	}
+
+	for i, t := range text.Issues {
+		issue := &note.GrammarIssues[i]
+		issue.Message, issue.Context, issue.Word, issue.Suggestions = t.Message, t.Context, t.Word, t.Suggestions
+	}
+	note.Stats.RepeatedWords, note.Stats.DoubledWords = text.RepeatedWords, text.DoubledWords
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestMasterKey returns a random base64-encoded master key
+func newTestMasterKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, masterKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// useNoteKeys configures the given master keys for the test
+func useNoteKeys(t *testing.T, keys string) {
+	t.Helper()
+	t.Setenv("NOTE_ENCRYPTION_KEY", keys)
+	t.Setenv("NOTE_ENCRYPTION_KEY_FILE", "")
+	if err := InitNoteEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { noteKeys = nil })
+}
+
+func TestParseKeyring(t *testing.T) {
+	a, b := newTestMasterKey(t), newTestMasterKey(t)
+	keys, err := parseKeyring("# current\n" + a + "\n# retired\n" + b + ", \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := parseKeyring(a)
+	if len(keys.byID) != 2 || keys.current.id != again.current.id {
+		t.Errorf("keyring of %d keys, current %s, want 2 keys, current %s", len(keys.byID), keys.current.id, again.current.id)
+	}
+
+	for _, value := range []string{"", "# none", "not base64!", base64.StdEncoding.EncodeToString([]byte("too short")), a + ",x"} {
+		if _, err := parseKeyring(value); err == nil {
+			t.Errorf("parseKeyring(%q) succeeded", value)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(file, []byte(b+"\n"+a+"\n"), 0o600)
+	t.Setenv("NOTE_ENCRYPTION_KEY", "")
+	t.Setenv("NOTE_ENCRYPTION_KEY_FILE", file)
+	t.Cleanup(func() { noteKeys = nil })
+	if err := InitNoteEncryption(); err != nil || noteKeys.current.id == keys.current.id {
+		t.Errorf("key file: %v, current key %v", err, noteKeys)
+	}
+	t.Setenv("NOTE_ENCRYPTION_KEY", a)
+	if err := InitNoteEncryption(); err == nil {
+		t.Error("both a key and a key file accepted")
+	}
+}
+
+func TestSealNote(t *testing.T) {
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+	useNoteKeys(t, oldKey)
+	note := Note{ID: primitive.NewObjectID(), MarkdownContent: "# Secret\n\nThe *plan*.", HTMLContent: "<h1>Secret</h1>"}
+	sealed, err := sealNote(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.MarkdownContent != "" || sealed.HTMLContent != "" || sealed.Encrypted.MarkdownBytes != int64(len(note.MarkdownContent)) ||
+		strings.Contains(string(sealed.Encrypted.Markdown), "Secret") {
+		t.Fatalf("sealed note: %+v", sealed)
+	}
+	other, _ := sealNote(note)
+	if string(other.Encrypted.DataKey) == string(sealed.Encrypted.DataKey) {
+		t.Error("two seals share a data key")
+	}
+
+	opened := sealed
+	if err := openNote(&opened); err != nil || opened.MarkdownContent != note.MarkdownContent || opened.HTMLContent != note.HTMLContent {
+		t.Fatalf("opened note: %+v, %v", opened, err)
+	}
+
+	// Content moved to another note or field does not open
+	moved := sealed
+	moved.ID = primitive.NewObjectID()
+	swapped := sealed
+	swapped.Encrypted = &NoteEncryption{KeyID: sealed.Encrypted.KeyID, DataKey: sealed.Encrypted.DataKey, Markdown: sealed.Encrypted.HTML, HTML: sealed.Encrypted.Markdown}
+	for name, n := range map[string]Note{"moved": moved, "swapped": swapped} {
+		if err := openNote(&n); err == nil {
+			t.Errorf("%s content opened", name)
+		}
+	}
+
+	// After a rotation, notes of the old key still open while it is
+	// configured, and new seals use the new key
+	useNoteKeys(t, newKey+","+oldKey)
+	opened = sealed
+	if err := openNote(&opened); err != nil || opened.MarkdownContent != note.MarkdownContent {
+		t.Errorf("note of the retired key: %v", err)
+	}
+	if resealed, _ := sealNote(opened); resealed.Encrypted.KeyID != noteKeys.current.id || resealed.Encrypted.KeyID == sealed.Encrypted.KeyID {
+		t.Errorf("resealed under %s", resealed.Encrypted.KeyID)
+	}
+	useNoteKeys(t, newKey)
+	if err := openNote(&sealed); !errors.Is(err, errUnknownNoteKey) {
+		t.Errorf("note of a removed key: %v, want errUnknownNoteKey", err)
+	}
+	noteKeys = nil
+	if err := openNote(&sealed); !errors.Is(err, errNoteEncryptionOff) {
+		t.Errorf("encryption off: %v, want errNoteEncryptionOff", err)
+	}
+}
+
+func TestSealCheck(t *testing.T) {
+	useNoteKeys(t, newTestMasterKey(t))
+	note := Note{
+		ID: primitive.NewObjectID(),
+		GrammarIssues: []GrammarIssue{
+			{Message: "Possible spelling mistake found.", Context: "The secret teh plan", Word: "teh", Suggestions: []string{"the"},
+				Offset: 11, Length: 3, RuleID: "MORFOLOGIK_RULE_EN_US", Category: CategorySpelling},
+			{Message: "Heading level skipped.", Context: "### Secret", Offset: 0, Length: 10, RuleID: "MD001"},
+		},
+		Stats: NoteStats{WordCount: 4, RepeatedWords: []WordFrequency{{"secret", 3}}, DoubledWords: []string{"plan"}},
+	}
+	want := note.GrammarIssues[0]
+
+	sealed, err := sealNote(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.GrammarIssues[0].Word != "teh" {
+		t.Fatal("sealing changed the issues of the note passed in")
+	}
+	for _, issue := range sealed.GrammarIssues {
+		if issue.Message != "" || issue.Context != "" || issue.Word != "" || issue.Suggestions != nil {
+			t.Errorf("sealed issue has text: %+v", issue)
+		}
+	}
+	if issue := sealed.GrammarIssues[0]; issue.Offset != 11 || issue.RuleID != want.RuleID || issue.Category != CategorySpelling {
+		t.Errorf("sealed issue lost its position or rule: %+v", issue)
+	}
+	if sealed.Stats.RepeatedWords != nil || sealed.Stats.DoubledWords != nil || sealed.Stats.WordCount != 4 ||
+		strings.Contains(string(sealed.EncryptedCheck.Text), "secret") {
+		t.Errorf("sealed stats %+v, check %q", sealed.Stats, sealed.EncryptedCheck.Text)
+	}
+
+	opened := sealed
+	opened.GrammarIssues = append([]GrammarIssue(nil), sealed.GrammarIssues...)
+	if err := openNote(&opened); err != nil {
+		t.Fatal(err)
+	}
+	if got := opened.GrammarIssues[0]; got.Message != want.Message || got.Context != want.Context || got.Word != "teh" || len(got.Suggestions) != 1 ||
+		opened.GrammarIssues[1].Context != "### Secret" || opened.Stats.RepeatedWords[0].Word != "secret" || opened.Stats.DoubledWords[0] != "plan" {
+		t.Errorf("opened check: %+v, %+v", opened.GrammarIssues, opened.Stats)
+	}
+
+	// Checks re-saved on their own are sealed under a key of their own
+	rechecked, err := sealCheck(opened)
+	if err != nil || rechecked.Encrypted == nil || string(rechecked.EncryptedCheck.DataKey) == string(sealed.EncryptedCheck.DataKey) {
+		t.Errorf("re-sealed check: %+v, %v", rechecked.EncryptedCheck, err)
+	}
+
+	// A check moved to another note, or with issues added or removed in
+	// the database, does not open
+	moved := sealed
+	moved.ID = primitive.NewObjectID()
+	moved.Encrypted = nil
+	dropped := sealed
+	dropped.GrammarIssues = sealed.GrammarIssues[:1]
+	for name, n := range map[string]Note{"moved": moved, "dropped": dropped} {
+		if err := openNote(&n); err == nil {
+			t.Errorf("%s check opened", name)
+		}
+	}
+
+	noteKeys = nil
+	if plain, err := sealCheck(note); err != nil || plain.EncryptedCheck != nil || plain.GrammarIssues[0].Word != "teh" {
+		t.Errorf("without encryption: %+v, %v", plain, err)
+	}
+}
+
+func TestNoteEncryptionAtRest(t *testing.T) {
+	useTestDB(t)
+	owner := primitive.NewObjectID()
+	plain, err := CreateNote(Note{OwnerID: owner, MarkdownContent: "plaintext note", HTMLContent: "<p>plaintext note</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+	useNoteKeys(t, oldKey)
+	secretIssue := GrammarIssue{Message: "Did you mean secret?", Context: "secret note", Word: "secret", Offset: 0, Length: 6}
+	id, err := CreateNote(Note{OwnerID: owner, MarkdownContent: "secret note", HTMLContent: "<p>secret note</p>", GrammarIssues: []GrammarIssue{secretIssue}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	stored := func() string {
+		var raw bson.M
+		notesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&raw)
+		return fmt.Sprint(raw)
+	}
+	if raw := stored(); strings.Contains(raw, "secret") {
+		t.Errorf("stored note has plaintext content: %v", raw)
+	}
+	note, err := GetNoteByID(owner, id.Hex())
+	if err != nil || note.MarkdownContent != "secret note" || len(note.GrammarIssues) != 1 || note.GrammarIssues[0].Context != secretIssue.Context || note.GrammarIssues[0].Message != secretIssue.Message {
+		t.Fatalf("loaded note: %+v, %v", note, err)
+	}
+
+	// So are re-checks, and checked paragraphs are not cached in the database
+	note.GrammarIssues[0].Context = "secret note, re-checked"
+	note.Stats.DoubledWords = []string{"secret"}
+	if err := UpdateNoteCheck(note); err != nil {
+		t.Fatal(err)
+	}
+	if raw := stored(); strings.Contains(raw, "secret") {
+		t.Errorf("stored check has plaintext: %v", raw)
+	}
+	if note, err := GetNoteByID(owner, id.Hex()); err != nil || note.GrammarIssues[0].Context != "secret note, re-checked" || note.Stats.DoubledWords[0] != "secret" {
+		t.Errorf("re-checked note: %+v, %v", note, err)
+	}
+	prevCollection, prevCache := grammarCacheCollection, grammarCache
+	grammarCacheCollection, grammarCache = notesCollection.Database().Collection("grammarCache"), newCheckLRU(10)
+	t.Cleanup(func() { grammarCacheCollection, grammarCache = prevCollection, prevCache })
+	storeCachedCheck("key", GrammarResult{Issues: []GrammarIssue{secretIssue}})
+	if n, err := grammarCacheCollection.CountDocuments(ctx, bson.M{}); n != 0 || err != nil {
+		t.Errorf("%d paragraphs cached in the database, %v", n, err)
+	}
+	if usage, err := GetStorageUsage(owner); err != nil || usage.Bytes != int64(len("plaintext note")+len("secret note")) {
+		t.Errorf("storage usage: %+v, %v", usage, err)
+	}
+
+	note.MarkdownContent, note.HTMLContent = "edited secret", "<p>edited secret</p>"
+	if err := UpdateNoteContent(note); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := GetAllNotes(owner, NoteFilter{Sort: "oldest"})
+	if err != nil || len(notes) != 2 || notes[0].MarkdownContent != "plaintext note" || notes[1].MarkdownContent != "edited secret" {
+		t.Fatalf("notes: %+v, %v", notes, err)
+	}
+
+	// Rotating re-encrypts both notes under the new key
+	useNoteKeys(t, newKey+"\n"+oldKey)
+	ids, err := GetNoteIDsToReseal(noteKeys.current.id)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("notes to reseal: %v, %v", ids, err)
+	}
+	for _, id := range ids {
+		if ok, err := ResealNote(id); !ok || err != nil {
+			t.Errorf("ResealNote(%s) = %v, %v", id.Hex(), ok, err)
+		}
+	}
+	if ids, _ := GetNoteIDsToReseal(noteKeys.current.id); len(ids) != 0 {
+		t.Errorf("%d notes left after rotating", len(ids))
+	}
+	useNoteKeys(t, newKey)
+	for _, id := range []primitive.ObjectID{plain, id} {
+		if note, err := GetNoteByID(owner, id.Hex()); err != nil || note.Encrypted == nil || note.MarkdownContent == "" {
+			t.Errorf("rotated note %s: %+v, %v", id.Hex(), note, err)
+		}
+	}
+}
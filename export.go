@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// exportFormat describes a grammar report format
+type exportFormat struct {
+	ContentType string
+	Extension   string
+	write       func(w io.Writer, files []reportFile) error
+}
+
+// exportFormats maps the format names accepted by the export endpoint and
+// command to their writers
+var exportFormats = map[string]exportFormat{
+	"json":       {ContentType: "application/json", Extension: "json", write: writeJSONReport},
+	"sarif":      {ContentType: "application/sarif+json", Extension: "sarif", write: writeSARIFReport},
+	"checkstyle": {ContentType: "application/xml", Extension: "xml", write: writeCheckstyleReport},
+}
+
+// reportFile is a note with the issues to report for it
+type reportFile struct {
+	Note   Note
+	Issues []reportIssue
+}
+
+// reportIssue is an issue with its position as line and column. Lines and
+// columns start at 1; columns count Unicode code points, not bytes. The
+// end position is just after the issue.
+type reportIssue struct {
+	GrammarIssue
+	Line      int `json:"line"`
+	Column    int `json:"column"`
+	EndLine   int `json:"endLine"`
+	EndColumn int `json:"endColumn"`
+}
+
+// WriteReport writes the issues of notes in the given format. Issues the
+// settings ignore are left out, as in the web interface.
+func WriteReport(w io.Writer, format string, notes []Note, settings GrammarSettings) error {
+	f, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("unknown report format %q (available: %s)", format, strings.Join(exportFormatNames(), ", "))
+	}
+
+	files := make([]reportFile, len(notes))
+	for i, note := range notes {
+		files[i].Note = note
+		positions := newLineIndex(note.MarkdownContent)
+		for _, issue := range settings.FilterIssues(note.GrammarIssues) {
+			ri := reportIssue{GrammarIssue: issue}
+			ri.Line, ri.Column = positions.position(issue.Offset)
+			ri.EndLine, ri.EndColumn = positions.position(issue.Offset + issue.Length)
+			files[i].Issues = append(files[i].Issues, ri)
+		}
+	}
+	return f.write(w, files)
+}
+
+// exportFormatNames returns the names of the report formats, sorted
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lineIndex converts byte offsets in a text to lines and columns
+type lineIndex struct {
+	text       string
+	lineStarts []int // Byte offset of the start of each line
+}
+
+func newLineIndex(text string) lineIndex {
+	starts := []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return lineIndex{text: text, lineStarts: starts}
+}
+
+// position returns the 1-based line and column of a byte offset
+func (idx lineIndex) position(offset int) (line, column int) {
+	offset = max(0, min(offset, len(idx.text)))
+	// The last line starting at or before offset
+	i := sort.Search(len(idx.lineStarts), func(i int) bool { return idx.lineStarts[i] > offset }) - 1
+	return i + 1, utf8.RuneCountInString(idx.text[idx.lineStarts[i]:offset]) + 1
+}
+
+// --- JSON ---
+
+type jsonReport struct {
+	Tool        string           `json:"tool"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Files       []jsonReportFile `json:"files"`
+}
+
+type jsonReportFile struct {
+	File           string        `json:"file"`
+	NoteID         string        `json:"noteId"`
+	Language       string        `json:"language,omitempty"`
+	CheckerVersion string        `json:"checkerVersion,omitempty"`
+	CheckedAt      *time.Time    `json:"checkedAt,omitempty"`
+	Issues         []reportIssue `json:"issues"`
+}
+
+func writeJSONReport(w io.Writer, files []reportFile) error {
+	report := jsonReport{Tool: "notex", GeneratedAt: time.Now().UTC(), Files: []jsonReportFile{}}
+	for _, f := range files {
+		file := jsonReportFile{
+			File:           f.Note.OriginalFilename,
+			NoteID:         f.Note.ID.Hex(),
+			Language:       f.Note.Language,
+			CheckerVersion: f.Note.CheckerVersion,
+			Issues:         f.Issues,
+		}
+		if !f.Note.CheckedAt.IsZero() {
+			file.CheckedAt = &f.Note.CheckedAt
+		}
+		if file.Issues == nil {
+			file.Issues = []reportIssue{}
+		}
+		report.Files = append(report.Files, file)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(report)
+}
+
+// --- SARIF ---
+//
+// Static Analysis Results Interchange Format 2.1.0, as read by GitHub code
+// scanning and most CI annotators. Only the parts notex needs are modeled.
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name,omitempty"`
+	ShortDescription *sarifMessage     `json:"shortDescription,omitempty"`
+	Properties       map[string]string `json:"properties,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId,omitempty"`
+	RuleIndex  *int              `json:"ruleIndex,omitempty"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int           `json:"startLine"`
+	StartColumn int           `json:"startColumn"`
+	EndLine     int           `json:"endLine"`
+	EndColumn   int           `json:"endColumn"`
+	Snippet     *sarifMessage `json:"snippet,omitempty"`
+}
+
+// sarifLevels maps issue severities to SARIF result levels
+var sarifLevels = map[string]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+	SeverityInfo:    "note",
+}
+
+func writeSARIFReport(w io.Writer, files []reportFile) error {
+	run := sarifRun{
+		Tool:       sarifTool{Driver: sarifDriver{Name: "notex", Rules: []sarifRule{}}},
+		ColumnKind: "unicodeCodePoints", // See reportIssue
+		Results:    []sarifResult{},
+	}
+
+	ruleIndex := map[string]int{}
+	for _, f := range files {
+		for _, issue := range f.Issues {
+			result := sarifResult{
+				RuleID:  issue.RuleID,
+				Level:   sarifLevels[issue.Severity],
+				Message: sarifMessage{Text: issue.Message},
+				Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: f.Note.OriginalFilename},
+					Region: sarifRegion{
+						StartLine:   issue.Line,
+						StartColumn: issue.Column,
+						EndLine:     issue.EndLine,
+						EndColumn:   issue.EndColumn,
+					},
+				}}},
+			}
+			if issue.Category != "" || issue.Source != "" {
+				result.Properties = map[string]string{"category": issue.Category, "source": issue.Source}
+			}
+			if result.Level == "" {
+				result.Level = "warning"
+			}
+			if issue.Word != "" {
+				result.Locations[0].PhysicalLocation.Region.Snippet = &sarifMessage{Text: issue.Word}
+			}
+			if len(issue.Suggestions) > 0 {
+				result.Message.Text += " Suggestions: " + strings.Join(issue.Suggestions, ", ")
+			}
+
+			if issue.RuleID != "" {
+				i, ok := ruleIndex[issue.RuleID]
+				if !ok {
+					i = len(run.Tool.Driver.Rules)
+					ruleIndex[issue.RuleID] = i
+					rule := sarifRule{ID: issue.RuleID, Name: issue.ShortMessage}
+					if issue.RuleDescription != "" {
+						rule.ShortDescription = &sarifMessage{Text: issue.RuleDescription}
+					}
+					if issue.RuleCategory != "" {
+						rule.Properties = map[string]string{"category": issue.RuleCategory}
+					}
+					run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rule)
+				}
+				result.RuleIndex = &i
+			}
+			run.Results = append(run.Results, result)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(sarifLog{Schema: sarifSchema, Version: "2.1.0", Runs: []sarifRun{run}})
+}
+
+// --- Checkstyle ---
+
+type checkstyleReport struct {
+	XMLName xml.Name         `xml:"checkstyle"`
+	Version string           `xml:"version,attr"`
+	Files   []checkstyleFile `xml:"file"`
+}
+
+type checkstyleFile struct {
+	Name   string            `xml:"name,attr"`
+	Errors []checkstyleError `xml:"error"`
+}
+
+type checkstyleError struct {
+	Line     int    `xml:"line,attr"`
+	Column   int    `xml:"column,attr"`
+	Severity string `xml:"severity,attr"`
+	Message  string `xml:"message,attr"`
+	Source   string `xml:"source,attr"`
+}
+
+func writeCheckstyleReport(w io.Writer, files []reportFile) error {
+	report := checkstyleReport{Version: "4.3"}
+	for _, f := range files {
+		file := checkstyleFile{Name: f.Note.OriginalFilename}
+		for _, issue := range f.Issues {
+			source := "notex"
+			if issue.Source != "" {
+				source += "." + issue.Source
+			}
+			if issue.RuleID != "" {
+				source += "." + issue.RuleID
+			}
+			severity := issue.Severity
+			if severity == "" {
+				severity = SeverityWarning
+			}
+			file.Errors = append(file.Errors, checkstyleError{
+				Line:     issue.Line,
+				Column:   issue.Column,
+				Severity: severity, // error, warning and info are checkstyle severities too
+				Message:  issue.Message,
+				Source:   source,
+			})
+		}
+		report.Files = append(report.Files, file)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// --- Handlers ---
+
+// handleExportNote exports the issues of the note {id}, and
+// handleExportNotes those of all notes of the current workspace, in the
+// format given by the "format" query parameter (json by default)
+func handleExportNote(w http.ResponseWriter, r *http.Request) {
+	noteID := chi.URLParam(r, "id")
+	note, err := GetNoteByID(currentWorkspace(r), noteID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Note not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error fetching note %s: %v", noteID, err)
+			http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		}
+		return
+	}
+	recordAudit(r, AuditView, note, "export")
+	writeReportResponse(w, r, strings.TrimSuffix(note.OriginalFilename, ".md"), []Note{note})
+}
+
+func handleExportNotes(w http.ResponseWriter, r *http.Request) {
+	notes, err := GetAllNotes(currentWorkspace(r), NoteFilter{Sort: "oldest"})
+	if err != nil {
+		log.Printf("Error fetching notes: %v", err)
+		http.Error(w, "Failed to load notes", http.StatusInternalServerError)
+		return
+	}
+	for _, note := range notes {
+		recordAudit(r, AuditView, note, "export of all notes")
+	}
+	writeReportResponse(w, r, "notex", notes)
+}
+
+// writeReportResponse writes the report of notes as a download named
+// after name
+func writeReportResponse(w http.ResponseWriter, r *http.Request, name string, notes []Note) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	f, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "Unknown format; use one of: "+strings.Join(exportFormatNames(), ", "), http.StatusBadRequest)
+		return
+	}
+
+	settings, err := GetGrammarSettings(currentWorkspace(r))
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+
+	w.Header().Set("Content-Type", f.ContentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-grammar."+f.Extension))
+	if err := WriteReport(w, format, notes, settings); err != nil {
+		log.Printf("Error writing %s report: %v", format, err)
+	}
+}
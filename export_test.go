@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLineIndexPosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		offset    int
+		line, col int
+	}{
+		{"start", "ab\ncd", 0, 1, 1},
+		{"first line", "ab\ncd", 1, 1, 2},
+		{"newline itself", "ab\ncd", 2, 1, 3},
+		{"second line", "ab\ncd", 3, 2, 1},
+		{"end of text", "ab\ncd", 5, 2, 3},
+		{"empty lines", "a\n\n\nb", 4, 4, 1},
+		{"multi-byte runes", "héllo wörld", len("héllo w"), 1, 8},
+		{"emoji", "😀 x", len("😀 "), 1, 3},
+		{"multi-byte on a later line", "ü\nçà x", len("ü\nçà "), 2, 4},
+		{"crlf", "ab\r\ncd", 4, 2, 1},
+		{"crlf second column", "ab\r\ncd\r\nef", len("ab\r\ncd\r\ne"), 3, 2},
+		{"before crlf", "ab\r\ncd", 2, 1, 3},
+		{"negative offset", "ab", -4, 1, 1},
+		{"past the end", "ab\ncd", 99, 2, 3},
+		{"empty text", "", 0, 1, 1},
+	}
+	for _, tt := range tests {
+		line, col := newLineIndex(tt.text).position(tt.offset)
+		if line != tt.line || col != tt.col {
+			t.Errorf("%s: position(%d) = %d:%d, want %d:%d", tt.name, tt.offset, line, col, tt.line, tt.col)
+		}
+	}
+}
+
+// exportTestNotes returns two notes with issues of each source, severity
+// and awkward message for the report tests
+func exportTestNotes() []Note {
+	id1, _ := primitive.ObjectIDFromHex("0123456789abcdef01234567")
+	id2, _ := primitive.ObjectIDFromHex("89abcdef0123456789abcdef")
+	return []Note{
+		{
+			ID:               id1,
+			OriginalFilename: "café.md",
+			MarkdownContent:  "# Tïtle\r\n\r\nI saw teh cat.\r\nSee https://example.com\r\n",
+			GrammarIssues: []GrammarIssue{
+				{Message: "Possible spelling mistake found.", Offset: 18, Length: 3, Word: "teh", Suggestions: []string{"the", "ten"},
+					RuleID: "MORFOLOGIK_RULE_EN_US", ShortMessage: "Spelling mistake", RuleDescription: "Possible spelling mistake",
+					RuleCategory: "TYPOS", Category: CategorySpelling, Severity: SeverityError, Source: SourceLanguageTool},
+				{Message: `Use "<" & ">" with care`, Offset: 2, Length: 6, Word: "Tïtle", Severity: "bogus"},
+				{Message: "Bare URL; wrap it in <...> or write a link.", Offset: 32, Length: 19, Word: "https://example.com",
+					Suggestions: []string{"<https://example.com>"}, RuleID: "MD034", ShortMessage: "no-bare-urls",
+					RuleDescription: "URLs should be written as links or in angle brackets", RuleCategory: "MARKDOWN",
+					Category: CategoryMarkdown, Severity: SeverityInfo, Source: SourceLint},
+				{Message: "Another typo.", Offset: 22, Length: 3, Word: "cat", RuleID: "MORFOLOGIK_RULE_EN_US",
+					Category: CategorySpelling, Severity: SeverityWarning, Source: SourceLanguageTool},
+			},
+		},
+		{ID: id2, OriginalFilename: "clean.md", MarkdownContent: "Nothing to see."},
+	}
+}
+
+// readGolden returns the contents of testdata/export/name
+func readGolden(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "export", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriteReportGolden(t *testing.T) {
+	for format, golden := range map[string]string{"sarif": "report.sarif", "checkstyle": "report.xml"} {
+		var b bytes.Buffer
+		if err := WriteReport(&b, format, exportTestNotes(), GrammarSettings{}); err != nil {
+			t.Fatal(err)
+		}
+		if want := readGolden(t, golden); b.String() != want {
+			t.Errorf("%s report differs from testdata/export/%s:\n%s", format, golden, b.String())
+		}
+	}
+}
+
+func TestSARIFReport(t *testing.T) {
+	var b bytes.Buffer
+	settings := GrammarSettings{Dictionary: []string{"Cat"}}
+	if err := WriteReport(&b, "sarif", exportTestNotes(), settings); err != nil {
+		t.Fatal(err)
+	}
+	var report sarifLog
+	if err := json.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if report.Version != "2.1.0" || report.Schema != sarifSchema || len(report.Runs) != 1 {
+		t.Fatalf("log = %s %s with %d runs", report.Schema, report.Version, len(report.Runs))
+	}
+	run := report.Runs[0]
+	if run.Tool.Driver.Name != "notex" || run.ColumnKind != "unicodeCodePoints" {
+		t.Errorf("run tool %q, column kind %q", run.Tool.Driver.Name, run.ColumnKind)
+	}
+	// Rules are listed once, in order of first use
+	if len(run.Tool.Driver.Rules) != 2 || run.Tool.Driver.Rules[0].ID != "MORFOLOGIK_RULE_EN_US" || run.Tool.Driver.Rules[1].ID != "MD034" {
+		t.Fatalf("rules = %+v", run.Tool.Driver.Rules)
+	}
+	// The dictionary word is left out
+	if len(run.Results) != 3 {
+		t.Fatalf("%d results, want 3: %+v", len(run.Results), run.Results)
+	}
+	for i, want := range []struct {
+		level     string
+		ruleIndex int // -1 for none
+	}{{"error", 0}, {"warning", -1}, {"note", 1}} {
+		result := run.Results[i]
+		if want.ruleIndex < 0 {
+			if result.Level != want.level || result.RuleIndex != nil || result.RuleID != "" {
+				t.Errorf("result %d: level %q, rule %q; want %q and no rule", i, result.Level, result.RuleID, want.level)
+			}
+			continue
+		}
+		if result.Level != want.level || result.RuleIndex == nil || *result.RuleIndex != want.ruleIndex ||
+			run.Tool.Driver.Rules[*result.RuleIndex].ID != result.RuleID {
+			t.Errorf("result %d: level %q, rule %s at %v; want %q, rule index %d", i, result.Level, result.RuleID, result.RuleIndex, want.level, want.ruleIndex)
+		}
+	}
+	region := run.Results[2].Locations[0].PhysicalLocation.Region
+	if region != (sarifRegion{StartLine: 4, StartColumn: 5, EndLine: 4, EndColumn: 24, Snippet: region.Snippet}) ||
+		region.Snippet == nil || region.Snippet.Text != "https://example.com" {
+		t.Errorf("bare URL region = %+v", region)
+	}
+	if uri := run.Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI; uri != "café.md" {
+		t.Errorf("artifact URI = %q", uri)
+	}
+}
+
+func TestCheckstyleReportEscaping(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteReport(&b, "checkstyle", exportTestNotes(), GrammarSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if want := `message="Use &#34;&lt;&#34; &amp; &#34;&gt;&#34; with care"`; !strings.Contains(out, want) {
+		t.Errorf("report lacks the escaped message %s:\n%s", want, out)
+	}
+
+	// The message survives a round trip
+	var report checkstyleReport
+	if err := xml.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatalf("invalid XML: %v", err)
+	}
+	if len(report.Files) != 2 || len(report.Files[0].Errors) != 4 || len(report.Files[1].Errors) != 0 {
+		t.Fatalf("files = %+v", report.Files)
+	}
+	if e := report.Files[0].Errors[1]; e.Message != `Use "<" & ">" with care` || e.Severity != "bogus" || e.Source != "notex" {
+		t.Errorf("error = %+v", e)
+	}
+}
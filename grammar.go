@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,39 +20,18 @@ var grammarChecker *GrammarChecker
 type GrammarChecker struct {
 	serverURL  string
 	serverProc *exec.Cmd
-}
-
-// LanguageToolResult represents the response from LanguageTool
-type LanguageToolResult struct {
-	Software struct {
-		Name    string `json:"name"`
-		Version string `json:"version"`
-	} `json:"software"`
-	Matches []struct {
-		Message      string        `json:"message"`
-		Offset       int           `json:"offset"`
-		Length       int           `json:"length"`
-		Replacements []Replacement `json:"replacements"`
-		Context      struct {
-			Text   string `json:"text"`
-			Offset int    `json:"offset"`
-			Length int    `json:"length"`
-		} `json:"context"`
-		Rule struct {
-			ID          string `json:"id"`
-			Description string `json:"description"`
-			Category    struct {
-				ID   string `json:"id"`
-				Name string `json:"name"`
-			} `json:"category"`
-		} `json:"rule"`
-	} `json:"matches"`
+	client     *http.Client  // nil uses http.DefaultClient
+	retries    int           // Retries of unavailable or rate-limited requests
+	backoff    time.Duration // Wait before the first retry, doubled after each
 }
 
 // NewGrammarChecker creates a new grammar checker
 func NewGrammarChecker() (*GrammarChecker, error) {
 	gc := &GrammarChecker{
 		serverURL: "http://localhost:8081/v2/check",
+		client:    newLanguageToolClient(),
+		retries:   grammarRetries(),
+		backoff:   500 * time.Millisecond,
 	}
 
 	// Start the LanguageTool server
@@ -87,38 +67,95 @@ func (gc *GrammarChecker) StopServer() error {
 	return nil
 }
 
-// CheckText checks the grammar of the given text
-func (gc *GrammarChecker) CheckText(text string, lang string) (*LanguageToolResult, error) {
+// CheckOptions configures a single grammar check
+type CheckOptions struct {
+	Language           string   // LanguageTool language code; empty or "auto" to detect
+	Dictionary         []string // Words that are never spelling errors
+	DisabledRules      []string // LanguageTool rule IDs to skip
+	DisabledCategories []string // LanguageTool category IDs to skip
+}
+
+// CheckOptions builds the options for checking text in lang with these settings
+func (s GrammarSettings) CheckOptions(lang string) CheckOptions {
+	return CheckOptions{
+		Language:           lang,
+		Dictionary:         s.Dictionary,
+		DisabledRules:      s.DisabledRules,
+		DisabledCategories: s.DisabledCategories,
+	}
+}
+
+// FilterIssues drops the issues these settings ignore. Issues stored
+// before a word or rule was added are hidden this way too.
+func (s GrammarSettings) FilterIssues(issues []GrammarIssue) []GrammarIssue {
+	opts := s.CheckOptions("")
+	filtered := make([]GrammarIssue, 0, len(issues))
+	for _, issue := range issues {
+		if !opts.ignores(issue) {
+			filtered = append(filtered, issue)
+		}
+	}
+	return filtered
+}
+
+// ignores reports whether an issue is suppressed by the options
+func (opts CheckOptions) ignores(issue GrammarIssue) bool {
+	for _, rule := range opts.DisabledRules {
+		if issue.RuleID != "" && strings.EqualFold(rule, issue.RuleID) {
+			return true
+		}
+	}
+	for _, category := range opts.DisabledCategories {
+		if issue.RuleCategory != "" && strings.EqualFold(category, issue.RuleCategory) {
+			return true
+		}
+	}
+	if issue.Category == CategorySpelling && issue.Word != "" {
+		for _, word := range opts.Dictionary {
+			if strings.EqualFold(word, issue.Word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckText checks the grammar of the given text.
+// An empty language asks LanguageTool to detect the language itself.
+// Failures are returned as *CheckError, see ErrCheckerUnavailable and
+// friends; transient ones are retried first.
+func (gc *GrammarChecker) CheckText(ctx context.Context, text string, opts CheckOptions) (*LTResponse, error) {
+	lang := opts.Language
 	if lang == "" {
-		lang = "en-US" // Default to English
+		lang = LanguageAuto
 	}
 
 	params := url.Values{}
 	params.Add("text", text)
 	params.Add("language", lang)
-
-	resp, err := http.PostForm(gc.serverURL, params)
-	if err != nil {
-		return nil, err
+	if len(opts.DisabledRules) > 0 {
+		params.Add("disabledRules", strings.Join(opts.DisabledRules, ","))
+	}
+	if len(opts.DisabledCategories) > 0 {
+		params.Add("disabledCategories", strings.Join(opts.DisabledCategories, ","))
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := gc.postForm(ctx, params)
 	if err != nil {
 		return nil, err
 	}
 
-	var result LanguageToolResult
+	var result LTResponse
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		return nil, err
+		return nil, &CheckError{Kind: ErrCheckerBadResponse, StatusCode: http.StatusOK, Err: err}
 	}
 
 	return &result, nil
 }
 
 // FormatCorrections formats grammar correction suggestions
-func (gc *GrammarChecker) FormatCorrections(result *LanguageToolResult) string {
+func (gc *GrammarChecker) FormatCorrections(result *LTResponse) string {
 	if len(result.Matches) == 0 {
 		return "No grammar issues found."
 	}
@@ -160,42 +197,253 @@ func min(a, b int) int {
 
 // InitGrammarChecker initializes the grammar checker
 func InitGrammarChecker() {
+	grammarQueue = newCheckQueue(grammarMaxConcurrency(), grammarQueueSize())
+
 	var err error
 	grammarChecker, err = NewGrammarChecker()
 	if err != nil {
 		log.Printf("Warning: Grammar checker initialization failed: %v", err)
-		// Continue without the grammar checker
+		// Continue without the grammar checker; CheckGrammar falls back
+		// to the Hunspell spell checker
+		if _, err := fallbackSpellChecker(DefaultGrammarLanguage()); err != nil {
+			log.Printf("Warning: No fallback spell checker either: %v", err)
+		}
+		return
 	}
+
+	// Learn the LanguageTool version up front, so cached results of an
+	// older version are not reused by the first checks
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if probe, err := grammarChecker.CheckText(ctx, "Hello.", CheckOptions{Language: "en-US"}); err == nil {
+		setLanguageToolVersion(probe.Software)
+		log.Printf("Grammar checker: %s", CurrentCheckerVersion())
+	} else {
+		log.Printf("Warning: Could not read LanguageTool version: %v", err)
+	}
+}
+
+// languageToolVersion holds the checker version LanguageTool last reported
+var languageToolVersion atomic.Value // string
+
+// setLanguageToolVersion records the version from a LanguageTool response
+func setLanguageToolVersion(info SoftwareInfo) string {
+	version := strings.TrimSpace(info.Name + " " + info.Version)
+	if version != "" {
+		languageToolVersion.Store(version)
+	}
+	return version
+}
+
+// CurrentCheckerVersion returns the checker and version new checks are
+// made with, e.g. "LanguageTool 6.6", or "" if LanguageTool has not
+// answered yet
+func CurrentCheckerVersion() string {
+	if grammarChecker == nil {
+		return hunspellCheckerVersion
+	}
+	version, _ := languageToolVersion.Load().(string)
+	return version
+}
+
+// GrammarResult holds the issues found in a text together with the
+// language LanguageTool used to check it
+type GrammarResult struct {
+	Issues             []GrammarIssue `bson:"issues"`
+	Language           string         `bson:"language"`           // Language code the text was checked with
+	DetectedLanguage   string         `bson:"detectedLanguage"`   // Language code LanguageTool detected
+	LanguageConfidence float64        `bson:"languageConfidence"` // Confidence of the detection (0-1)
+	Incomplete         bool           `bson:"incomplete"`         // LanguageTool did not check all of the text
+	CheckerVersion     string         `bson:"checkerVersion"`     // Checker that found the issues, see CurrentCheckerVersion
 }
 
-// CheckGrammar checks the grammar of the given text
-func CheckGrammar(text string) ([]GrammarIssue, error) {
+// CheckGrammar checks the grammar of the given text.
+// Matches on words in the dictionary or on disabled rules are dropped.
+//
+// The text is checked paragraph by paragraph so that results can be
+// cached; editing one paragraph of a long note re-checks only that one.
+// Paragraphs that miss the cache are sent to LanguageTool in bounded
+// chunks (see checkParagraphs).
+//
+// Without LanguageTool, the Hunspell spell checker is used instead.
+// Checking stops when ctx is canceled, e.g. when the request is.
+func CheckGrammar(ctx context.Context, text string, opts CheckOptions) (GrammarResult, error) {
 	if grammarChecker == nil {
-		return nil, fmt.Errorf("grammar checker not initialized")
+		return CheckSpelling(text, opts)
 	}
 
-	result, err := grammarChecker.CheckText(text, "")
+	paragraphs := splitParagraphs(text)
+	result := GrammarResult{Language: opts.Language, CheckerVersion: CurrentCheckerVersion()}
+	if len(paragraphs) == 0 {
+		return result, nil
+	}
+
+	// With auto-detection, short paragraphs such as headings are easily
+	// misdetected. Detect on the longest paragraph and check the rest in
+	// the language found there. The detection has checked the longest
+	// paragraph in that language already, so its result is kept.
+	rest := paragraphs
+	var detected []GrammarResult
+	reused := -1 // Index of the paragraph checked by the detection
+	if opts.Language == "" || opts.Language == LanguageAuto {
+		longest := 0
+		for i, p := range paragraphs {
+			if len(p.Text) > len(paragraphs[longest].Text) {
+				longest = i
+			}
+		}
+		var err error
+		detected, err = checkParagraphs(ctx, paragraphs[longest:longest+1], opts)
+		if err != nil {
+			return GrammarResult{}, err
+		}
+		result.DetectedLanguage = detected[0].DetectedLanguage
+		result.LanguageConfidence = detected[0].LanguageConfidence
+		if lang := detected[0].Language; lang != "" && lang != LanguageAuto {
+			opts.Language = lang
+			reused = longest
+			rest = append(append([]textSegment{}, paragraphs[:longest]...), paragraphs[longest+1:]...)
+			if !detected[0].Incomplete {
+				// Checks in the detected language, e.g. by the editor, find it too
+				storeCachedCheck(opts.cacheKey(paragraphs[longest].Text), detected[0])
+			}
+		}
+	}
+
+	checked, err := checkParagraphs(ctx, rest, opts)
 	if err != nil {
-		return nil, err
+		return GrammarResult{}, err
+	}
+	if reused >= 0 {
+		checked = append(checked[:reused], append([]GrammarResult{detected[0]}, checked[reused:]...)...)
+	}
+	for i, p := range paragraphs {
+		if result.DetectedLanguage == "" {
+			result.DetectedLanguage = checked[i].DetectedLanguage
+			result.LanguageConfidence = checked[i].LanguageConfidence
+		}
+		result.Incomplete = result.Incomplete || checked[i].Incomplete
+		if result.CheckerVersion == "" {
+			result.CheckerVersion = checked[i].CheckerVersion
+		}
+
+		// Shift paragraph-relative offsets to offsets in the whole text
+		for _, issue := range checked[i].Issues {
+			if opts.ignores(issue) {
+				continue
+			}
+			issue.Offset += p.Offset
+			result.Issues = append(result.Issues, issue)
+		}
+	}
+	result.Language = opts.Language
+
+	return result, nil
+}
+
+// checkChunk sends one chunk of text to LanguageTool and converts the
+// matches. Offsets in the result are byte offsets into text.
+func checkChunk(ctx context.Context, text string, opts CheckOptions) (GrammarResult, error) {
+	result, err := grammarChecker.CheckText(ctx, text, opts)
+	if err != nil {
+		return GrammarResult{}, err
 	}
 
 	// Convert LanguageTool results to GrammarIssue
-	issues := make([]GrammarIssue, len(result.Matches))
-	for i, match := range result.Matches {
+	toByteOffset := utf16ToByteOffsets(text)
+	issues := make([]GrammarIssue, 0, len(result.Matches))
+	for _, match := range result.Matches {
 		// Extract replacement values from the Replacement objects
 		suggestions := make([]string, len(match.Replacements))
 		for j, repl := range match.Replacements {
 			suggestions[j] = repl.Value
 		}
 
-		issues[i] = GrammarIssue{
+		// LanguageTool counts UTF-16 code units; store byte offsets instead
+		start := toByteOffset(match.Offset)
+		end := toByteOffset(match.Offset + match.Length)
+
+		issues = append(issues, GrammarIssue{
 			Message:     match.Message,
 			Context:     match.Context.Text,
-			Offset:      match.Offset,
-			Length:      match.Length,
+			Offset:      start,
+			Length:      end - start,
 			Suggestions: suggestions,
+			Word:        text[start:end],
+
+			RuleID:          match.Rule.ID,
+			RuleDescription: match.Rule.Description,
+			RuleCategory:    match.Rule.Category.ID,
+			IssueType:       match.Rule.IssueType,
+			ShortMessage:    match.ShortMessage,
+			Category:        issueCategory(match.Rule.IssueType, match.Rule.Category.ID),
+			Severity:        issueSeverity(match.Rule.IssueType),
+			Source:          SourceLanguageTool,
+		})
+	}
+
+	return GrammarResult{
+		Issues:             issues,
+		Language:           result.Language.Code,
+		DetectedLanguage:   result.Language.DetectedLang.Code,
+		LanguageConfidence: result.Language.DetectedLang.Confidence,
+		Incomplete:         result.Warnings.IncompleteResults,
+		CheckerVersion:     setLanguageToolVersion(result.Software),
+	}, nil
+}
+
+// issueCategory maps a LanguageTool issue type and category ID onto one
+// of the categories issues are grouped by
+func issueCategory(issueType, categoryID string) string {
+	switch {
+	case issueType == "misspelling" || categoryID == "TYPOS":
+		return CategorySpelling
+	case issueType == "typographical" || issueType == "whitespace" ||
+		categoryID == "PUNCTUATION" || categoryID == "TYPOGRAPHY":
+		return CategoryPunctuation
+	case issueType == "style" || issueType == "register" || issueType == "locale-violation" ||
+		categoryID == "STYLE" || categoryID == "REDUNDANCY" || categoryID == "PLAIN_ENGLISH" ||
+		categoryID == "COLLOQUIALISMS" || categoryID == "REPETITIONS_STYLE":
+		return CategoryStyle
+	default:
+		return CategoryGrammar
+	}
+}
+
+// issueSeverity maps a LanguageTool issue type onto a severity level
+func issueSeverity(issueType string) string {
+	switch issueType {
+	case "misspelling", "grammar":
+		return SeverityError
+	case "typographical", "duplication", "inconsistency", "locale-violation", "non-conformance":
+		return SeverityWarning
+	default: // style, register, whitespace, uncategorized, ...
+		return SeverityInfo
+	}
+}
+
+// utf16ToByteOffsets returns a function mapping UTF-16 code unit offsets
+// in text (as reported by LanguageTool) to byte offsets. Offsets past the
+// end are clamped to len(text).
+func utf16ToByteOffsets(text string) func(int) int {
+	// byteAt[u] is the byte offset of UTF-16 unit u; the second unit of a
+	// surrogate pair maps to the start of its rune
+	byteAt := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		byteAt = append(byteAt, i)
+		if r >= 0x10000 {
+			byteAt = append(byteAt, i)
 		}
 	}
+	byteAt = append(byteAt, len(text))
 
-	return issues, nil
+	return func(offset int) int {
+		if offset < 0 {
+			return 0
+		}
+		if offset >= len(byteAt) {
+			return len(text)
+		}
+		return byteAt[offset]
+	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Cache counters, published on /debug/vars
+var (
+	grammarCacheMemoryHits = expvar.NewInt("grammar_cache_memory_hits")
+	grammarCacheStoreHits  = expvar.NewInt("grammar_cache_store_hits")
+	grammarCacheMisses     = expvar.NewInt("grammar_cache_misses")
+)
+
+// grammarCache is the in-memory LRU in front of the persistent cache
+var grammarCache = newCheckLRU(grammarCacheSize())
+
+// grammarCacheSize reads the LRU capacity from GRAMMAR_CACHE_SIZE
+func grammarCacheSize() int {
+	if size, err := strconv.Atoi(os.Getenv("GRAMMAR_CACHE_SIZE")); err == nil && size > 0 {
+		return size
+	}
+	return 2000 // Paragraphs
+}
+
+// lookupCachedCheck finds a paragraph result in the in-memory LRU, then in
+// the persistent cache, counting hits and misses. Results of another
+// checker version than the current one count as misses.
+//
+// With notes encrypted at rest, the persistent cache is not used: its
+// results quote the paragraphs they are for.
+func lookupCachedCheck(key string) (GrammarResult, bool) {
+	if result, ok := grammarCache.Get(key); ok && isCurrentCheck(result) {
+		grammarCacheMemoryHits.Add(1)
+		return result, true
+	}
+	if noteKeys != nil {
+		grammarCacheMisses.Add(1)
+		return GrammarResult{}, false
+	}
+
+	if cached, err := GetCachedCheck(key); err == nil && isCurrentCheck(cached.Result) {
+		grammarCacheStoreHits.Add(1)
+		grammarCache.Add(key, cached.Result)
+		return cached.Result, true
+	} else if err != mongo.ErrNoDocuments && err != errNoGrammarCacheStore {
+		log.Printf("Error reading grammar cache: %v", err)
+	}
+
+	grammarCacheMisses.Add(1)
+	return GrammarResult{}, false
+}
+
+// isCurrentCheck reports whether a cached result was made by the current
+// checker version. While the version is unknown every result is accepted.
+func isCurrentCheck(result GrammarResult) bool {
+	current := CurrentCheckerVersion()
+	return current == "" || result.CheckerVersion == current
+}
+
+// storeCachedCheck saves a paragraph result in both cache layers, or only
+// in memory with notes encrypted at rest
+func storeCachedCheck(key string, result GrammarResult) {
+	grammarCache.Add(key, result)
+	if noteKeys != nil {
+		return
+	}
+	if err := SaveCachedCheck(CachedCheck{Key: key, Result: result}); err != nil && err != errNoGrammarCacheStore {
+		log.Printf("Error writing grammar cache: %v", err)
+	}
+}
+
+// cacheKey hashes text together with every option sent to LanguageTool.
+// The dictionary is not sent, so it is left out: cached results are
+// unfiltered, and CheckGrammar drops the issues the current dictionary
+// ignores (see CheckOptions.ignores) on cache hits as on fresh checks.
+// Adding a word thus takes effect at once and keeps the cached paragraphs.
+func (opts CheckOptions) cacheKey(text string) string {
+	h := sha256.New()
+	for _, part := range []string{
+		opts.Language,
+		sortedJoin(opts.DisabledRules),
+		sortedJoin(opts.DisabledCategories),
+		text,
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0}) // Separator, so parts can't run into each other
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sortedJoin joins a copy of values in sorted order, so that the order
+// settings were added in doesn't change cache keys
+func sortedJoin(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x1f")
+}
+
+// checkLRU is a fixed-size, least-recently-used map of cache keys to
+// check results. It is safe for concurrent use.
+type checkLRU struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Front is most recently used
+	items    map[string]*list.Element
+}
+
+// lruEntry is the value stored in the checkLRU list
+type lruEntry struct {
+	key    string
+	result GrammarResult
+}
+
+func newCheckLRU(capacity int) *checkLRU {
+	return &checkLRU{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the result for key and marks it as recently used
+func (c *checkLRU) Get(key string) (GrammarResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return GrammarResult{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).result, true
+}
+
+// Add stores the result for key, evicting the least recently used entry
+// when the cache is full
+func (c *checkLRU) Add(key string, result GrammarResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruEntry).result = result
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, result: result})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
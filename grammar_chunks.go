@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// chunkSeparator joins consecutive paragraphs inside one chunk
+const chunkSeparator = "\n\n"
+
+// grammarChunkSize is the maximum number of bytes sent to LanguageTool in
+// one request, read from GRAMMAR_CHUNK_SIZE
+func grammarChunkSize() int {
+	if size, err := strconv.Atoi(os.Getenv("GRAMMAR_CHUNK_SIZE")); err == nil && size > 0 {
+		return size
+	}
+	return 20000
+}
+
+// grammarChunkConcurrency is the maximum number of chunks of one text
+// checked at the same time, read from GRAMMAR_CHUNK_CONCURRENCY
+func grammarChunkConcurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("GRAMMAR_CHUNK_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
+// checkChunkPlan is a chunk of text sent to LanguageTool in one request,
+// built from whole paragraphs or from a piece of an oversized paragraph
+type checkChunkPlan struct {
+	Text  string
+	Parts []chunkPart
+}
+
+// chunkPart places a run of paragraph text inside a chunk
+type chunkPart struct {
+	Paragraph       int // Index into the paragraphs being checked
+	ChunkOffset     int // Byte offset of the run in the chunk text
+	ParagraphOffset int // Byte offset of the run in its paragraph
+	Length          int
+}
+
+// checkParagraphs checks each paragraph, returning results with offsets
+// relative to their paragraph. Cached results are reused; the rest are
+// packed into chunks of at most grammarChunkSize bytes and checked
+// concurrently. Results LanguageTool marks as incomplete are not cached.
+func checkParagraphs(ctx context.Context, paragraphs []textSegment, opts CheckOptions) ([]GrammarResult, error) {
+	results := make([]GrammarResult, len(paragraphs))
+	keys := make([]string, len(paragraphs))
+	var missing []int
+	for i, p := range paragraphs {
+		keys[i] = opts.cacheKey(p.Text)
+		if cached, ok := lookupCachedCheck(keys[i]); ok {
+			results[i] = cached
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	chunks := planChunks(paragraphs, missing, grammarChunkSize())
+	chunkResults := make([]GrammarResult, len(chunks))
+
+	// The first failure cancels the chunks still being checked
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(grammarChunkConcurrency())
+	for i, chunk := range chunks {
+		g.Go(func() error {
+			result, err := checkChunk(ctx, chunk.Text, opts)
+			chunkResults[i] = result
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Distribute chunk issues back onto their paragraphs
+	for i, chunk := range chunks {
+		chunkResult := chunkResults[i]
+		for _, part := range chunk.Parts {
+			result := &results[part.Paragraph]
+			if result.Language == "" {
+				result.Language = chunkResult.Language
+				result.DetectedLanguage = chunkResult.DetectedLanguage
+				result.LanguageConfidence = chunkResult.LanguageConfidence
+				result.CheckerVersion = chunkResult.CheckerVersion
+			}
+			result.Incomplete = result.Incomplete || chunkResult.Incomplete
+			if result.Issues == nil {
+				result.Issues = []GrammarIssue{} // Cache "no issues" as checked
+			}
+		}
+		for _, issue := range chunkResult.Issues {
+			part := chunk.partAt(issue.Offset)
+			issue.Offset = issue.Offset - part.ChunkOffset + part.ParagraphOffset
+			results[part.Paragraph].Issues = append(results[part.Paragraph].Issues, issue)
+		}
+	}
+
+	for _, i := range missing {
+		if !results[i].Incomplete {
+			storeCachedCheck(keys[i], results[i])
+		}
+	}
+	return results, nil
+}
+
+// partAt returns the part containing the chunk byte offset. Offsets in a
+// separator belong to the part before it.
+func (c checkChunkPlan) partAt(offset int) chunkPart {
+	part := c.Parts[0]
+	for _, p := range c.Parts[1:] {
+		if p.ChunkOffset > offset {
+			break
+		}
+		part = p
+	}
+	return part
+}
+
+// planChunks packs the paragraphs at the given indexes into chunks of at
+// most maxSize bytes. Consecutive paragraphs share a chunk; a paragraph
+// longer than maxSize is split on sentence boundaries into chunks of its own.
+func planChunks(paragraphs []textSegment, indexes []int, maxSize int) []checkChunkPlan {
+	var chunks []checkChunkPlan
+	var current checkChunkPlan
+	var text strings.Builder
+
+	flush := func() {
+		if len(current.Parts) > 0 {
+			current.Text = text.String()
+			chunks = append(chunks, current)
+		}
+		current = checkChunkPlan{}
+		text.Reset()
+	}
+
+	for _, i := range indexes {
+		p := paragraphs[i].Text
+		if len(p) > maxSize {
+			flush()
+			for _, piece := range splitSentences(p, maxSize) {
+				chunks = append(chunks, checkChunkPlan{
+					Text:  piece.Text,
+					Parts: []chunkPart{{Paragraph: i, ParagraphOffset: piece.Offset, Length: len(piece.Text)}},
+				})
+			}
+			continue
+		}
+
+		if text.Len() > 0 && text.Len()+len(chunkSeparator)+len(p) > maxSize {
+			flush()
+		}
+		if text.Len() > 0 {
+			text.WriteString(chunkSeparator)
+		}
+		current.Parts = append(current.Parts, chunkPart{Paragraph: i, ChunkOffset: text.Len(), Length: len(p)})
+		text.WriteString(p)
+	}
+	flush()
+	return chunks
+}
+
+// splitSentences splits text into pieces of at most maxSize bytes,
+// preferring to cut after a sentence end, then after a line break, then
+// after a space. Text without any of those is cut at a rune boundary.
+func splitSentences(text string, maxSize int) []textSegment {
+	var pieces []textSegment
+	offset := 0
+	for len(text)-offset > maxSize {
+		window := text[offset : offset+maxSize]
+		cut := lastSentenceEnd(window)
+		if cut <= 0 {
+			cut = strings.LastIndexByte(window, '\n') + 1
+		}
+		if cut <= 0 {
+			cut = strings.LastIndexByte(window, ' ') + 1
+		}
+		if cut <= 0 {
+			cut = maxSize
+			for cut > 0 && !utf8.RuneStart(text[offset+cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = maxSize // Degenerate maxSize smaller than one rune
+			}
+		}
+		pieces = append(pieces, textSegment{Offset: offset, Text: text[offset : offset+cut]})
+		offset += cut
+	}
+	if offset < len(text) {
+		pieces = append(pieces, textSegment{Offset: offset, Text: text[offset:]})
+	}
+	return pieces
+}
+
+// lastSentenceEnd returns the byte offset just after the last ". ", "! "
+// or "? " in text, or 0 if there is none
+func lastSentenceEnd(text string) int {
+	end := 0
+	for _, terminator := range []string{". ", "! ", "? "} {
+		if i := strings.LastIndex(text, terminator); i >= 0 && i+len(terminator) > end {
+			end = i + len(terminator)
+		}
+	}
+	return end
+}
+
+// textSegment is a piece of a larger text and its byte offset in it
+type textSegment struct {
+	Offset int
+	Text   string
+}
+
+// splitParagraphs splits text on blank lines. Blank lines themselves are
+// not part of any paragraph.
+func splitParagraphs(text string) []textSegment {
+	var paragraphs []textSegment
+	start := -1 // Start of the current paragraph, -1 between paragraphs
+	lineStart := 0
+	for lineStart < len(text) {
+		lineEnd := strings.IndexByte(text[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(text)
+		} else {
+			lineEnd += lineStart
+		}
+
+		if strings.TrimSpace(text[lineStart:lineEnd]) == "" {
+			if start >= 0 {
+				paragraphs = append(paragraphs, textSegment{Offset: start, Text: strings.TrimRight(text[start:lineStart], "\r\n")})
+				start = -1
+			}
+		} else if start < 0 {
+			start = lineStart
+		}
+		lineStart = lineEnd + 1
+	}
+	if start >= 0 {
+		paragraphs = append(paragraphs, textSegment{Offset: start, Text: strings.TrimRight(text[start:], "\r\n")})
+	}
+	return paragraphs
+}
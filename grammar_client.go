@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of LanguageTool failures. A *CheckError matches one of these
+// with errors.Is.
+var (
+	ErrCheckerUnavailable = errors.New("LanguageTool is unavailable")
+	ErrCheckerRateLimited = errors.New("LanguageTool rate limit reached")
+	ErrCheckerBadResponse = errors.New("bad response from LanguageTool")
+	ErrCheckerBusy        = errors.New("grammar checker is busy")
+)
+
+// CheckError describes a failed request to LanguageTool
+type CheckError struct {
+	Kind       error         // ErrCheckerUnavailable, ErrCheckerRateLimited, ErrCheckerBadResponse or ErrCheckerBusy
+	StatusCode int           // HTTP status, 0 if there was no response
+	RetryAfter time.Duration // Wait requested by a 429 or 503 response, or estimated by grammarQueue
+	Err        error         // Underlying error, if any
+}
+
+func (e *CheckError) Error() string {
+	msg := e.Kind.Error()
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrCheckerUnavailable) etc. match on the kind
+func (e *CheckError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// temporary reports whether the request may succeed when retried. A busy
+// queue is not retried here: the caller is told to come back later.
+func (e *CheckError) temporary() bool {
+	return e.Kind == ErrCheckerUnavailable || e.Kind == ErrCheckerRateLimited
+}
+
+// grammarTimeout is the time limit of one request to LanguageTool, read
+// from GRAMMAR_TIMEOUT (a duration such as "30s")
+func grammarTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAMMAR_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * time.Second
+}
+
+// grammarRetries is how often a failed request is retried, read from
+// GRAMMAR_RETRIES
+func grammarRetries() int {
+	if n, err := strconv.Atoi(os.Getenv("GRAMMAR_RETRIES")); err == nil && n >= 0 {
+		return n
+	}
+	return 2
+}
+
+// newLanguageToolClient returns the HTTP client for talking to the local
+// LanguageTool server, keeping an idle connection for each request
+// grammarQueue lets through at the same time
+func newLanguageToolClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 5 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = grammarMaxConcurrency()
+	return &http.Client{Timeout: grammarTimeout(), Transport: transport}
+}
+
+// maxRetryWait caps the wait before a retry, also when the server asks
+// for a longer one
+const maxRetryWait = 10 * time.Second
+
+// postForm posts params to LanguageTool and returns the response body of
+// a successful (200) response. Each attempt waits for its turn in
+// grammarQueue, in the lane of ctx. Unavailable and rate-limited responses
+// are retried with exponential backoff, up to gc.retries times.
+func (gc *GrammarChecker) postForm(ctx context.Context, params url.Values) ([]byte, error) {
+	backoff := gc.backoff
+	for attempt := 0; ; attempt++ {
+		release, err := grammarQueue.acquire(ctx, checkLaneFrom(ctx))
+		if err != nil {
+			return nil, err
+		}
+		body, err := gc.postFormOnce(ctx, params)
+		release() // Not held while backing off
+		var checkErr *CheckError
+		if err == nil || !errors.As(err, &checkErr) || !checkErr.temporary() || attempt >= gc.retries {
+			return body, err
+		}
+
+		// Full jitter, so concurrent chunks don't retry in lockstep
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if checkErr.RetryAfter > wait {
+			wait = checkErr.RetryAfter
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		backoff *= 2
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// postFormOnce makes a single request, turning failures into *CheckError
+func (gc *GrammarChecker) postFormOnce(ctx context.Context, params url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gc.serverURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := gc.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err() // Canceled by the caller, not a checker failure
+		}
+		return nil, &CheckError{Kind: ErrCheckerUnavailable, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &CheckError{Kind: ErrCheckerUnavailable, StatusCode: resp.StatusCode, Err: err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, &CheckError{Kind: ErrCheckerRateLimited, StatusCode: resp.StatusCode,
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return nil, &CheckError{Kind: ErrCheckerUnavailable, StatusCode: resp.StatusCode,
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	default:
+		return nil, &CheckError{Kind: ErrCheckerBadResponse, StatusCode: resp.StatusCode,
+			Err: errors.New(responseSnippet(body))}
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+// A missing header or a date in the past gives 0.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(time.Now()) {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// responseSnippet returns the start of an error response body for logs;
+// LanguageTool answers bad requests with a plain text message
+func responseSnippet(body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	if text == "" {
+		return "empty response"
+	}
+	return text
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// checkLane is the priority of a LanguageTool request. Interactive
+// requests (uploads, the editor, re-checking one note) have someone
+// waiting for them; background requests (bulk re-checks) don't.
+type checkLane int
+
+const (
+	laneInteractive checkLane = iota
+	laneBackground
+)
+
+type checkLaneKey struct{}
+
+// withCheckLane marks the grammar checks made with ctx as belonging to
+// lane. Checks are interactive unless marked otherwise.
+func withCheckLane(ctx context.Context, lane checkLane) context.Context {
+	return context.WithValue(ctx, checkLaneKey{}, lane)
+}
+
+func checkLaneFrom(ctx context.Context) checkLane {
+	lane, _ := ctx.Value(checkLaneKey{}).(checkLane)
+	return lane
+}
+
+// Queue metrics, published at /debug/vars
+var (
+	grammarQueueActive             = expvar.NewInt("grammar_queue_active")
+	grammarQueueInteractiveWaiting = expvar.NewInt("grammar_queue_interactive_waiting")
+	grammarQueueBackgroundWaiting  = expvar.NewInt("grammar_queue_background_waiting")
+	grammarQueueRejected           = expvar.NewInt("grammar_queue_rejected")
+)
+
+// grammarMaxConcurrency is the maximum number of requests LanguageTool
+// works on at the same time, read from GRAMMAR_MAX_CONCURRENCY
+func grammarMaxConcurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("GRAMMAR_MAX_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
+// grammarBackgroundConcurrency is how many of those requests background
+// checks may use, read from GRAMMAR_BACKGROUND_CONCURRENCY. By default
+// half, so a bulk re-check leaves room for interactive checks.
+func grammarBackgroundConcurrency(limit int) int {
+	if n, err := strconv.Atoi(os.Getenv("GRAMMAR_BACKGROUND_CONCURRENCY")); err == nil && n > 0 {
+		return min(n, limit)
+	}
+	return max(1, limit/2)
+}
+
+// grammarQueueSize is how many interactive requests may wait for a free
+// slot before more are turned away, read from GRAMMAR_QUEUE_SIZE
+func grammarQueueSize() int {
+	if n, err := strconv.Atoi(os.Getenv("GRAMMAR_QUEUE_SIZE")); err == nil && n >= 0 {
+		return n
+	}
+	return 32
+}
+
+// checkQueue limits the requests sent to LanguageTool at the same time.
+//
+// Requests wait in one FIFO per lane. A free slot always goes to the
+// oldest interactive request first; background requests only start when
+// no interactive request is waiting, and never take more than
+// backgroundLimit slots. Background requests wait as long as it takes,
+// while interactive requests are rejected with ErrCheckerBusy once
+// maxWaiting of them are queued, so that users get an answer instead of
+// a hanging page.
+type checkQueue struct {
+	mu              sync.Mutex
+	limit           int // Maximum requests in flight
+	backgroundLimit int // Maximum background requests in flight
+	maxWaiting      int // Maximum interactive requests waiting
+
+	active     [2]int             // Requests in flight, per lane
+	waiting    [2][]chan struct{} // Waiting requests per lane, oldest first; closed when granted
+	avgLatency time.Duration      // Moving average of the time a slot is held
+}
+
+// grammarQueue is the queue in front of the LanguageTool server. It is
+// made again by InitGrammarChecker, once the .env file has been read.
+var grammarQueue = newCheckQueue(grammarMaxConcurrency(), grammarQueueSize())
+
+func newCheckQueue(limit, maxWaiting int) *checkQueue {
+	return &checkQueue{
+		limit:           limit,
+		backgroundLimit: grammarBackgroundConcurrency(limit),
+		maxWaiting:      maxWaiting,
+		avgLatency:      time.Second,
+	}
+}
+
+// acquire waits for a slot in lane and returns the function that frees
+// it. It fails with a *CheckError of kind ErrCheckerBusy when the
+// interactive queue is full, or with ctx.Err() if ctx ends first.
+func (q *checkQueue) acquire(ctx context.Context, lane checkLane) (release func(), err error) {
+	q.mu.Lock()
+	if q.canStart(lane) {
+		q.active[lane]++
+		q.updateMetrics()
+		q.mu.Unlock()
+		return q.releaser(lane), nil
+	}
+	if lane == laneInteractive && len(q.waiting[lane]) >= q.maxWaiting {
+		retry := q.retryAfter()
+		q.mu.Unlock()
+		grammarQueueRejected.Add(1)
+		return nil, &CheckError{Kind: ErrCheckerBusy, RetryAfter: retry}
+	}
+	granted := make(chan struct{})
+	q.waiting[lane] = append(q.waiting[lane], granted)
+	q.updateMetrics()
+	q.mu.Unlock()
+
+	select {
+	case <-granted:
+		return q.releaser(lane), nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, w := range q.waiting[lane] {
+			if w == granted {
+				q.waiting[lane] = append(q.waiting[lane][:i], q.waiting[lane][i+1:]...)
+				q.updateMetrics()
+				return nil, ctx.Err()
+			}
+		}
+		// Granted just as ctx ended: pass the slot on
+		q.active[lane]--
+		q.grant()
+		return nil, ctx.Err()
+	}
+}
+
+// canStart reports whether a new request in lane may start right away,
+// without overtaking one that is waiting. Must be called with q.mu held.
+func (q *checkQueue) canStart(lane checkLane) bool {
+	if q.active[laneInteractive]+q.active[laneBackground] >= q.limit || len(q.waiting[laneInteractive]) > 0 {
+		return false
+	}
+	if lane == laneBackground {
+		return len(q.waiting[laneBackground]) == 0 && q.active[laneBackground] < q.backgroundLimit
+	}
+	return true
+}
+
+// releaser returns the function that frees a slot of lane, once
+func (q *checkQueue) releaser(lane checkLane) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.avgLatency = (q.avgLatency*7 + time.Since(start)) / 8
+			q.active[lane]--
+			q.grant()
+		})
+	}
+}
+
+// grant hands free slots to waiting requests, interactive ones first.
+// Must be called with q.mu held.
+func (q *checkQueue) grant() {
+	for q.active[laneInteractive]+q.active[laneBackground] < q.limit {
+		lane := laneInteractive
+		if len(q.waiting[laneInteractive]) == 0 {
+			if len(q.waiting[laneBackground]) == 0 || q.active[laneBackground] >= q.backgroundLimit {
+				break
+			}
+			lane = laneBackground
+		}
+		close(q.waiting[lane][0])
+		q.waiting[lane] = q.waiting[lane][1:]
+		q.active[lane]++
+	}
+	q.updateMetrics()
+}
+
+// retryAfter estimates when a rejected request could be accepted: the
+// time for the queued interactive requests to drain. Must be called with
+// q.mu held.
+func (q *checkQueue) retryAfter() time.Duration {
+	rounds := math.Ceil(float64(len(q.waiting[laneInteractive])+1) / float64(q.limit))
+	return max(time.Second, time.Duration(rounds)*q.avgLatency).Round(time.Second)
+}
+
+// updateMetrics publishes the queue state. Must be called with q.mu held.
+func (q *checkQueue) updateMetrics() {
+	grammarQueueActive.Set(int64(q.active[laneInteractive] + q.active[laneBackground]))
+	grammarQueueInteractiveWaiting.Set(int64(len(q.waiting[laneInteractive])))
+	grammarQueueBackgroundWaiting.Set(int64(len(q.waiting[laneBackground])))
+}
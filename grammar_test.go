@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// fakeLanguageTool is an httptest stand-in for the LanguageTool server.
+// It counts and records the forms posted to /v2/check.
+type fakeLanguageTool struct {
+	server   *httptest.Server
+	requests atomic.Int32
+	lastForm atomic.Value // url.Values of the latest request
+}
+
+// newFakeLanguageTool starts a fake LanguageTool answering /v2/check with
+// handler, and points grammarChecker at it for the rest of the test. The
+// paragraph cache is emptied so results always come from the fake.
+func newFakeLanguageTool(t *testing.T, handler http.HandlerFunc) (*fakeLanguageTool, *GrammarChecker) {
+	t.Helper()
+	fake := &fakeLanguageTool{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/check" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.requests.Add(1)
+		fake.lastForm.Store(r.PostForm)
+		handler(w, r)
+	}))
+	t.Cleanup(fake.server.Close)
+
+	gc := &GrammarChecker{serverURL: fake.server.URL + "/v2/check", client: fake.server.Client()}
+	prevChecker, prevCache := grammarChecker, grammarCache
+	grammarChecker, grammarCache = gc, newCheckLRU(100)
+	t.Cleanup(func() {
+		grammarChecker, grammarCache = prevChecker, prevCache
+		languageToolVersion.Store("")
+	})
+	return fake, gc
+}
+
+// typoResponse builds the LanguageTool response for text, flagging every
+// "teh" as a misspelling of "the". Offsets are UTF-16 code units, like
+// those of the real server.
+func typoResponse(text, language string) LTResponse {
+	resp := LTResponse{
+		Software: SoftwareInfo{Name: "LanguageTool", Version: "6.6", APIVersion: 1},
+		Language: LanguageInfo{Code: language, DetectedLang: DetectedLanguageInfo{Code: language, Confidence: 0.9}},
+		Matches:  []LTMatch{},
+	}
+	if language == LanguageAuto {
+		resp.Language = LanguageInfo{Code: "en-US", DetectedLang: DetectedLanguageInfo{Code: "en-US", Confidence: 0.75}}
+	}
+
+	runes := []rune(text)
+	for i := 0; i+3 <= len(runes); i++ {
+		if string(runes[i:i+3]) != "teh" {
+			continue
+		}
+		resp.Matches = append(resp.Matches, LTMatch{
+			Message:      "Possible spelling mistake found.",
+			ShortMessage: "Spelling mistake",
+			Replacements: []Replacement{{Value: "the"}},
+			Offset:       len(utf16.Encode(runes[:i])),
+			Length:       3,
+			Context:      Context{Text: text, Offset: len(utf16.Encode(runes[:i])), Length: 3},
+			Rule: RuleInfo{
+				ID:          "MORFOLOGIK_RULE_EN_US",
+				Description: "Possible spelling mistake",
+				IssueType:   "misspelling",
+				Category:    CategoryInfo{ID: "TYPOS", Name: "Possible Typo"},
+			},
+		})
+	}
+	return resp
+}
+
+// typoHandler answers every check with typoResponse
+func typoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(typoResponse(r.PostForm.Get("text"), r.PostForm.Get("language")))
+}
+
+func TestCheckText(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		opts       CheckOptions
+		wantParams map[string]string
+		wantOffset []int
+	}{
+		{
+			name:       "empty language asks for detection",
+			text:       "I saw teh cat.",
+			wantParams: map[string]string{"language": "auto", "disabledRules": "", "disabledCategories": ""},
+			wantOffset: []int{6},
+		},
+		{
+			name:       "explicit language",
+			text:       "teh and teh",
+			opts:       CheckOptions{Language: "en-GB"},
+			wantParams: map[string]string{"language": "en-GB"},
+			wantOffset: []int{0, 8},
+		},
+		{
+			name: "disabled rules and categories are sent along",
+			text: "No issues here.",
+			opts: CheckOptions{
+				Language:           "de-DE",
+				DisabledRules:      []string{"RULE_A", "RULE_B"},
+				DisabledCategories: []string{"STYLE"},
+			},
+			wantParams: map[string]string{"disabledRules": "RULE_A,RULE_B", "disabledCategories": "STYLE"},
+			wantOffset: nil,
+		},
+		{
+			name:       "offsets stay in UTF-16 code units",
+			text:       "😀 teh",
+			wantParams: map[string]string{"text": "😀 teh"},
+			wantOffset: []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, gc := newFakeLanguageTool(t, typoHandler)
+
+			resp, err := gc.CheckText(context.Background(), tt.text, tt.opts)
+			if err != nil {
+				t.Fatalf("CheckText: %v", err)
+			}
+
+			form := fake.lastForm.Load().(url.Values)
+			for key, want := range tt.wantParams {
+				if got := strings.Join(form[key], ","); got != want {
+					t.Errorf("param %s = %q, want %q", key, got, want)
+				}
+			}
+
+			var offsets []int
+			for _, m := range resp.Matches {
+				offsets = append(offsets, m.Offset)
+			}
+			if !reflect.DeepEqual(offsets, tt.wantOffset) {
+				t.Errorf("match offsets = %v, want %v", offsets, tt.wantOffset)
+			}
+			if resp.Software.Version != "6.6" {
+				t.Errorf("software version = %q, want 6.6", resp.Software.Version)
+			}
+		})
+	}
+}
+
+func TestCheckTextErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		timeout      time.Duration
+		wantKind     error
+		wantStatus   int
+		wantRequests int32 // 3 when retried: the first attempt and 2 retries
+	}{
+		{
+			name: "server error with HTML page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("<html><body>Internal Server Error</body></html>"))
+			},
+			wantKind:     ErrCheckerBadResponse,
+			wantStatus:   http.StatusInternalServerError,
+			wantRequests: 1,
+		},
+		{
+			name: "plain text error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Error: Missing 'language' parameter", http.StatusBadRequest)
+			},
+			wantKind:     ErrCheckerBadResponse,
+			wantStatus:   http.StatusBadRequest,
+			wantRequests: 1,
+		},
+		{
+			name: "JSON error body with a non-200 status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(typoResponse("teh", "en-US"))
+			},
+			wantKind:     ErrCheckerBadResponse,
+			wantStatus:   http.StatusInternalServerError,
+			wantRequests: 1,
+		},
+		{
+			name: "malformed JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"software": {"name": "LanguageTool"}, "matches": [`))
+			},
+			wantKind:     ErrCheckerBadResponse,
+			wantStatus:   http.StatusOK,
+			wantRequests: 1,
+		},
+		{
+			name: "overloaded server is retried",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			},
+			wantKind:     ErrCheckerUnavailable,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantRequests: 3,
+		},
+		{
+			name: "rate limit is retried",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			},
+			wantKind:     ErrCheckerRateLimited,
+			wantStatus:   http.StatusTooManyRequests,
+			wantRequests: 3,
+		},
+		{
+			name: "timeout is retried",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(2 * time.Second):
+				case <-r.Context().Done():
+				}
+			},
+			timeout:      50 * time.Millisecond,
+			wantKind:     ErrCheckerUnavailable,
+			wantRequests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, gc := newFakeLanguageTool(t, tt.handler)
+			gc.retries, gc.backoff = 2, time.Millisecond
+			if tt.timeout > 0 {
+				gc.client.Timeout = tt.timeout
+			}
+
+			_, err := gc.CheckText(context.Background(), "I saw teh cat.", CheckOptions{Language: "en-US"})
+			if !errors.Is(err, tt.wantKind) {
+				t.Fatalf("CheckText error = %v, want %v", err, tt.wantKind)
+			}
+			var checkErr *CheckError
+			if !errors.As(err, &checkErr) || checkErr.StatusCode != tt.wantStatus {
+				t.Errorf("CheckText error = %#v, want status %d", err, tt.wantStatus)
+			}
+			if got := fake.requests.Load(); got != tt.wantRequests {
+				t.Errorf("%d requests, want %d", got, tt.wantRequests)
+			}
+
+			if _, err := CheckGrammar(context.Background(), "I saw teh cat.", CheckOptions{Language: "en-US"}); !errors.Is(err, tt.wantKind) {
+				t.Errorf("CheckGrammar error = %v, want %v", err, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestCheckTextUnavailable(t *testing.T) {
+	fake, gc := newFakeLanguageTool(t, typoHandler)
+	gc.retries, gc.backoff = 1, time.Millisecond
+	gc.client.Timeout = time.Second
+	fake.server.Close() // Nothing listens on the URL any more
+
+	_, err := gc.CheckText(context.Background(), "I saw teh cat.", CheckOptions{})
+	if !errors.Is(err, ErrCheckerUnavailable) {
+		t.Fatalf("CheckText error = %v, want %v", err, ErrCheckerUnavailable)
+	}
+}
+
+func TestCheckTextRetrySucceeds(t *testing.T) {
+	var calls atomic.Int32
+	fake, gc := newFakeLanguageTool(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		typoHandler(w, r)
+	})
+	gc.retries, gc.backoff = 2, time.Millisecond
+
+	resp, err := gc.CheckText(context.Background(), "I saw teh cat.", CheckOptions{Language: "en-US"})
+	if err != nil {
+		t.Fatalf("CheckText: %v", err)
+	}
+	if len(resp.Matches) != 1 || fake.requests.Load() != 2 {
+		t.Errorf("%d matches after %d requests, want 1 after 2", len(resp.Matches), fake.requests.Load())
+	}
+}
+
+func TestCheckTextCanceled(t *testing.T) {
+	fake, gc := newFakeLanguageTool(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	gc.retries, gc.backoff = 2, time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := CheckGrammar(ctx, "I saw teh cat.", CheckOptions{Language: "en-US"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CheckGrammar error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := fake.requests.Load(); got != 1 {
+		t.Errorf("%d requests, want 1: a canceled check is not retried", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"3", 3 * time.Second},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.header); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCheckGrammar(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		opts         CheckOptions
+		wantWords    []string
+		wantOffsets  []int
+		wantLanguage string
+		wantDetected string
+	}{
+		{
+			name:         "single paragraph",
+			text:         "I saw teh cat.",
+			opts:         CheckOptions{Language: "en-US"},
+			wantWords:    []string{"teh"},
+			wantOffsets:  []int{6},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "UTF-16 offsets become byte offsets",
+			text:         "😀 é teh",
+			opts:         CheckOptions{Language: "en-US"},
+			wantWords:    []string{"teh"},
+			wantOffsets:  []int{8},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "offsets are relative to the whole text",
+			text:         "# Title\n\nFirst paragraph.\n\nThen teh second 😀 and teh third.",
+			opts:         CheckOptions{Language: "en-US"},
+			wantWords:    []string{"teh", "teh"},
+			wantOffsets:  []int{32, 52},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "auto detection",
+			text:         "Short.\n\nA longer paragraph with teh typo.",
+			opts:         CheckOptions{Language: LanguageAuto},
+			wantWords:    []string{"teh"},
+			wantOffsets:  []int{32},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "dictionary words are not misspellings",
+			text:         "I saw teh cat.",
+			opts:         CheckOptions{Language: "en-US", Dictionary: []string{"TEH"}},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "disabled rules are dropped even if the server reports them",
+			text:         "I saw teh cat.",
+			opts:         CheckOptions{Language: "en-US", DisabledRules: []string{"MORFOLOGIK_RULE_EN_US"}},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "disabled categories are dropped",
+			text:         "I saw teh cat.",
+			opts:         CheckOptions{Language: "en-US", DisabledCategories: []string{"typos"}},
+			wantLanguage: "en-US",
+			wantDetected: "en-US",
+		},
+		{
+			name:         "empty text",
+			text:         "\n\n",
+			opts:         CheckOptions{Language: "en-US"},
+			wantLanguage: "en-US",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFakeLanguageTool(t, typoHandler)
+
+			result, err := CheckGrammar(context.Background(), tt.text, tt.opts)
+			if err != nil {
+				t.Fatalf("CheckGrammar: %v", err)
+			}
+
+			var words []string
+			var offsets []int
+			for _, issue := range result.Issues {
+				words = append(words, tt.text[issue.Offset:issue.Offset+issue.Length])
+				offsets = append(offsets, issue.Offset)
+				if issue.Word != "teh" || issue.Category != CategorySpelling || issue.Severity != SeverityError ||
+					issue.Source != SourceLanguageTool || !reflect.DeepEqual(issue.Suggestions, []string{"the"}) {
+					t.Errorf("unexpected issue %+v", issue)
+				}
+			}
+			if !reflect.DeepEqual(words, tt.wantWords) {
+				t.Errorf("issue words = %q, want %q", words, tt.wantWords)
+			}
+			if !reflect.DeepEqual(offsets, tt.wantOffsets) {
+				t.Errorf("issue offsets = %v, want %v", offsets, tt.wantOffsets)
+			}
+			if result.Language != tt.wantLanguage || result.DetectedLanguage != tt.wantDetected {
+				t.Errorf("language = %q (detected %q), want %q (detected %q)",
+					result.Language, result.DetectedLanguage, tt.wantLanguage, tt.wantDetected)
+			}
+		})
+	}
+}
+
+func TestCheckGrammarDetectsOnce(t *testing.T) {
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+
+	text := "Short teh.\n\nA longer paragraph with teh typo."
+	result, err := CheckGrammar(context.Background(), text, CheckOptions{Language: LanguageAuto})
+	if err != nil {
+		t.Fatalf("CheckGrammar: %v", err)
+	}
+	if got := fake.requests.Load(); got != 2 {
+		t.Errorf("%d requests, want 2: the detection and the other paragraph", got)
+	}
+	if form := fake.lastForm.Load().(url.Values); form.Get("language") != "en-US" || strings.Contains(form.Get("text"), "longer") {
+		t.Errorf("last request: %v, want the short paragraph in en-US", form)
+	}
+	var offsets []int
+	for _, issue := range result.Issues {
+		offsets = append(offsets, issue.Offset)
+	}
+	if want := []int{6, 36}; !reflect.DeepEqual(offsets, want) || result.Language != "en-US" {
+		t.Errorf("issue offsets = %v in %q, want %v in en-US", offsets, result.Language, want)
+	}
+
+	// Checking in the detected language reuses the detection's result
+	before := fake.requests.Load()
+	if _, err := CheckGrammar(context.Background(), text, CheckOptions{Language: "en-US"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.requests.Load() - before; got != 0 {
+		t.Errorf("%d requests checking again in en-US, want 0", got)
+	}
+}
+
+func TestCheckGrammarChunks(t *testing.T) {
+	t.Setenv("GRAMMAR_CHUNK_SIZE", "40")
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+
+	paragraphs := []string{
+		"One teh.",
+		"Two is a much longer paragraph that needs more than one chunk, teh end. And another sentence with teh.",
+		"Three teh.",
+	}
+	text := strings.Join(paragraphs, "\n\n")
+
+	result, err := CheckGrammar(context.Background(), text, CheckOptions{Language: "en-US"})
+	if err != nil {
+		t.Fatalf("CheckGrammar: %v", err)
+	}
+	if got := fake.requests.Load(); got < 3 {
+		t.Errorf("%d requests, want the text split over at least 3", got)
+	}
+
+	var want []int
+	for i := 0; ; {
+		j := strings.Index(text[i:], "teh")
+		if j < 0 {
+			break
+		}
+		want = append(want, i+j)
+		i += j + 3
+	}
+	var got []int
+	for _, issue := range result.Issues {
+		got = append(got, issue.Offset)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("issue offsets = %v, want %v", got, want)
+	}
+}
+
+func TestCheckGrammarCache(t *testing.T) {
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+	opts := CheckOptions{Language: "en-US"}
+
+	if _, err := CheckGrammar(context.Background(), "First teh.\n\nSecond.", opts); err != nil {
+		t.Fatalf("CheckGrammar: %v", err)
+	}
+	before := fake.requests.Load()
+
+	// Only the edited paragraph goes to the server again
+	result, err := CheckGrammar(context.Background(), "First teh.\n\nSecond, edited.", opts)
+	if err != nil {
+		t.Fatalf("CheckGrammar: %v", err)
+	}
+	if got := fake.requests.Load() - before; got != 1 {
+		t.Errorf("%d requests after editing one paragraph, want 1", got)
+	}
+	if len(result.Issues) != 1 || result.Issues[0].Offset != 6 {
+		t.Errorf("issues = %+v, want the cached issue at offset 6", result.Issues)
+	}
+	if result.CheckerVersion != "LanguageTool 6.6" {
+		t.Errorf("checker version = %q, want LanguageTool 6.6", result.CheckerVersion)
+	}
+}
+
+// The dictionary is left out of the cache key: the cached results are
+// filtered against the current dictionary on every hit, so adding or
+// removing a word takes effect without checking the text again
+func TestCheckGrammarCacheDictionary(t *testing.T) {
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+	text := "I saw teh cat."
+
+	for i, tt := range []struct {
+		dictionary []string
+		wantIssues int
+	}{
+		{nil, 1},
+		{[]string{"teh"}, 0},
+		{[]string{"teh", "notex"}, 0},
+		{[]string{"notex"}, 1},
+	} {
+		result, err := CheckGrammar(context.Background(), text, CheckOptions{Language: "en-US", Dictionary: tt.dictionary})
+		if err != nil {
+			t.Fatalf("CheckGrammar: %v", err)
+		}
+		if len(result.Issues) != tt.wantIssues {
+			t.Errorf("with dictionary %q: %d issues, want %d", tt.dictionary, len(result.Issues), tt.wantIssues)
+		}
+		if got := fake.requests.Load(); got != 1 {
+			t.Errorf("check %d: %d requests, want the first check's only", i+1, got)
+		}
+	}
+
+	// The cache keeps what LanguageTool found, whatever the dictionary
+	cached, ok := lookupCachedCheck(CheckOptions{Language: "en-US", Dictionary: []string{"teh"}}.cacheKey(text))
+	if !ok || len(cached.Issues) != 1 || cached.Issues[0].Word != "teh" {
+		t.Errorf("cached result = %+v, %v; want the unfiltered issue", cached, ok)
+	}
+}
+
+func TestUTF16ToByteOffsets(t *testing.T) {
+	tests := []struct {
+		text string
+		want map[int]int // UTF-16 offset -> byte offset
+	}{
+		{"", map[int]int{0: 0, 1: 0, -1: 0}},
+		{"abc", map[int]int{0: 0, 2: 2, 3: 3, 10: 3}},
+		{"é!", map[int]int{0: 0, 1: 2, 2: 3}},        // 2-byte rune, 1 unit
+		{"中文", map[int]int{1: 3, 2: 6}},              // 3-byte runes, 1 unit each
+		{"a😀b", map[int]int{1: 1, 2: 1, 3: 5, 4: 6}}, // Surrogate pair: 2 units
+		{"😀😀", map[int]int{0: 0, 2: 4, 3: 4, 4: 8}},  // Second unit maps to the rune start
+		{"\ufeffx", map[int]int{0: 0, 1: 3, 2: 4}},   // BOM is one unit
+		{"e\u0301x", map[int]int{1: 1, 2: 3, 3: 4}},  // Combining mark counts separately
+	}
+
+	for _, tt := range tests {
+		toByte := utf16ToByteOffsets(tt.text)
+		for unit, want := range tt.want {
+			if got := toByte(unit); got != want {
+				t.Errorf("utf16ToByteOffsets(%q)(%d) = %d, want %d", tt.text, unit, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newCheckQueue(2, 1)
+	if q.backgroundLimit != 1 {
+		t.Fatalf("backgroundLimit = %d, want 1", q.backgroundLimit)
+	}
+
+	// Background checks get at most backgroundLimit slots
+	releaseBackground, err := q.acquire(ctx, laneBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backgroundStarted := make(chan func())
+	go func() {
+		release, _ := q.acquire(ctx, laneBackground)
+		backgroundStarted <- release
+	}()
+	releaseInteractive, err := q.acquire(ctx, laneInteractive)
+	if err != nil {
+		t.Fatalf("interactive check waited for background ones: %v", err)
+	}
+
+	// With all slots taken, one interactive check may wait; the next is
+	// turned away
+	interactiveStarted := make(chan func())
+	go func() {
+		release, _ := q.acquire(ctx, laneInteractive)
+		interactiveStarted <- release
+	}()
+	waitFor(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.waiting[laneInteractive]) == 1 && len(q.waiting[laneBackground]) == 1
+	})
+	_, err = q.acquire(ctx, laneInteractive)
+	var checkErr *CheckError
+	if !errors.Is(err, ErrCheckerBusy) || !errors.As(err, &checkErr) || checkErr.RetryAfter < time.Second {
+		t.Fatalf("acquire on a full queue: %v, want ErrCheckerBusy with a Retry-After", err)
+	}
+
+	// The waiting interactive check goes first, although the background
+	// one has waited longer
+	releaseInteractive()
+	select {
+	case release := <-interactiveStarted:
+		release()
+	case <-backgroundStarted:
+		t.Fatal("background check started before the waiting interactive one")
+	case <-time.After(time.Second):
+		t.Fatal("waiting interactive check did not start")
+	}
+	releaseBackground()
+	select {
+	case release := <-backgroundStarted:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("waiting background check did not start")
+	}
+
+	// A canceled wait leaves the queue
+	releaseA, _ := q.acquire(ctx, laneInteractive)
+	releaseB, _ := q.acquire(ctx, laneInteractive)
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.acquire(canceled, laneInteractive); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire with an expiring context: %v", err)
+	}
+	releaseA()
+	releaseB()
+	if q.active != [2]int{} || len(q.waiting[laneInteractive]) != 0 {
+		t.Errorf("queue not empty after all releases: active %v, waiting %d", q.active, len(q.waiting[laneInteractive]))
+	}
+}
@@ -1,21 +1,32 @@
 package main
 
 import (
+	"errors"
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	md "github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var templates *template.Template
+// templates holds the partials (_*.html), rendered on their own by
+// renderTemplate. pages holds each full page: base.html with the page's
+// "title" and "content" blocks, plus the partials.
+var (
+	templates *template.Template
+	pages     map[string]*template.Template
+)
 
 // LoadTemplates parses all HTML templates
 func LoadTemplates() {
@@ -24,10 +35,29 @@ func LoadTemplates() {
 		"safeHTML": func(s string) template.HTML {
 			return template.HTML(s) // Marks the string as safe HTML content
 		},
+		"percent": func(f float64) float64 {
+			return f * 100 // Turns a 0-1 ratio into a percentage
+		},
 	}
 
 	// Use Funcs to add custom template functions
-	templates = template.Must(template.New("").Funcs(funcmap).ParseGlob("templates/*.html"))
+	templates = template.Must(template.New("").Funcs(funcmap).ParseGlob("templates/_*.html"))
+	base := template.Must(template.Must(templates.Clone()).ParseFiles("templates/base.html"))
+
+	// Every other file is a page; each defines the blocks of base.html
+	// anew, so each gets its own copy
+	files, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		log.Fatalf("Error listing templates: %v", err)
+	}
+	pages = map[string]*template.Template{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.HasPrefix(name, "_") || name == "base.html" {
+			continue
+		}
+		pages[name] = template.Must(template.Must(base.Clone()).ParseFiles(file))
+	}
 	log.Println("HTML Templates loaded successfully.")
 }
 
@@ -40,21 +70,114 @@ func renderTemplate(w http.ResponseWriter, tmplName string, data interface{}) {
 	}
 }
 
-// handleIndex renders the main page with the list of notes
+// renderPage renders a full page, e.g. "index.html", with data
+func renderPage(w http.ResponseWriter, page string, data interface{}) {
+	tmpl, ok := pages[page]
+	if !ok {
+		log.Printf("Error executing page %s: no such page", page)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error executing page %s: %v", page, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// checkerBusy reports whether err is grammarQueue turning a check away,
+// and when to retry
+func checkerBusy(err error) (time.Duration, bool) {
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) && checkErr.Kind == ErrCheckerBusy {
+		return checkErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// renderRetryLater answers status (503 Service Unavailable or 429 Too Many
+// Requests) with a Retry-After header and a message fragment, swapped
+// into target if given
+func renderRetryLater(w http.ResponseWriter, status int, target, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	if target != "" {
+		w.Header().Set("HX-Retarget", target)
+		w.Header().Set("HX-Reswap", "innerHTML")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderTemplate(w, "_retry_later.html", map[string]interface{}{
+		"Message":    message,
+		"RetryAfter": seconds,
+	})
+}
+
+// handleIndex renders the main page with the notes of the current
+// workspace
 func handleIndex(w http.ResponseWriter, r *http.Request) {
-	notes, err := GetAllNotes()
+	user := currentUser(r)
+	access := currentAccess(r)
+	notes, err := GetAllNotes(access.Workspace.ID, noteFilterFromRequest(r))
 	if err != nil {
 		log.Printf("Error fetching notes: %v", err)
 		http.Error(w, "Failed to load notes", http.StatusInternalServerError)
 		return
 	}
+	workspaces, err := GetUserWorkspaces(user.ID)
+	if err != nil {
+		log.Printf("Error fetching workspaces of %s: %v", user.Username, err)
+		workspaces = []Workspace{access.Workspace}
+	}
+	settings, err := GetGrammarSettings(access.Workspace.ID)
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
 
 	// Data to pass to the base template
 	pageData := map[string]interface{}{
-		"Title": "Go Notes App",
-		"Notes": notes,
+		"Title":           "Go Notes App",
+		"User":            user,
+		"Access":          access,
+		"Workspaces":      workspaces,
+		"NoteList":        noteListView{Notes: notes, Access: access},
+		"Languages":       grammarLanguages,
+		"DefaultLanguage": settings.DefaultLanguage(),
+		"Recheck":         CurrentRecheckProgress(access.Workspace.ID),
+		"CSRFToken":       csrfToken(w, r),
+		"CSPNonce":        cspNonce(r),
+	}
+	renderPage(w, "index.html", pageData)
+}
+
+// handleListNotes renders the note list fragment, filtered by query params
+func handleListNotes(w http.ResponseWriter, r *http.Request) {
+	notes, err := GetAllNotes(currentWorkspace(r), noteFilterFromRequest(r))
+	if err != nil {
+		log.Printf("Error fetching notes: %v", err)
+		http.Error(w, "Failed to load notes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	renderTemplate(w, "_notelist.html", noteListView{Notes: notes, Access: currentAccess(r)})
+}
+
+// noteListView is the data for the note list: the notes, and whether the
+// user may delete them
+type noteListView struct {
+	Notes  []Note
+	Access Access
+}
+
+// noteFilterFromRequest reads the note list filters sent along by the
+// filter controls (hx-include="#note-filters")
+func noteFilterFromRequest(r *http.Request) NoteFilter {
+	return NoteFilter{
+		SpellingErrors: r.FormValue("spelling") != "",
+		Sort:           r.FormValue("sort"),
 	}
-	renderTemplate(w, "base.html", pageData)
 }
 
 // handleUpload processes the uploaded markdown file
@@ -93,42 +216,66 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	markdownContent := string(fileBytes)
 
-	// --- Processing ---
-	// 1. Grammar Check
-	grammarIssues, err := CheckGrammar(markdownContent)
+	user := currentUser(r)
+	if err := checkQuota(user.ID, 1, int64(len(fileBytes))); err != nil {
+		quotaError(w, "#upload-error", err)
+		return
+	}
+	workspace := currentWorkspace(r)
+	settings, err := GetGrammarSettings(workspace)
 	if err != nil {
-		log.Printf("Grammar check failed for %s: %v", handler.Filename, err)
-		// Decide how to handle: fail upload, or proceed without issues?
-		// Let's proceed but log the error, maybe add a warning issue.
-		grammarIssues = append(grammarIssues, GrammarIssue{Message: "Grammar check process failed: " + err.Error()})
+		log.Printf("Error loading grammar settings: %v", err)
+		// Check without the dictionary and disabled rules
 	}
 
-	// 2. Render Markdown to HTML
+	// Front matter, then the form field, then the workspace default
+	language := ResolveNoteLanguage(markdownContent, r.FormValue("language"), settings.DefaultLanguage())
+	knownFiles, err := GetNoteFilenames(workspace)
+	if err != nil {
+		log.Printf("Error fetching note filenames: %v", err)
+		knownFiles = nil // Skip the broken relative link check
+	}
+
+	// --- Processing ---
+	// 1. Render Markdown to HTML
 	htmlContent := RenderMarkdownToHTML(markdownContent)
 
-	// 3. Create Note struct
+	// 2. Create Note struct
 	newNote := Note{
+		OwnerID:          user.ID,
+		WorkspaceID:      workspace,
 		OriginalFilename: filepath.Base(handler.Filename), // Basic sanitization
 		MarkdownContent:  markdownContent,
 		HTMLContent:      htmlContent,
-		GrammarIssues:    grammarIssues,
+		Language:         language,
 		// ID and CreatedAt will be set by MongoDB driver or CreateNote func
 	}
 
+	// 3. Grammar check, markdown lint and writing statistics
+	if err := CheckNote(r.Context(), &newNote, settings, knownFiles); err != nil {
+		if retry, busy := checkerBusy(err); busy {
+			renderRetryLater(w, http.StatusServiceUnavailable, "#upload-error", "The grammar checker is busy, so the note was not saved.", retry)
+			return
+		}
+		// Proceed with the failure recorded as an issue on the note
+		log.Printf("Grammar check failed for %s: %v", handler.Filename, err)
+	}
+
 	// 4. Save to Database
-	_, err = CreateNote(newNote)
+	newNote.ID, err = CreateNote(newNote)
 	if err != nil {
 		log.Printf("Error saving note to DB: %v", err)
 		http.Error(w, "Failed to save the note.", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, AuditCreate, newNote, "upload")
 
 	log.Printf("Successfully processed and saved note: %s", newNote.OriginalFilename)
 
 	// --- HTMX Response ---
 	// Instead of redirecting, return the updated list of notes fragment
 	// This will replace the content of the target div specified in hx-target
-	notes, err := GetAllNotes() // Fetch the fresh list
+	notes, err := GetAllNotes(workspace, noteFilterFromRequest(r)) // Fetch the fresh list
 	if err != nil {
 		log.Printf("Error fetching notes after upload: %v", err)
 		// Fallback or error message? For simplicity, render empty list on error
@@ -137,7 +284,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/html")
 	// Execute *only* the partial template for the note list
-	renderTemplate(w, "_notelist.html", notes)
+	renderTemplate(w, "_notelist.html", noteListView{Notes: notes, Access: currentAccess(r)})
 
 	// --- Alternative: Full Page Redirect (less HTMX-y) ---
 	// http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -146,14 +293,16 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 // handleGetNoteContent fetches a note and renders its content based on 'type' query param
 func handleGetNoteContent(w http.ResponseWriter, r *http.Request) {
 	noteID := chi.URLParam(r, "id")
-	contentType := r.URL.Query().Get("type") // e.g., "html", "markdown", "details" (default)
+	contentType := r.URL.Query().Get("type")  // e.g., "html", "markdown", "issues", "proofread", "details" (default)
+	category := r.URL.Query().Get("category") // Optional issue category filter
 
 	if noteID == "" {
 		http.Error(w, "Missing note ID", http.StatusBadRequest)
 		return
 	}
 
-	note, err := GetNoteByID(noteID)
+	access := currentAccess(r)
+	note, err := GetNoteByID(access.Workspace.ID, noteID)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			http.Error(w, "Note not found", http.StatusNotFound)
@@ -164,20 +313,171 @@ func handleGetNoteContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Hide issues for words and rules ignored since the note was checked
+	if settings, err := GetGrammarSettings(access.Workspace.ID); err == nil {
+		note.GrammarIssues = settings.FilterIssues(note.GrammarIssues)
+	} else {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+
+	view := noteDetailView{Note: note, Category: category, AllIssues: note.GrammarIssues, Access: access}
+	if category != "" {
+		view.GrammarIssues = filterIssuesByCategory(note.GrammarIssues, category)
+	}
+
+	// The frame of the note's HTML is recorded when it loads the HTML
+	if contentType != "html" || r.Header.Get("HX-Request") != "true" {
+		viewed := contentType
+		if viewed == "" {
+			viewed = "details"
+		}
+		recordAudit(r, AuditView, note, viewed)
+	}
+
 	switch contentType {
 	case "markdown":
+		if r.Header.Get("HX-Request") == "true" {
+			// htmx swaps whatever it gets in as HTML, so the page gets the
+			// markdown escaped
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			renderTemplate(w, "_note_markdown.html", view)
+			return
+		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		_, _ = w.Write([]byte(note.MarkdownContent)) // Ignore write error for simplicity here
 	case "html":
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Header.Get("HX-Request") == "true" {
+			// The page gets a sandboxed frame showing the note's HTML, as
+			// loaded below
+			renderTemplate(w, "_note_html.html", view)
+			return
+		}
+		// The note's HTML on its own, in an origin of its own: it can't run
+		// scripts, nor reach the app's cookies or pages
+		w.Header().Set("Content-Security-Policy", untrustedHTMLPolicy+"; frame-ancestors 'self'")
+		allowFraming(w)
 		_, _ = w.Write([]byte(note.HTMLContent)) // Ignore write error
+	case "issues":
+		// Only the grammar issues panel, used by the category filter
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		renderTemplate(w, "_grammar_issues.html", view)
+	case "proofread":
+		// The rendered note with its issues highlighted inline
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		renderTemplate(w, "_note_proofread.html", view)
 	case "details", "": // Default to showing details fragment
 		fallthrough // Explicit fallthrough
 	default:
 		// Render the detail partial template
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		renderTemplate(w, "_note_detail.html", note)
+		renderTemplate(w, "_note_detail.html", view)
+	}
+}
+
+// noteDetailView is the data for the note detail templates: the note plus
+// the issue category currently filtered on (empty for all)
+type noteDetailView struct {
+	Note
+	Category  string
+	AllIssues []GrammarIssue // Unfiltered issues, for the category counts
+	Access    Access         // Which controls to show
+}
+
+// CategoryCounts counts the note's issues per category, in IssueCategories order
+func (v noteDetailView) CategoryCounts() []IssueGroup {
+	all := Note{GrammarIssues: v.AllIssues}
+	return all.IssuesByCategory()
+}
+
+// ProofreadingHTML renders the note with the issues of the view
+// highlighted, see RenderProofreadingHTML
+func (v noteDetailView) ProofreadingHTML() string {
+	return RenderProofreadingHTML(v.MarkdownContent, v.GrammarIssues)
+}
+
+// CheckOutdated reports whether the note's issues came from another
+// checker version than the one new checks use
+func (v noteDetailView) CheckOutdated() bool {
+	current := CurrentCheckerVersion()
+	return current != "" && v.CheckerVersion != current
+}
+
+// filterIssuesByCategory keeps the issues in the given category
+// ("other" keeps the issues without a known category)
+func filterIssuesByCategory(issues []GrammarIssue, category string) []GrammarIssue {
+	var filtered []GrammarIssue
+	for _, issue := range issues {
+		if issue.Category == category || (category == "other" && !isIssueCategory(issue.Category)) {
+			filtered = append(filtered, issue)
+		}
+	}
+	return filtered
+}
+
+// handleRecheckNote re-checks a note with the current settings and
+// checker, then renders its details with the new results
+func handleRecheckNote(w http.ResponseWriter, r *http.Request) {
+	noteID := chi.URLParam(r, "id")
+	access := currentAccess(r)
+	note, err := GetNoteByID(access.Workspace.ID, noteID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Note not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error fetching note %s: %v", noteID, err)
+			http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	settings, err := GetGrammarSettings(access.Workspace.ID)
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+	}
+	knownFiles, err := GetNoteFilenames(access.Workspace.ID)
+	if err != nil {
+		log.Printf("Error fetching note filenames: %v", err)
+		knownFiles = nil
 	}
+
+	if err := CheckNote(r.Context(), &note, settings, knownFiles); err != nil {
+		if retry, busy := checkerBusy(err); busy {
+			// Keep the stored check rather than replace it with this failure
+			renderRetryLater(w, http.StatusServiceUnavailable, "", "The grammar checker is busy, so the note was not re-checked.", retry)
+			return
+		}
+		log.Printf("Grammar check failed for %s: %v", note.OriginalFilename, err)
+	}
+	if err := UpdateNoteCheck(note); err != nil {
+		log.Printf("Error saving re-checked note %s: %v", noteID, err)
+		http.Error(w, "Failed to save the note.", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Re-checked note: %s (%s)", note.OriginalFilename, note.CheckerVersion)
+	recordAudit(r, AuditCheck, note, "re-check")
+
+	note.GrammarIssues = settings.FilterIssues(note.GrammarIssues)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_note_detail.html", noteDetailView{Note: note, AllIssues: note.GrammarIssues, Access: access})
+}
+
+// handleRecheckAll starts re-checking all notes of the current workspace
+// in the background and renders the progress, which polls itself while
+// the re-check runs
+func handleRecheckAll(w http.ResponseWriter, r *http.Request) {
+	ws := currentAccess(r).Workspace
+	if StartRecheckAll(ws.ID, auditorFor(r, AuditCheck, "re-check of all notes")) {
+		log.Printf("%s started re-checking all notes of workspace %q", currentUser(r).Username, ws.Name)
+	}
+	handleRecheckStatus(w, r)
+}
+
+// handleRecheckStatus renders the progress of the workspace's bulk
+// re-check
+func handleRecheckStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_recheck_status.html", CurrentRecheckProgress(currentWorkspace(r)))
 }
 
 // handleDeleteNote deletes a note and returns the updated list
@@ -188,7 +488,11 @@ func handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := DeleteNoteByID(noteID)
+	workspace := currentWorkspace(r)
+	note, err := GetNoteByID(workspace, noteID) // For the audit log
+	if err == nil {
+		err = DeleteNoteByID(workspace, noteID)
+	}
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// Note already deleted? Still return the current list.
@@ -200,11 +504,12 @@ func handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		log.Printf("Deleted note %s successfully", noteID)
+		recordAudit(r, AuditDelete, note, "")
 	}
 
 	// --- HTMX Response ---
 	// Return the updated note list fragment to replace the existing list
-	notes, err := GetAllNotes()
+	notes, err := GetAllNotes(workspace, noteFilterFromRequest(r))
 	if err != nil {
 		log.Printf("Error fetching notes after delete: %v", err)
 		// Return empty response on error? Or maybe just 200 OK?
@@ -213,7 +518,7 @@ func handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	renderTemplate(w, "_notelist.html", notes)
+	renderTemplate(w, "_notelist.html", noteListView{Notes: notes, Access: currentAccess(r)})
 
 	// --- Alternative: Simple 200 OK (Less ideal for list updates) ---
 	// w.WriteHeader(http.StatusOK)
@@ -222,10 +527,7 @@ func handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 
 // RenderMarkdownToHTML converts markdown string to HTML string
 func RenderMarkdownToHTML(mdContent string) string {
-	// Configure markdown parser extensions
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
-	p := parser.NewWithExtensions(extensions)
-	doc := p.Parse([]byte(mdContent))
+	doc := ParseMarkdown(mdContent)
 
 	// Configure HTML renderer options
 	htmlFlags := html.CommonFlags | html.HrefTargetBlank // Open external links in new tab
@@ -234,3 +536,12 @@ func RenderMarkdownToHTML(mdContent string) string {
 
 	return string(md.Render(doc, renderer))
 }
+
+// ParseMarkdown parses a markdown string into an AST, with the same
+// extensions used for rendering
+func ParseMarkdown(mdContent string) ast.Node {
+	// Configure markdown parser extensions
+	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
+	p := parser.NewWithExtensions(extensions)
+	return p.Parse([]byte(mdContent))
+}
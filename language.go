@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// LanguageAuto asks LanguageTool to detect the language of the text
+const LanguageAuto = "auto"
+
+// GrammarLanguage is a language offered in the upload form
+type GrammarLanguage struct {
+	Code string
+	Name string
+}
+
+// grammarLanguages lists the languages offered in the upload form.
+// LanguageTool supports more; any valid code in front matter is accepted.
+var grammarLanguages = []GrammarLanguage{
+	{Code: LanguageAuto, Name: "Auto-detect"},
+	{Code: "en-US", Name: "English (US)"},
+	{Code: "en-GB", Name: "English (GB)"},
+	{Code: "de-DE", Name: "German"},
+	{Code: "fr", Name: "French"},
+}
+
+// DefaultGrammarLanguage returns the server-wide grammar language,
+// configured through GRAMMAR_LANGUAGE, for workspaces that have not chosen
+// one. It falls back to auto-detection.
+func DefaultGrammarLanguage() string {
+	if lang := normalizeLanguage(os.Getenv("GRAMMAR_LANGUAGE")); lang != "" {
+		return lang
+	}
+	return LanguageAuto
+}
+
+// DefaultLanguage returns the grammar language of the workspace's notes
+// that set none themselves
+func (s GrammarSettings) DefaultLanguage() string {
+	if lang := normalizeLanguage(s.Language); lang != "" {
+		return lang
+	}
+	return DefaultGrammarLanguage()
+}
+
+// ResolveNoteLanguage picks the grammar language for a note.
+// Front matter wins over the upload form field, which wins over the
+// workspace default.
+func ResolveNoteLanguage(markdown string, formValue string, workspaceDefault string) string {
+	if lang := normalizeLanguage(frontMatterValue(markdown, "lang", "language")); lang != "" {
+		return lang
+	}
+	if lang := normalizeLanguage(formValue); lang != "" {
+		return lang
+	}
+	return workspaceDefault
+}
+
+// offeredLanguage reports whether lang is one of grammarLanguages
+func offeredLanguage(lang string) bool {
+	for _, l := range grammarLanguages {
+		if l.Code == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLanguage trims a language code and maps its spelling to the
+// form LanguageTool expects (e.g. "de_de" -> "de-DE")
+func normalizeLanguage(lang string) string {
+	lang = strings.TrimSpace(strings.ReplaceAll(lang, "_", "-"))
+	if lang == "" {
+		return ""
+	}
+	if strings.EqualFold(lang, LanguageAuto) {
+		return LanguageAuto
+	}
+	parts := strings.SplitN(lang, "-", 2)
+	parts[0] = strings.ToLower(parts[0])
+	if len(parts) == 2 && len(parts[1]) == 2 { // Region subtag
+		parts[1] = strings.ToUpper(parts[1])
+	}
+	return strings.Join(parts, "-")
+}
+
+// frontMatterValue returns the first of keys found in a YAML front matter
+// block ("---" delimited) at the top of the markdown. Only simple
+// "key: value" lines are understood.
+func frontMatterValue(markdown string, keys ...string) string {
+	markdown = strings.TrimPrefix(markdown, "\ufeff") // Skip a BOM
+	if !strings.HasPrefix(markdown, "---\n") && !strings.HasPrefix(markdown, "---\r\n") {
+		return ""
+	}
+
+	lines := strings.Split(markdown, "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "---" || line == "..." {
+			break // End of front matter
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		for _, want := range keys {
+			if strings.EqualFold(key, want) {
+				return strings.Trim(strings.TrimSpace(value), `"'`)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// --- Rate Limits ---
+//
+// Each client gets a token bucket per class of request: reads (GET,
+// HEAD), writes (everything else) and grammar checks (requests that run
+// LanguageTool, on top of their write). Signed-in clients are keyed by
+// user, others by IP (see realIP). A client whose bucket is empty is
+// answered with 429 and Retry-After.
+
+// rateLimit is the configuration of one class: Burst requests at once,
+// refilled at Burst per Per. A zero Burst means no limit.
+type rateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// parseRateLimit parses "<requests>/<duration>", e.g. "60/1m", or "off"
+func parseRateLimit(s string) (rateLimit, bool) {
+	if s == "off" {
+		return rateLimit{}, true
+	}
+	n, per, ok := strings.Cut(s, "/")
+	burst, err := strconv.Atoi(n)
+	if !ok || err != nil || burst <= 0 {
+		return rateLimit{}, false
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return rateLimit{}, false
+	}
+	return rateLimit{Burst: burst, Per: d}, true
+}
+
+// rateLimitFromEnv reads the limit of a class from the environment
+// variable name, e.g. RATE_LIMIT_WRITE=60/1m
+func rateLimitFromEnv(name string, fallback rateLimit) rateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, ok := parseRateLimit(value)
+	if !ok {
+		log.Printf("Invalid %s %q, using %d/%s", name, value, fallback.Burst, fallback.Per)
+		return fallback
+	}
+	return limit
+}
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets of all clients for one class
+type rateLimiter struct {
+	limit     rateLimit
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from the bucket of key. If there is none, it
+// returns false and how long until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l.limit.Burst == 0 {
+		return true, 0
+	}
+	rate := float64(l.limit.Burst) / l.limit.Per.Seconds() // Tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the buckets that have been refilled since their last
+// use, as they are the same as new ones; at most once per refill period
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.limit.Per {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimiters holds the limiter of each request class. InitRateLimits
+// makes them again once the .env file has been read.
+var rateLimiters = newRateLimiters()
+
+// newRateLimiters configures the classes with RATE_LIMIT_READ,
+// RATE_LIMIT_WRITE and RATE_LIMIT_GRAMMAR. The editor checks while the
+// user types, so the default grammar limit leaves room for that.
+func newRateLimiters() map[string]*rateLimiter {
+	return map[string]*rateLimiter{
+		"read":    newRateLimiter(rateLimitFromEnv("RATE_LIMIT_READ", rateLimit{Burst: 600, Per: time.Minute})),
+		"write":   newRateLimiter(rateLimitFromEnv("RATE_LIMIT_WRITE", rateLimit{Burst: 120, Per: time.Minute})),
+		"grammar": newRateLimiter(rateLimitFromEnv("RATE_LIMIT_GRAMMAR", rateLimit{Burst: 60, Per: time.Minute})),
+	}
+}
+
+// InitRateLimits applies the limits and trusted proxies of the
+// environment; call it before serving
+func InitRateLimits() {
+	rateLimiters = newRateLimiters()
+	trustedProxies = trustedProxiesFromEnv()
+}
+
+// rateLimited counts the requests turned away per class, published at
+// /debug/vars
+var rateLimited = expvar.NewMap("rate_limited")
+
+// rateLimitKey returns the client a request is counted against: the
+// signed-in user, or else the IP address
+func rateLimitKey(r *http.Request) string {
+	if user := currentUser(r); !user.ID.IsZero() {
+		return "user:" + user.ID.Hex()
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the IP address of the client, as set by realIP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // realIP sets it without a port
+	}
+	return host
+}
+
+// --- Client Addresses ---
+//
+// Behind a reverse proxy, requests come from the proxy, which passes the
+// client's address on in X-Forwarded-For or X-Real-IP. Any client can
+// send those headers too, so they are only believed on requests from the
+// proxies listed in TRUSTED_PROXIES; otherwise a client could pick a new
+// address, and so a fresh rate limit bucket, for every request.
+
+// trustedProxies are the addresses of TRUSTED_PROXIES. InitRateLimits
+// reads them again once the .env file has been read.
+var trustedProxies = trustedProxiesFromEnv()
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and
+// CIDR ranges, e.g. "10.0.0.0/8, 192.0.2.7"
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// trustedProxiesFromEnv reads TRUSTED_PROXIES; without it, no proxy is
+// trusted
+func trustedProxiesFromEnv() []netip.Prefix {
+	value := os.Getenv("TRUSTED_PROXIES")
+	proxies, err := parseTrustedProxies(value)
+	if err != nil {
+		log.Printf("Invalid TRUSTED_PROXIES %q, trusting no proxy: %v", value, err)
+		return nil
+	}
+	return proxies
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP sets r.RemoteAddr to the address of the client that trusted
+// proxies forwarded the request for. Other requests keep the address of
+// their TCP peer, whatever headers they send.
+func realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedClientIP(r); ip != "" {
+			r.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client address in the X-Forwarded-For or
+// X-Real-IP header of r, or "" unless r comes from a trusted proxy
+func forwardedClientIP(r *http.Request) string {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(peer.Addr()) {
+		return ""
+	}
+
+	// Each proxy appends the address it got the request from, so the
+	// client is the last one that isn't a trusted proxy; the ones before
+	// it are whatever the client sent
+	var client string
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	if client != "" {
+		return client
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return ""
+}
+
+// limitClass returns middleware counting requests against the limiter
+// of class
+func limitClass(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retry := rateLimiters[class].allow(rateLimitKey(r), time.Now()); !ok {
+				rateLimited.Add(class, 1)
+				renderRetryLater(w, http.StatusTooManyRequests, "#request-error", "You are sending too many requests.", retry)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitRequests limits reads and writes; after requireUser, it counts
+// them against the user
+func limitRequests(next http.Handler) http.Handler {
+	reads, writes := limitClass("read")(next), limitClass("write")(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			reads.ServeHTTP(w, r)
+		default:
+			writes.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limitGrammar limits the requests that run grammar checks
+var limitGrammar = limitClass("grammar")
+
+// --- Storage Quotas ---
+//
+// Each user may store at most QUOTA_NOTES notes with at most QUOTA_BYTES
+// of markdown in total, counting the notes they created in any
+// workspace. 0 means no limit.
+
+// storageQuota is the most a user may store
+type storageQuota struct {
+	Notes int64
+	Bytes int64
+}
+
+// userStorageQuota reads the quota from QUOTA_NOTES and QUOTA_BYTES
+func userStorageQuota() storageQuota {
+	quota := storageQuota{Notes: 1000, Bytes: 100 << 20}
+	if n, err := strconv.ParseInt(os.Getenv("QUOTA_NOTES"), 10, 64); err == nil && n >= 0 {
+		quota.Notes = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("QUOTA_BYTES"), 10, 64); err == nil && n >= 0 {
+		quota.Bytes = n
+	}
+	return quota
+}
+
+// QuotaError is returned by checkQuota for a change that doesn't fit
+type QuotaError struct {
+	Usage StorageUsage
+	Quota storageQuota
+}
+
+func (e *QuotaError) Error() string {
+	if e.Quota.Notes > 0 && e.Usage.Notes >= e.Quota.Notes {
+		return fmt.Sprintf("You have reached your limit of %d notes. Delete some notes to make room.", e.Quota.Notes)
+	}
+	return fmt.Sprintf("This would take you over your storage limit of %s (you use %s). Delete some notes to make room.",
+		formatBytes(e.Quota.Bytes), formatBytes(e.Usage.Bytes))
+}
+
+// checkQuota checks that owner may store addNotes more notes and
+// addBytes more markdown (negative when a note shrinks), returning a
+// *QuotaError if not
+func checkQuota(owner primitive.ObjectID, addNotes, addBytes int64) error {
+	quota := userStorageQuota()
+	if quota.Notes == 0 && quota.Bytes == 0 {
+		return nil
+	}
+	usage, err := GetStorageUsage(owner)
+	if err != nil {
+		return err
+	}
+	if (quota.Notes > 0 && addNotes > 0 && usage.Notes+addNotes > quota.Notes) ||
+		(quota.Bytes > 0 && addBytes > 0 && usage.Bytes+addBytes > quota.Bytes) {
+		return &QuotaError{Usage: usage, Quota: quota}
+	}
+	return nil
+}
+
+// quotaError answers a change checkQuota turned down, with the message
+// swapped into target
+func quotaError(w http.ResponseWriter, target string, err error) {
+	quotaErr, ok := err.(*QuotaError)
+	if !ok {
+		log.Printf("Error checking storage quota: %v", err)
+		http.Error(w, "Failed to check your storage quota", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("HX-Retarget", target)
+	w.Header().Set("HX-Reswap", "innerHTML")
+	w.WriteHeader(http.StatusForbidden)
+	renderTemplate(w, "_request_error.html", quotaErr.Error())
+}
+
+// formatBytes returns n as a size for people, e.g. "1.5 MB"
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
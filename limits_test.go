@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want rateLimit
+		ok   bool
+	}{
+		{"60/1m", rateLimit{Burst: 60, Per: time.Minute}, true},
+		{"5/10s", rateLimit{Burst: 5, Per: 10 * time.Second}, true},
+		{"off", rateLimit{}, true},
+		{"60", rateLimit{}, false},
+		{"0/1m", rateLimit{}, false},
+		{"60/soon", rateLimit{}, false},
+	} {
+		got, ok := parseRateLimit(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRateLimit(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(rateLimit{Burst: 2, Per: 10 * time.Second})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("alice", now); !ok {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	ok, retry := limiter.allow("alice", now)
+	if ok || retry != 5*time.Second {
+		t.Errorf("request over the burst: %v, retry after %s, want false, 5s", ok, retry)
+	}
+	if ok, _ := limiter.allow("bob", now); !ok {
+		t.Error("another client was limited")
+	}
+	if ok, _ := limiter.allow("alice", now.Add(5*time.Second)); !ok {
+		t.Error("request after the refill was limited")
+	}
+	if ok, _ := newRateLimiter(rateLimit{}).allow("alice", now); !ok {
+		t.Error("request limited with the limit off")
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	LoadTemplates()
+	defer InitRateLimits()
+	rateLimiters = map[string]*rateLimiter{
+		"read":  newRateLimiter(rateLimit{Burst: 1, Per: time.Minute}),
+		"write": newRateLimiter(rateLimit{Burst: 1, Per: time.Minute}),
+	}
+	handler := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/notes", nil)
+		req.RemoteAddr = ip
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "192.0.2.1:1234"); rec.Code != http.StatusOK {
+		t.Fatalf("first read: status %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "192.0.2.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("first write: status %d, want its own bucket", rec.Code)
+	}
+	rec := do(http.MethodGet, "192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("second read: status %d, Retry-After %q, want 429, 60", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := do(http.MethodGet, "192.0.2.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("read from another IP: status %d", rec.Code)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies(" 10.0.0.0/8, 192.0.2.7,::1 ,")
+	if err != nil || fmt.Sprint(proxies) != "[10.0.0.0/8 192.0.2.7/32 ::1/128]" {
+		t.Errorf("parseTrustedProxies = %v, %v", proxies, err)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.example"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("parseTrustedProxies(%q): no error", bad)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	defer InitRateLimits()
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	for _, tt := range []struct {
+		name, peer   string
+		forwardedFor []string
+		realIP, want string
+	}{
+		{"no proxy", "203.0.113.9:1234", nil, "", "203.0.113.9:1234"},
+		{"spoofed by a client", "203.0.113.9:1234", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.9:1234"},
+		{"forwarded", "10.1.2.3:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed through a proxy", "10.1.2.3:1234", []string{"1.2.3.4, 198.51.100.1, 10.0.0.5"}, "", "198.51.100.1"},
+		{"several headers", "10.1.2.3:1234", []string{"1.2.3.4", "198.51.100.1"}, "", "198.51.100.1"},
+		{"real IP", "10.1.2.3:1234", nil, "198.51.100.2", "198.51.100.2"},
+		{"only proxies", "192.0.2.7:1234", []string{"10.0.0.1"}, "", "10.0.0.1"},
+		{"unparsable", "10.1.2.3:1234", []string{"unknown"}, "", "10.1.2.3:1234"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		for _, value := range tt.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		var got string
+		realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.RemoteAddr })).ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: RemoteAddr %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLimitRequestsSpoofedIP(t *testing.T) {
+	LoadTemplates()
+	defer InitRateLimits()
+	trustedProxies = nil
+	rateLimiters = map[string]*rateLimiter{"read": newRateLimiter(rateLimit{Burst: 1, Per: time.Minute})}
+	handler := realIP(limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// Without trusted proxies, a new forwarded address every time doesn't
+	// get a new bucket
+	var codes []int
+	for _, spoofed := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/notes", nil)
+		req.RemoteAddr = "203.0.113.9:1234"
+		req.Header.Set("X-Forwarded-For", spoofed)
+		req.Header.Set("X-Real-IP", spoofed)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("statuses %v, want 200 then 429", codes)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	useTestDB(t)
+	alice, _ := createTestUsers(t)
+	t.Setenv("QUOTA_NOTES", "2")
+	t.Setenv("QUOTA_BYTES", "10")
+	if _, err := CreateNote(Note{OwnerID: alice.ID, WorkspaceID: alice.ID, MarkdownContent: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkQuota(alice.ID, 1, 4); err != nil {
+		t.Errorf("note that fits: %v", err)
+	}
+	if err := checkQuota(alice.ID, 1, 5); err == nil {
+		t.Error("note over the byte quota was allowed")
+	}
+	if err := checkQuota(alice.ID, 0, -3); err != nil {
+		t.Errorf("shrinking a note: %v", err)
+	}
+	if _, err := CreateNote(Note{OwnerID: alice.ID, WorkspaceID: alice.ID, MarkdownContent: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := checkQuota(alice.ID, 1, 1).(*QuotaError); !ok || err.Usage.Notes != 2 {
+		t.Errorf("third note: %v, want a QuotaError", err)
+	}
+}
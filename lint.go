@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// Issue sources, stored in GrammarIssue.Source
+const (
+	SourceLanguageTool = "languagetool"
+	SourceHunspell     = "hunspell"
+	SourceLint         = "lint"
+)
+
+// LintRule is a markdown style rule. IDs follow markdownlint where a
+// matching rule exists, so they can be looked up there.
+type LintRule struct {
+	ID          string
+	Name        string
+	Description string
+	Severity    string
+	check       func(*lintContext)
+}
+
+// LintRules lists every lint rule. Rules are switched off through the
+// disabled rules in the grammar settings, like LanguageTool rules.
+var LintRules = []LintRule{
+	{ID: "MD001", Name: "heading-increment", Severity: SeverityWarning,
+		Description: "Heading levels should only increase by one at a time", check: lintHeadingIncrement},
+	{ID: "MD004", Name: "ul-style", Severity: SeverityInfo,
+		Description: "Unordered lists should use one bullet marker consistently", check: lintListMarkers},
+	{ID: "MD009", Name: "no-trailing-spaces", Severity: SeverityInfo,
+		Description: "Lines should not end in whitespace (two spaces for a line break are allowed)", check: lintTrailingSpaces},
+	{ID: "MD024", Name: "no-duplicate-heading-ids", Severity: SeverityWarning,
+		Description: "Headings should have unique IDs so they can be linked to", check: lintDuplicateHeadingIDs},
+	{ID: "MD034", Name: "no-bare-urls", Severity: SeverityInfo,
+		Description: "URLs should be written as links or in angle brackets", check: lintBareURLs},
+	{ID: "MD045", Name: "no-alt-text", Severity: SeverityWarning,
+		Description: "Images should have alternate text", check: lintImageAltText},
+	{ID: "MD051", Name: "link-fragments", Severity: SeverityError,
+		Description: "Links to #fragments should point to a heading in the note", check: lintLinks},
+}
+
+// LintOptions configures LintMarkdown
+type LintOptions struct {
+	Check CheckOptions // Its DisabledRules switch off lint rules too
+
+	// KnownFiles holds the filenames of existing notes. Relative links to
+	// files not in it are reported; nil skips that check.
+	KnownFiles map[string]bool
+}
+
+// lintContext is the state shared by the rules while linting one note
+type lintContext struct {
+	source string
+	doc    ast.Node
+	opts   LintOptions
+	rule   LintRule
+	issues []GrammarIssue
+
+	fencedLines map[int]bool // 0-based line numbers inside fenced code
+	headingIDs  map[string]bool
+}
+
+// LintMarkdown runs the enabled lint rules over a markdown document and
+// reports problems in the GrammarIssue shape, with Source set to "lint"
+func LintMarkdown(source string, opts LintOptions) []GrammarIssue {
+	ctx := &lintContext{
+		source:      source,
+		doc:         ParseMarkdown(source),
+		opts:        opts,
+		fencedLines: fencedCodeLines(source),
+		headingIDs:  map[string]bool{},
+	}
+	ast.WalkFunc(ctx.doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering && h.HeadingID != "" {
+			ctx.headingIDs[h.HeadingID] = true
+		}
+		return ast.GoToNext
+	})
+
+	for _, rule := range LintRules {
+		if opts.Check.ignores(GrammarIssue{RuleID: rule.ID}) {
+			continue
+		}
+		ctx.rule = rule
+		rule.check(ctx)
+	}
+
+	var issues []GrammarIssue
+	for _, issue := range ctx.issues {
+		if !opts.Check.ignores(issue) {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// report records an issue of the current rule at a byte range of the source
+func (ctx *lintContext) report(offset, length int, message string, suggestions ...string) {
+	if offset < 0 {
+		offset, length = 0, 0 // Could not locate the node in the source
+	}
+	end := min(len(ctx.source), offset+length)
+	ctx.issues = append(ctx.issues, GrammarIssue{
+		Message:     message,
+		Context:     lineAround(ctx.source, offset),
+		Offset:      offset,
+		Length:      end - offset,
+		Suggestions: suggestions,
+		Word:        ctx.source[offset:end],
+
+		RuleID:          ctx.rule.ID,
+		RuleDescription: ctx.rule.Description,
+		RuleCategory:    "MARKDOWN",
+		IssueType:       "style",
+		ShortMessage:    ctx.rule.Name,
+		Category:        CategoryMarkdown,
+		Severity:        ctx.rule.Severity,
+		Source:          SourceLint,
+	})
+}
+
+// find returns the byte offset of the first occurrence of needle at or
+// after from that is outside fenced code, or -1
+func (ctx *lintContext) find(needle string, from int) int {
+	for from >= 0 && from <= len(ctx.source) {
+		i := strings.Index(ctx.source[from:], needle)
+		if i < 0 || needle == "" {
+			return -1
+		}
+		offset := from + i
+		if !ctx.fencedLines[strings.Count(ctx.source[:offset], "\n")] {
+			return offset
+		}
+		from = offset + len(needle)
+	}
+	return -1
+}
+
+// --- Rules ---
+
+// atxHeadingPattern matches the "## " prefix of an ATX heading line
+var atxHeadingPattern = regexp.MustCompile(`(?m)^ {0,3}#{1,6}[ \t]+\S`)
+
+// headingOffsets returns the source offsets of headings, in document
+// order. ATX ("## ...") heading lines map one-to-one onto the headings
+// when there are no setext headings; otherwise each heading's text is
+// searched for after the previous one.
+func (ctx *lintContext) headingOffsets(headings []*ast.Heading) []int {
+	var atx []int
+	for _, loc := range atxHeadingPattern.FindAllStringIndex(ctx.source, -1) {
+		if !ctx.fencedLines[strings.Count(ctx.source[:loc[0]], "\n")] {
+			atx = append(atx, loc[0])
+		}
+	}
+	if len(atx) == len(headings) {
+		return atx
+	}
+
+	offsets := make([]int, len(headings))
+	cursor := 0
+	for i, h := range headings {
+		offsets[i] = ctx.find(nodeText(h), cursor)
+		if offsets[i] >= 0 {
+			// Point at the start of the line, i.e. at the "#" markers
+			offsets[i] = strings.LastIndexByte(ctx.source[:offsets[i]], '\n') + 1
+			cursor = offsets[i] + 1
+		}
+	}
+	return offsets
+}
+
+// headings collects the heading nodes of the document
+func (ctx *lintContext) headings() []*ast.Heading {
+	var headings []*ast.Heading
+	ast.WalkFunc(ctx.doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering && !h.IsTitleblock {
+			headings = append(headings, h)
+		}
+		return ast.GoToNext
+	})
+	return headings
+}
+
+func lintHeadingIncrement(ctx *lintContext) {
+	headings := ctx.headings()
+	offsets := ctx.headingOffsets(headings)
+	for i := 1; i < len(headings); i++ {
+		prev, cur := headings[i-1].Level, headings[i].Level
+		if cur > prev+1 {
+			ctx.report(offsets[i], lineLength(ctx.source, offsets[i]),
+				fmt.Sprintf("Heading level skipped: h%d follows h%d.", cur, prev),
+				strings.Repeat("#", prev+1)+" "+nodeText(headings[i]))
+		}
+	}
+}
+
+// dedupedIDPattern matches the "-1", "-2", ... suffix the parser appends
+// to automatic heading IDs that are already taken
+var dedupedIDPattern = regexp.MustCompile(`^(.*)-(\d+)$`)
+
+func lintDuplicateHeadingIDs(ctx *lintContext) {
+	headings := ctx.headings()
+	offsets := ctx.headingOffsets(headings)
+	uses := map[string]int{} // Headings seen per ID, before deduplication
+	for i, h := range headings {
+		id := h.HeadingID
+		if id == "" {
+			continue
+		}
+		// The parser renames the n-th repeat of "intro" to "intro-n"; a
+		// heading that is really called "Intro 2" doesn't match the count
+		if m := dedupedIDPattern.FindStringSubmatch(id); m != nil && uses[m[1]] > 0 && m[2] == strconv.Itoa(uses[m[1]]) {
+			id = m[1]
+		}
+		if uses[id] > 0 {
+			ctx.report(offsets[i], lineLength(ctx.source, offsets[i]),
+				fmt.Sprintf("Duplicate heading ID %q; links to #%s only reach the first heading.", id, id))
+		}
+		uses[id]++
+	}
+}
+
+// bulletLinePattern matches a bullet list item marker at the start of a line
+var bulletLinePattern = regexp.MustCompile(`(?m)^[ \t]*([*+-])[ \t]+\S`)
+
+func lintListMarkers(ctx *lintContext) {
+	// The first bullet in the note sets the style
+	var style byte
+	for _, m := range bulletLinePattern.FindAllStringSubmatchIndex(ctx.source, -1) {
+		marker := ctx.source[m[2]]
+		line := strings.Count(ctx.source[:m[2]], "\n")
+		if ctx.fencedLines[line] || isThematicBreak(ctx.source, m[0]) {
+			continue
+		}
+		if style == 0 {
+			style = marker
+		}
+		if marker == style {
+			continue
+		}
+		ctx.report(m[2], 1,
+			fmt.Sprintf("Inconsistent list marker %q; this note uses %q.", marker, style),
+			string(style))
+	}
+}
+
+func lintTrailingSpaces(ctx *lintContext) {
+	lineStart := 0
+	for i, line := range strings.Split(ctx.source, "\n") {
+		content := strings.TrimRight(line, "\r")
+		trimmed := strings.TrimRight(content, " \t")
+		trailing := len(content) - len(trimmed)
+		isBreak := trailing == 2 && strings.HasSuffix(content, "  ") && trimmed != ""
+		if trailing > 0 && !isBreak && !ctx.fencedLines[i] {
+			ctx.report(lineStart+len(trimmed), trailing, "Trailing whitespace.", "")
+		}
+		lineStart += len(line) + 1
+	}
+}
+
+func lintBareURLs(ctx *lintContext) {
+	cursor := 0
+	ast.WalkFunc(ctx.doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		link, ok := node.(*ast.Link)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		dest := string(link.Destination)
+		offset := ctx.find(dest, cursor)
+		if offset < 0 {
+			return ast.GoToNext
+		}
+		cursor = offset + len(dest)
+
+		// Autolinked URLs have the URL itself as text and no markup around it
+		if nodeText(link) != dest && "mailto:"+nodeText(link) != dest {
+			return ast.GoToNext
+		}
+		if offset > 0 && strings.ContainsRune("<([", rune(ctx.source[offset-1])) {
+			return ast.GoToNext
+		}
+		ctx.report(offset, len(dest), "Bare URL; wrap it in <...> or write a link.", "<"+dest+">")
+		return ast.GoToNext
+	})
+}
+
+func lintImageAltText(ctx *lintContext) {
+	cursor := 0
+	ast.WalkFunc(ctx.doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		img, ok := node.(*ast.Image)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		offset := ctx.find("]("+string(img.Destination), cursor)
+		if offset >= 0 {
+			cursor = offset + 1
+			if start := strings.LastIndex(ctx.source[:offset], "!["); start >= 0 {
+				offset = start
+			}
+		}
+		if strings.TrimSpace(nodeText(img)) == "" {
+			length := 0
+			if offset >= 0 {
+				length = strings.IndexByte(ctx.source[offset:], ')') + 1
+			}
+			ctx.report(offset, length, "Image has no alternate text.")
+		}
+		return ast.SkipChildren
+	})
+}
+
+func lintLinks(ctx *lintContext) {
+	cursor := 0
+	ast.WalkFunc(ctx.doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		link, ok := node.(*ast.Link)
+		if !ok || !entering || link.NoteID != 0 {
+			return ast.GoToNext // Not a link, or a footnote reference
+		}
+		dest := string(link.Destination)
+		offset := ctx.find("("+dest, cursor)
+		if offset >= 0 {
+			offset++ // Point at the destination itself
+			cursor = offset
+		}
+
+		if fragment, ok := strings.CutPrefix(dest, "#"); ok {
+			if fragment != "" && !ctx.headingIDs[fragment] {
+				ctx.report(offset, len(dest), fmt.Sprintf("Link to #%s, but no heading has that ID.", fragment))
+			}
+			return ast.GoToNext
+		}
+
+		if ctx.opts.KnownFiles == nil || !isRelativeLink(dest) {
+			return ast.GoToNext
+		}
+		target, err := url.PathUnescape(strings.SplitN(strings.SplitN(dest, "#", 2)[0], "?", 2)[0])
+		if err != nil || target == "" {
+			return ast.GoToNext
+		}
+		if !ctx.opts.KnownFiles[path.Base(target)] {
+			ctx.report(offset, len(dest), fmt.Sprintf("Broken relative link: no note named %q.", path.Base(target)))
+		}
+		return ast.GoToNext
+	})
+}
+
+// --- Helpers ---
+
+// sortIssues orders issues from different sources by their position
+func sortIssues(issues []GrammarIssue) {
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Offset < issues[j].Offset })
+}
+
+// isRelativeLink reports whether a link destination is a relative path
+// (no scheme, not absolute, not a fragment)
+func isRelativeLink(dest string) bool {
+	if dest == "" || strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "#") {
+		return false
+	}
+	u, err := url.Parse(dest)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// nodeText concatenates the text inside a node
+func nodeText(node ast.Node) string {
+	var b strings.Builder
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		switch leaf := n.(type) {
+		case *ast.Text:
+			b.Write(leaf.Literal)
+		case *ast.Code:
+			b.Write(leaf.Literal)
+		}
+		return ast.GoToNext
+	})
+	return b.String()
+}
+
+// fenceLinePattern matches the opening or closing line of a fenced code block
+var fenceLinePattern = regexp.MustCompile("^ {0,3}(```|~~~)")
+
+// fencedCodeLines marks the lines (0-based) that are part of fenced code
+// blocks, fences included
+func fencedCodeLines(source string) map[int]bool {
+	lines := map[int]bool{}
+	fence := ""
+	for i, line := range strings.Split(source, "\n") {
+		m := fenceLinePattern.FindStringSubmatch(line)
+		switch {
+		case fence == "" && m != nil:
+			fence = m[1]
+			lines[i] = true
+		case fence != "":
+			lines[i] = true
+			if m != nil && m[1] == fence {
+				fence = ""
+			}
+		}
+	}
+	return lines
+}
+
+// isThematicBreak reports whether the line at offset is a "* * *" or
+// "- - -" rule rather than a list item
+func isThematicBreak(source string, offset int) bool {
+	line := source[offset : offset+lineLength(source, offset)]
+	compact := strings.NewReplacer(" ", "", "\t", "").Replace(line)
+	return len(compact) >= 3 && strings.Count(compact, compact[:1]) == len(compact)
+}
+
+// lineLength returns the length of the line starting at offset, without
+// its line ending
+func lineLength(source string, offset int) int {
+	if offset < 0 || offset >= len(source) {
+		return 0
+	}
+	end := strings.IndexByte(source[offset:], '\n')
+	if end < 0 {
+		end = len(source) - offset
+	}
+	return len(strings.TrimRight(source[offset:offset+end], "\r"))
+}
+
+// lineAround returns the full source line containing offset
+func lineAround(source string, offset int) string {
+	if offset < 0 || offset > len(source) {
+		return ""
+	}
+	start := strings.LastIndexByte(source[:offset], '\n') + 1
+	return strings.TrimSpace(source[start : start+lineLength(source, start)])
+}
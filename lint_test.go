@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// lintOnly runs a single lint rule and returns its issues as "offset:word"
+func lintOnly(ruleID, source string, knownFiles map[string]bool) []string {
+	var disabled []string
+	for _, rule := range LintRules {
+		if rule.ID != ruleID {
+			disabled = append(disabled, rule.ID)
+		}
+	}
+	opts := LintOptions{Check: CheckOptions{DisabledRules: disabled}, KnownFiles: knownFiles}
+
+	var found []string
+	for _, issue := range LintMarkdown(source, opts) {
+		found = append(found, fmt.Sprintf("%d:%s", issue.Offset, issue.Word))
+	}
+	return found
+}
+
+func TestLintRules(t *testing.T) {
+	notes := map[string]bool{"other.md": true}
+	tests := []struct {
+		rule   string
+		name   string
+		source string
+		want   []string
+	}{
+		{"MD001", "skipped level", "# A\n\n### C\n", []string{"5:### C"}},
+		{"MD001", "one level at a time", "# A\n\n## B\n\n### C\n\n# D\n", nil},
+		{"MD001", "setext headings", "A\n===\n\nC\n---\n\n#### D\n", []string{"14:#### D"}},
+		{"MD001", "in code", "# A\n\n```\n### not a heading\n```\n", nil},
+
+		{"MD004", "mixed markers", "- one\n* two\n- three\n", []string{"6:*"}},
+		{"MD004", "one marker", "* one\n* two\n\n* three\n", nil},
+		{"MD004", "thematic break", "- one\n\n* * *\n", nil},
+		{"MD004", "in code", "- one\n\n```\n* two\n```\n", nil},
+
+		{"MD009", "trailing spaces", "one \ntwo\t\nthree   \n", []string{"3: ", "8:\t", "15:   "}},
+		{"MD009", "line break", "one  \ntwo\r\n", nil},
+		{"MD009", "in code", "```\ncode \n```\n", nil},
+
+		{"MD024", "duplicate", "# Intro\n\ntext\n\n## Intro\n", []string{"15:## Intro"}},
+		{"MD024", "numbered heading", "# Intro\n\n# Intro 2\n", nil},
+		{"MD024", "in code", "# Intro\n\n```\n# Intro\n```\n", nil},
+
+		{"MD034", "bare url", "See https://example.com now.\n", []string{"4:https://example.com"}},
+		{"MD034", "wrapped url", "See <https://example.com> or [it](https://example.com).\n", nil},
+		{"MD034", "in code", "```\nhttps://example.com\n```\n", nil},
+
+		{"MD045", "no alt text", "Look: ![](cat.png)\n", []string{"6:![](cat.png)"}},
+		{"MD045", "alt text", "Look: ![A cat](cat.png)\n", nil},
+		{"MD045", "in code", "```\n![](cat.png)\n```\n", nil},
+
+		{"MD051", "missing fragment", "# Intro\n\n[up](#intro) [down](#outro)\n", []string{"29:#outro"}},
+		{"MD051", "broken relative link", "[a](other.md) [b](missing.md#top)\n", []string{"18:missing.md#top"}},
+		{"MD051", "external links", "[a](https://example.com/x.md) [b](/abs.md)\n", nil},
+		{"MD051", "in code", "# Intro\n\n```\n[down](#outro)\n```\n", nil},
+	}
+	for _, tt := range tests {
+		if got := lintOnly(tt.rule, tt.source, notes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: got %q, want %q", tt.rule, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLintDisabledRule(t *testing.T) {
+	source := "# A\n\n### C \n"
+	if issues := LintMarkdown(source, LintOptions{}); len(issues) != 2 {
+		t.Fatalf("got %d issues, want 2: %+v", len(issues), issues)
+	}
+	issues := LintMarkdown(source, LintOptions{Check: CheckOptions{DisabledRules: []string{"MD001"}}})
+	if len(issues) != 1 || issues[0].RuleID != "MD009" {
+		t.Errorf("with MD001 disabled got %+v, want only MD009", issues)
+	}
+}
+
+func TestLintUnknownFiles(t *testing.T) {
+	// Without the list of notes, relative links are not checked
+	if got := lintOnly("MD051", "[b](missing.md)\n", nil); got != nil {
+		t.Errorf("got %q, want no issues", got)
+	}
+}
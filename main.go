@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -21,39 +22,27 @@ func main() {
 		port = "8080" // Default port
 	}
 
+	// Command line tools, e.g. "notex recheck", run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Initialize components
 	LoadTemplates()      // Load HTML templates first
 	ConnectDB()          // Connect to MongoDB
 	InitGrammarChecker() // Check for LanguageTool JAR
+	InitRateLimits()     // Apply the configured rate limits and trusted proxies
 
 	// Ensure DB disconnect on exit
 	defer DisconnectDB()
 
-	// Setup Router
-	r := chi.NewRouter()
-
-	// Middleware stack
-	r.Use(middleware.RequestID)                 // Inject request ID
-	r.Use(middleware.RealIP)                    // Use X-Forwarded-For or X-Real-IP
-	r.Use(middleware.Logger)                    // Log requests
-	r.Use(middleware.Recoverer)                 // Recover from panics
-	r.Use(middleware.Timeout(60 * time.Second)) // Set request timeout
-
-	// --- Static Files ---
-	// Serve files from the 'static' directory
-	fs := http.FileServer(http.Dir("./static"))
-	r.Handle("/static/*", http.StripPrefix("/static/", fs))
-
-	// --- Routes ---
-	r.Get("/", handleIndex)                    // Main page
-	r.Post("/notes", handleUpload)             // Upload new note
-	r.Get("/notes/{id}", handleGetNoteContent) // Get note content (HTML, Markdown, Details) via query param `type`
-	r.Delete("/notes/{id}", handleDeleteNote)  // Delete a note
-
 	// --- Server Setup ---
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: r,
+		Handler: newRouter(),
 	}
 
 	// --- Graceful Shutdown ---
@@ -93,3 +82,135 @@ func main() {
 
 	// DisconnectDB is called via defer in main
 }
+
+// newRouter sets up the middleware and routes
+func newRouter() http.Handler {
+	r := chi.NewRouter()
+
+	// Middleware stack
+	r.Use(middleware.RequestID)                 // Inject request ID
+	r.Use(realIP)                               // Use X-Forwarded-For or X-Real-IP of TRUSTED_PROXIES
+	r.Use(middleware.Logger)                    // Log requests
+	r.Use(middleware.Recoverer)                 // Recover from panics
+	r.Use(securityHeaders)                      // CSP with a per-response nonce, and related headers
+	r.Use(verifyCSRF)                           // Reject cross-site requests that change something
+	r.Use(middleware.Timeout(60 * time.Second)) // Set request timeout
+
+	// --- Static Files ---
+	// Serve files from the 'static' directory
+	fs := http.FileServer(http.Dir("./static"))
+	r.Handle("/static/*", http.StripPrefix("/static/", fs))
+
+	// Pages without a user are rate limited per IP; see limits.go
+	r.Group(func(r chi.Router) {
+		r.Use(limitRequests)
+
+		// --- Accounts ---
+		r.Get("/login", handleLoginPage)  // Login form
+		r.Post("/login", handleLogin)     // Sign in, starting a session
+		r.Get("/signup", handleLoginPage) // Sign-up form
+		r.Post("/signup", handleSignup)   // Create an account and sign in
+		r.Post("/logout", handleLogout)   // End the session
+
+		// Single sign-on with the OIDC provider, if configured; see oidc.go
+		r.Get("/auth/oidc/login", handleOIDCLogin)       // Redirect to the provider
+		r.Get("/auth/oidc/callback", handleOIDCCallback) // Sign in with the code the provider sent back
+
+		// --- Share Links ---
+		// Public, read-only pages of shared notes; see shares.go
+		r.Get("/s/{token}", handleSharePage)    // The shared note, or its password form
+		r.Post("/s/{token}", handleUnlockShare) // Check the password of a protected share
+	})
+
+	// Everything else needs a signed-in user, and works in their current
+	// workspace. API tokens need the read scope for GET requests and write
+	// for others. What a member may do in the workspace is declared per
+	// route with requirePermission; see policy.go. Requests are rate
+	// limited per user, and those running grammar checks also with
+	// limitGrammar.
+	r.Group(func(r chi.Router) {
+		r.Use(requireUser, limitRequests, requireMethodScope, requireWorkspace)
+
+		// Reading notes, their reports and the settings
+		r.Group(func(r chi.Router) {
+			r.Use(requirePermission(PermViewNotes))
+			r.Get("/", handleIndex)                       // Main page
+			r.Get("/notes", handleListNotes)              // Note list fragment, filtered by query params
+			r.Get("/notes/{id}", handleGetNoteContent)    // Get note content (HTML, Markdown, Details) via query param `type`
+			r.Get("/notes/recheck", handleRecheckStatus)  // Progress of the bulk re-check
+			r.Get("/notes/export", handleExportNotes)     // Report of all notes, ?format=json|sarif|checkstyle
+			r.Get("/notes/{id}/export", handleExportNote) // Report of one note
+			r.Get("/settings", handleGetSettings)         // Grammar settings panel
+			r.Get("/workspaces", handleWorkspaces)        // Workspaces panel: members and invitations
+		})
+
+		// Changing notes
+		r.Group(func(r chi.Router) {
+			r.Use(requirePermission(PermEditNotes))
+			r.With(limitGrammar).Post("/notes", handleUpload) // Upload new note
+			r.Delete("/notes/{id}", handleDeleteNote)         // Delete a note
+
+			// Re-checking stored notes with the current settings and checker
+			r.With(limitGrammar).Post("/notes/{id}/recheck", handleRecheckNote) // Re-check one note, returns its details
+			r.With(limitGrammar).Post("/notes/recheck", handleRecheckAll)       // Start re-checking all notes in the background
+
+			// Live editor: write or edit a note with grammar checks while typing
+			r.Get("/editor", handleEditor)                                // Editor for a new note
+			r.With(limitGrammar).Post("/editor", handleEditorSave)        // Save a new note from the editor
+			r.With(limitGrammar).Post("/editor/check", handleEditorCheck) // Check changed paragraphs, streams NDJSON results
+			r.Get("/notes/{id}/edit", handleEditor)                       // Editor for an existing note
+			r.With(limitGrammar).Put("/notes/{id}", handleEditorSave)     // Save an edited note
+
+			// Public share links of the workspace's notes
+			r.Get("/shares", handleListShares)               // Active shares of all notes
+			r.Get("/notes/{id}/shares", handleNoteShares)    // Active shares of one note, with the form to create one
+			r.Post("/notes/{id}/shares", handleCreateShare)  // Create a share link
+			r.Delete("/shares/{shareID}", handleRevokeShare) // Revoke a share link
+		})
+
+		// Grammar settings: default language, dictionary, disabled rules
+		// and categories
+		r.Group(func(r chi.Router) {
+			r.Use(requirePermission(PermEditSettings))
+			r.Put("/settings/language", handleSetLanguage)    // Set the "language" form field, empty for the server default
+			r.Post("/settings/{list}", handleAddSetting)      // Add the "value" form field to a list
+			r.Delete("/settings/{list}", handleRemoveSetting) // Remove the "value" query param from a list
+		})
+
+		// Invitations to the workspace
+		r.Group(func(r chi.Router) {
+			r.Use(requirePermission(PermManageMembers))
+			r.Post("/invitations", handleInvite)                  // Invite the "username" form field with "role"
+			r.Delete("/invitations/{id}", handleCancelInvitation) // Cancel a pending invitation
+		})
+
+		// Members change roles with manage-members, but anyone may leave;
+		// these handlers ask the policy themselves
+		r.Put("/members/{userID}", handleSetMemberRole)   // Set the "role" form field
+		r.Delete("/members/{userID}", handleRemoveMember) // Remove a member, or leave
+
+		// The user's own workspaces and invitations
+		r.Post("/workspaces", handleCreateWorkspace)                 // Create a workspace and switch to it
+		r.Post("/workspaces/switch", handleSwitchWorkspace)          // Make the "workspace" form field current
+		r.Post("/invitations/{id}/accept", handleAcceptInvitation)   // Join the invitation's workspace
+		r.Post("/invitations/{id}/decline", handleDeclineInvitation) // Turn an invitation down
+
+		// API tokens of the user; tokens need the admin scope to manage them
+		r.Group(func(r chi.Router) {
+			r.Use(requireScope(ScopeAdmin))
+			r.Get("/settings/tokens", handleGetAPITokens)           // Token list fragment
+			r.Post("/settings/tokens", handleCreateAPIToken)        // Create a token, shown once
+			r.Delete("/settings/tokens/{id}", handleRevokeAPIToken) // Revoke a token
+		})
+
+		// For the admin only
+		r.Group(func(r chi.Router) {
+			r.Use(requireAdmin, requireScope(ScopeAdmin))
+			r.Get("/admin/audit", handleAuditLog)              // Audit events fragment, filtered by query params
+			r.Get("/admin/audit/export", handleExportAuditLog) // The same events as CSV
+			r.Handle("/debug/vars", expvar.Handler())          // Runtime counters (grammar cache hits/misses, ...) as JSON
+		})
+	})
+
+	return r
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,16 +14,281 @@ type GrammarIssue struct {
 	Offset      int      `json:"offset"`      // Character offset in the original text
 	Length      int      `json:"length"`      // Length of the problematic text span
 	Suggestions []string `json:"suggestions"` // Suggested replacements
+	Word        string   `json:"word"`        // The flagged text itself
+
+	// Rule metadata from LanguageTool
+	RuleID          string `json:"ruleId"`          // Rule that matched, e.g. "MORFOLOGIK_RULE_EN_US"
+	RuleDescription string `json:"ruleDescription"` // Human-readable rule description
+	RuleCategory    string `json:"ruleCategory"`    // LanguageTool category ID, e.g. "TYPOS"
+	IssueType       string `json:"issueType"`       // LanguageTool issue type, e.g. "misspelling"
+	ShortMessage    string `json:"shortMessage"`    // Short form of Message, may be empty
+
+	Category string `json:"category"` // One of the Category* constants
+	Severity string `json:"severity"` // One of the Severity* constants
+	Source   string `json:"source"`   // Checker that reported it: "languagetool", "hunspell" or "lint"
+}
+
+// Issue categories used to group and filter grammar issues
+const (
+	CategorySpelling    = "spelling"
+	CategoryGrammar     = "grammar"
+	CategoryStyle       = "style"
+	CategoryPunctuation = "punctuation"
+	CategoryMarkdown    = "markdown" // Lint issues in the markdown itself
+)
+
+// IssueCategories lists the issue categories in display order
+var IssueCategories = []string{CategorySpelling, CategoryGrammar, CategoryStyle, CategoryPunctuation, CategoryMarkdown}
+
+// Issue severities, from most to least severe
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// IssueGroup is the set of a note's issues in one category
+type IssueGroup struct {
+	Category string
+	Issues   []GrammarIssue
+}
+
+// IssuesByCategory groups the note's grammar issues by category, in
+// IssueCategories order. Empty categories are left out.
+func (n Note) IssuesByCategory() []IssueGroup {
+	var groups []IssueGroup
+	for _, category := range IssueCategories {
+		group := IssueGroup{Category: category}
+		for _, issue := range n.GrammarIssues {
+			if issue.Category == category {
+				group.Issues = append(group.Issues, issue)
+			}
+		}
+		if len(group.Issues) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	// Issues without a known category (e.g. checker failures) go last
+	other := IssueGroup{Category: "other"}
+	for _, issue := range n.GrammarIssues {
+		if !isIssueCategory(issue.Category) {
+			other.Issues = append(other.Issues, issue)
+		}
+	}
+	if len(other.Issues) > 0 {
+		groups = append(groups, other)
+	}
+	return groups
+}
+
+// isIssueCategory reports whether category is one of IssueCategories
+func isIssueCategory(category string) bool {
+	for _, c := range IssueCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// GrammarSettings holds the user dictionary and the LanguageTool rules
+// and categories that should never be reported. Each user has their own.
+type GrammarSettings struct {
+	ID                 string    `bson:"_id"`                // Hex ID of the user
+	Dictionary         []string  `bson:"dictionary"`         // Words that are never spelling errors
+	DisabledRules      []string  `bson:"disabledRules"`      // LanguageTool rule IDs
+	DisabledCategories []string  `bson:"disabledCategories"` // LanguageTool category IDs
+	Language           string    `bson:"language,omitempty"` // Default grammar language; empty for GRAMMAR_LANGUAGE
+	UpdatedAt          time.Time `bson:"updatedAt"`
+}
+
+// User is an account that notes belong to
+type User struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	Username     string             `bson:"username"`              // Unique, lowercase
+	PasswordHash string             `bson:"passwordHash"`          // bcrypt hash, see hashPassword; empty for single sign-on users
+	Admin        bool               `bson:"admin"`                 // The first account, or per the OIDC groups; may see server internals
+	OIDCIssuer   string             `bson:"oidcIssuer,omitempty"`  // Provider of a single sign-on user, see oidc.go
+	OIDCSubject  string             `bson:"oidcSubject,omitempty"` // The user's ID at the provider
+	CreatedAt    time.Time          `bson:"createdAt"`
+}
+
+// Workspace is a notebook shared by its members, each with a Role (see
+// policy.go). Every user has a personal workspace, with the same ID as
+// the user, where their notes went before workspaces existed.
+type Workspace struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Name      string             `bson:"name"`
+	Personal  bool               `bson:"personal"` // Its creator can't leave it or lose the admin role
+	Members   []Member           `bson:"members"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// Member is a user's membership of a workspace
+type Member struct {
+	UserID   primitive.ObjectID `bson:"userId"`
+	Username string             `bson:"username"`
+	Role     Role               `bson:"role"`
+	JoinedAt time.Time          `bson:"joinedAt"`
+}
+
+// Invitation asks a user to join a workspace with a role. It is deleted
+// when accepted or declined, or by MongoDB once expired (TTL index).
+type Invitation struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	WorkspaceID   primitive.ObjectID `bson:"workspaceId"`
+	WorkspaceName string             `bson:"workspaceName"`
+	Username      string             `bson:"username"` // Invited user
+	Role          Role               `bson:"role"`
+	InvitedBy     string             `bson:"invitedBy"` // Username of the admin who invited them
+	CreatedAt     time.Time          `bson:"createdAt"`
+	ExpiresAt     time.Time          `bson:"expiresAt"`
+}
+
+// Session is a signed-in browser. The cookie holds a random token; only
+// its SHA-256 hash is stored, so the sessions collection can't be used to
+// sign in.
+type Session struct {
+	Key       string             `bson:"_id"` // Hex SHA-256 of the cookie token
+	UserID    primitive.ObjectID `bson:"userId"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"` // MongoDB deletes the session after this (TTL index)
+}
+
+// APIToken lets scripts use the API as a user, see apitokens.go. Only
+// the SHA-256 hash of the token is stored.
+type APIToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `bson:"userId"`
+	Name       string             `bson:"name"`   // Chosen by the user, e.g. "backup script"
+	Hash       string             `bson:"hash"`   // Hex SHA-256 of the token
+	Hint       string             `bson:"hint"`   // First characters of the token, to recognize it
+	Scopes     []string           `bson:"scopes"` // ScopeRead, ScopeWrite or ScopeAdmin
+	CreatedAt  time.Time          `bson:"createdAt"`
+	LastUsedAt time.Time          `bson:"lastUsedAt,omitempty"` // Zero if never used; updated at most once a minute
+}
+
+// Share is a public read-only link to a note, see shares.go. Unlike
+// session and API tokens, the link's token is stored as is, so owners can
+// copy their links again; it only gives access to what the notes
+// collection holds anyway.
+type Share struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	Token        string             `bson:"token"` // Random, in the link: /s/<token>
+	NoteID       primitive.ObjectID `bson:"noteId"`
+	WorkspaceID  primitive.ObjectID `bson:"workspaceId"`            // Workspace of the note
+	OwnerID      primitive.ObjectID `bson:"ownerId"`                // User who created the share
+	PasswordHash string             `bson:"passwordHash,omitempty"` // bcrypt hash; empty for shares without a password
+	CreatedAt    time.Time          `bson:"createdAt"`
+	ExpiresAt    time.Time          `bson:"expiresAt,omitempty"` // Zero for shares that don't expire; MongoDB deletes the others after this (TTL index)
 }
 
 // Note defines the structure for a note stored in MongoDB
 type Note struct {
 	ID               primitive.ObjectID `bson:"_id,omitempty"` // MongoDB object ID
+	OwnerID          primitive.ObjectID `bson:"ownerId"`       // User who created the note
+	WorkspaceID      primitive.ObjectID `bson:"workspaceId"`   // Workspace the note belongs to, see policy.go
 	OriginalFilename string             `bson:"originalFilename"`
 	MarkdownContent  string             `bson:"markdownContent"`
 	HTMLContent      string             `bson:"htmlContent"`
 	GrammarIssues    []GrammarIssue     `bson:"grammarIssues"`
 	CreatedAt        time.Time          `bson:"createdAt"`
+
+	// Grammar language: the requested code ("auto" for detection) and
+	// what LanguageTool detected when checking the note
+	Language           string  `bson:"language,omitempty"`
+	DetectedLanguage   string  `bson:"detectedLanguage,omitempty"`
+	LanguageConfidence float64 `bson:"languageConfidence,omitempty"`
+
+	// GrammarIncomplete is set when LanguageTool reported that it did not
+	// check all of the text (e.g. it hit a time or size limit)
+	GrammarIncomplete bool `bson:"grammarIncomplete,omitempty"`
+
+	Stats NoteStats `bson:"stats"` // Writing statistics, see ComputeNoteStats
+
+	// Checker that produced GrammarIssues (e.g. "LanguageTool 6.6") and
+	// when, so stale results can be re-checked
+	CheckerVersion string    `bson:"checkerVersion,omitempty"`
+	CheckedAt      time.Time `bson:"checkedAt,omitempty"`
+
+	// Encrypted holds the markdown and HTML when stored encrypted, in
+	// which case MarkdownContent and HTMLContent are stored empty and
+	// filled in on loading; see encryption.go
+	Encrypted *NoteEncryption `bson:"encrypted,omitempty"`
+
+	// EncryptedCheck holds the text of the check results (the messages,
+	// excerpts and suggestions of GrammarIssues and the words in Stats)
+	// when stored encrypted, in which case those are stored empty
+	EncryptedCheck *SealedCheck `bson:"encryptedCheck,omitempty"`
+}
+
+// NoteEncryption is the encrypted content of a note: sealed with a data
+// key, which is stored wrapped by the master key KeyID
+type NoteEncryption struct {
+	KeyID         string `bson:"keyId"`
+	DataKey       []byte `bson:"dataKey"`
+	Markdown      []byte `bson:"markdown"`
+	HTML          []byte `bson:"html"`
+	MarkdownBytes int64  `bson:"markdownBytes"` // Plaintext size, for storage quotas
+}
+
+// SealedCheck is the encrypted text of a note's check results. It has a
+// data key of its own, since checks are saved without the content.
+type SealedCheck struct {
+	KeyID   string `bson:"keyId"`
+	DataKey []byte `bson:"dataKey"`
+	Text    []byte `bson:"text"`
+}
+
+// NoteStats holds the writing-quality metrics of a note
+type NoteStats struct {
+	WordCount          int                    `bson:"wordCount"`
+	SentenceCount      int                    `bson:"sentenceCount"`
+	ReadingTimeSeconds int                    `bson:"readingTimeSeconds"`
+	AvgSentenceLength  float64                `bson:"avgSentenceLength"` // Words per sentence
+	SentenceLengths    []SentenceLengthBucket `bson:"sentenceLengths"`   // Sentence length histogram
+
+	// Readability scores
+	FleschReadingEase    float64 `bson:"fleschReadingEase"`    // 0-100, higher is easier
+	FleschKincaidGrade   float64 `bson:"fleschKincaidGrade"`   // US school grade
+	GunningFog           float64 `bson:"gunningFog"`           // Years of education
+	ColemanLiau          float64 `bson:"colemanLiau"`          // US school grade
+	AutomatedReadability float64 `bson:"automatedReadability"` // US school grade
+
+	PassiveVoicePercent float64         `bson:"passiveVoicePercent"` // Share of sentences in passive voice
+	AdverbPercent       float64         `bson:"adverbPercent"`       // Share of words that are "-ly" adverbs
+	RepeatedWords       []WordFrequency `bson:"repeatedWords"`       // Most overused words
+	DoubledWords        []string        `bson:"doubledWords"`        // Words accidentally repeated, as in "the the"
+}
+
+// SentenceLengthBucket counts sentences of up to MaxWords words (and more
+// than the previous bucket's MaxWords). MaxWords is 0 for the last bucket.
+type SentenceLengthBucket struct {
+	MaxWords int `bson:"maxWords"`
+	Count    int `bson:"count"`
+}
+
+// WordFrequency is a word and how often it is used
+type WordFrequency struct {
+	Word  string `bson:"word"`
+	Count int    `bson:"count"`
+}
+
+// ReadingTime formats the reading time for display, e.g. "3 min"
+func (s NoteStats) ReadingTime() string {
+	if s.ReadingTimeSeconds < 60 {
+		return "< 1 min"
+	}
+	return fmt.Sprintf("%d min", (s.ReadingTimeSeconds+30)/60)
+}
+
+// CachedCheck is the grammar check result for one paragraph, stored in the
+// grammarCache collection. Issue offsets are relative to the paragraph.
+type CachedCheck struct {
+	Key       string        `bson:"_id"` // See CheckOptions.cacheKey
+	Result    GrammarResult `bson:"result"`
+	CreatedAt time.Time     `bson:"createdAt"`
 }
 
 // --- LanguageTool JSON Output Structures ---
@@ -99,3 +365,43 @@ type DetectedLanguageInfo struct {
 	Confidence float64 `json:"confidence"`
 	Source     string  `json:"source"` // e.g., "ngram" or "user"
 }
+
+// StorageUsage is how much a user stores: their notes, in all
+// workspaces, and the bytes of their markdown
+type StorageUsage struct {
+	Notes int64 `bson:"notes"`
+	Bytes int64 `bson:"bytes"`
+}
+
+// AuditAction is what an AuditEvent records being done to a note
+type AuditAction string
+
+const (
+	AuditCreate AuditAction = "create"
+	AuditView   AuditAction = "view"
+	AuditEdit   AuditAction = "edit"
+	AuditCheck  AuditAction = "check" // A re-check of the grammar
+	AuditShare  AuditAction = "share"
+	AuditDelete AuditAction = "delete"
+)
+
+// auditActions lists the actions, in the order the audit log offers them
+var auditActions = []AuditAction{AuditCreate, AuditView, AuditEdit, AuditCheck, AuditShare, AuditDelete}
+
+// AuditEvent records who did what to which note, see audit.go. Events are
+// only ever inserted, never changed or deleted. The note's filename and
+// the user's name are copied in, so they stay readable after either is
+// gone.
+type AuditEvent struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	Time        time.Time          `bson:"time"`
+	Action      AuditAction        `bson:"action"`
+	RequestID   string             `bson:"requestId"`          // From middleware.RequestID, as in the request log
+	UserID      primitive.ObjectID `bson:"userId,omitempty"`   // Zero for visitors of share links
+	Username    string             `bson:"username,omitempty"` // Username at the time
+	IP          string             `bson:"ip"`                 // Client address, as set by realIP
+	NoteID      primitive.ObjectID `bson:"noteId"`
+	WorkspaceID primitive.ObjectID `bson:"workspaceId"`
+	Filename    string             `bson:"filename,omitempty"`
+	Detail      string             `bson:"detail,omitempty"` // e.g. how the note was viewed, or the share created or revoked
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 of RS384, ES512, ...
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- Single Sign-On ---
+//
+// With OIDC_ISSUER set, users can sign in with an OpenID Connect provider
+// instead of a password: the authorization code flow with PKCE. The
+// provider's endpoints come from its discovery document, and the ID
+// token's signature is checked against its published keys (JWKS). Users
+// are created on their first sign-in, and their groups (OIDC_GROUPS_CLAIM)
+// decide whether they may sign in and whether they are admins
+// (OIDC_GROUP_ROLES). Accounts are linked by the provider's subject, never
+// by username, so a provider user can't take over a password account.
+
+// oidcConfig is the configuration of the provider, from the environment
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for a public client, which relies on PKCE alone
+	RedirectURL  string // Empty for PUBLIC_URL (or the request's address) + /auth/oidc/callback
+	Scopes       []string
+	GroupsClaim  string
+	GroupRoles   map[string]string // Group to oidcRoleAdmin or oidcRoleUser
+	Name         string            // Shown on the login page
+}
+
+// The roles OIDC_GROUP_ROLES maps groups to
+const (
+	oidcRoleAdmin = "admin"
+	oidcRoleUser  = "user"
+)
+
+// oidcConfigFromEnv reads the configuration; ok is false without
+// OIDC_ISSUER and OIDC_CLIENT_ID, when single sign-on is off
+func oidcConfigFromEnv() (config oidcConfig, ok bool) {
+	config = oidcConfig{
+		Issuer:       strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		GroupRoles:   map[string]string{},
+		Name:         os.Getenv("OIDC_NAME"),
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.Name == "" {
+		config.Name = "single sign-on"
+	}
+	// e.g. OIDC_GROUP_ROLES=notex-admins=admin,staff=user
+	for _, pair := range strings.Split(os.Getenv("OIDC_GROUP_ROLES"), ",") {
+		group, role, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		if role != oidcRoleAdmin && role != oidcRoleUser {
+			log.Printf("Ignoring OIDC_GROUP_ROLES entry %q: roles are %s and %s", pair, oidcRoleAdmin, oidcRoleUser)
+			continue
+		}
+		config.GroupRoles[group] = role
+	}
+	return config, config.Issuer != "" && config.ClientID != ""
+}
+
+// passwordLoginDisabled reports whether OIDC_ONLY=true turns off signing
+// in and up with passwords
+func passwordLoginDisabled() bool {
+	_, enabled := oidcConfigFromEnv()
+	return enabled && os.Getenv("OIDC_ONLY") == "true"
+}
+
+// roleForGroups returns the role of a user in groups: admin if any group
+// maps to it, else user. Without OIDC_GROUP_ROLES everyone is a user; with
+// it, users without a mapped group get no role and may not sign in.
+func (c oidcConfig) roleForGroups(groups []string) (role string, ok bool) {
+	if len(c.GroupRoles) == 0 {
+		return oidcRoleUser, true
+	}
+	for _, group := range groups {
+		switch c.GroupRoles[group] {
+		case oidcRoleAdmin:
+			return oidcRoleAdmin, true
+		case oidcRoleUser:
+			role = oidcRoleUser
+		}
+	}
+	return role, role != ""
+}
+
+// oidcHTTPClient makes the requests to the provider
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// --- Discovery and Keys ---
+
+// oidcProvider is the provider's discovery document, plus its keys
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // By key ID
+	keysFetched time.Time
+}
+
+// jwksRefreshInterval is how often the keys may be fetched again for an
+// unknown key ID, as when the provider rotates its keys
+const jwksRefreshInterval = time.Minute
+
+// oidcProviders caches the discovered providers by issuer
+var (
+	oidcProvidersMu sync.Mutex
+	oidcProviders   = map[string]*oidcProvider{}
+)
+
+// discoverOIDC returns the provider of issuer, fetching its discovery
+// document on first use
+func discoverOIDC(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+	if provider, ok := oidcProviders[issuer]; ok {
+		return provider, nil
+	}
+
+	provider := &oidcProvider{}
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("discovery: issuer is %q, want %q", provider.Issuer, issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery: endpoints missing")
+	}
+	oidcProviders[issuer] = provider
+	return provider, nil
+}
+
+// getJSON decodes the JSON at target into v
+func getJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// key returns the provider's signing key with the given ID, fetching the
+// keys again if it is new
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, p.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	p.keysFetched = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping OIDC signing key %q: %v", jwk.Kid, err)
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns the key with the given ID. Tokens without a key ID may
+// use the provider's only key.
+func (p *oidcProvider) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// jsonWebKey is an RSA or EC public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("bad key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := number(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := number(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := number(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := number(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// --- ID Tokens ---
+
+// idTokenClaims are the claims of an ID token notex uses. Groups are
+// read separately, as the claim's name is configurable.
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+	Groups            []string `json:"-"`
+}
+
+// audience is the "aud" claim: one client ID, or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtAlgorithms are the signature algorithms ID tokens may use, with
+// their hash. "none" and HMAC algorithms are refused.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// idTokenLeeway allows for clocks of the provider and notex that differ
+// a little
+const idTokenLeeway = time.Minute
+
+// errInvalidIDToken is returned by verifyIDToken for tokens that don't
+// pass the checks
+var errInvalidIDToken = errors.New("invalid ID token")
+
+// verifyIDToken checks the signature and claims of the ID token raw,
+// issued by provider for clientID in the sign-in with nonce, and returns
+// its claims
+func verifyIDToken(ctx context.Context, provider *oidcProvider, raw, clientID, nonce, groupsClaim string, now time.Time) (idTokenClaims, error) {
+	var claims idTokenClaims
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: not a JWT", errInvalidIDToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return claims, fmt.Errorf("%w: algorithm %q not allowed", errInvalidIDToken, header.Alg)
+	}
+	key, err := provider.key(ctx, header.Kid)
+	if err != nil {
+		return claims, fmt.Errorf("%w: %v", errInvalidIDToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: bad signature encoding", errInvalidIDToken)
+	}
+	if err := verifyJWTSignature(header.Alg, hash, key, parts[0]+"."+parts[1], signature); err != nil {
+		return claims, err
+	}
+
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.Issuer != provider.Issuer:
+		return claims, fmt.Errorf("%w: issuer %q", errInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(clientID):
+		return claims, fmt.Errorf("%w: not issued for this client", errInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != clientID:
+		return claims, fmt.Errorf("%w: authorized party %q", errInvalidIDToken, claims.AuthorizedParty)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: no subject", errInvalidIDToken)
+	case now.After(time.Unix(claims.Expiry, 0).Add(idTokenLeeway)):
+		return claims, fmt.Errorf("%w: expired", errInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)):
+		return claims, fmt.Errorf("%w: issued in the future", errInvalidIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, fmt.Errorf("%w: nonce doesn't match", errInvalidIDToken)
+	}
+
+	// The groups claim is a list of names, or a single name
+	var all map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &all); err == nil {
+		if value, ok := all[groupsClaim]; ok {
+			var one string
+			if json.Unmarshal(value, &claims.Groups) != nil && json.Unmarshal(value, &one) == nil {
+				claims.Groups = []string{one}
+			}
+		}
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes the base64url JSON of a JWT header or payload
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: bad encoding", errInvalidIDToken)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: bad JSON", errInvalidIDToken)
+	}
+	return nil
+}
+
+// verifyJWTSignature checks the signature of signed (the header and
+// payload) with key
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, signature []byte) error {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: bad signature", errInvalidIDToken)
+}
+
+// --- Authorization Code Flow ---
+
+// oidcCookieName is the cookie holding the state, nonce and PKCE verifier
+// of a sign-in in progress, between the redirect to the provider and the
+// callback
+const oidcCookieName = "notex_oidc"
+
+// oidcLoginTTL is how long a sign-in with the provider may take
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcLogin is what the callback of a sign-in checks against
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge returns the S256 code challenge of verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// redirectURL returns the callback address registered with the provider
+func (c oidcConfig) redirectURL(r *http.Request) string {
+	if c.RedirectURL != "" {
+		return c.RedirectURL
+	}
+	return publicURL(r) + "/auth/oidc/callback"
+}
+
+// handleOIDCLogin starts a sign-in: it remembers a new state, nonce and
+// PKCE verifier in a cookie and sends the browser to the provider
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	config, ok := oidcConfigFromEnv()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverOIDC(r.Context(), config.Issuer)
+	if err != nil {
+		log.Printf("Error discovering OIDC provider %s: %v", config.Issuer, err)
+		renderLogin(w, r, http.StatusBadGateway, loginView{Error: "Single sign-on is unavailable, please try again later."})
+		return
+	}
+
+	var login oidcLogin
+	if login.State, err = randomToken(32); err == nil {
+		if login.Nonce, err = randomToken(32); err == nil {
+			login.Verifier, err = randomToken(32)
+		}
+	}
+	if err != nil {
+		log.Printf("Error starting OIDC sign-in: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	value, _ := json.Marshal(login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode, // Sent along with the provider's redirect back
+	})
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.ClientID},
+		"redirect_uri":          {config.redirectURL(r)},
+		"scope":                 {strings.Join(config.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {pkceChallenge(login.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	target := provider.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes a sign-in: it checks the state, exchanges
+// the code for an ID token, verifies it, and signs in its user, creating
+// them on their first sign-in
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	config, ok := oidcConfigFromEnv()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	failed := func(status int, message string) {
+		renderLogin(w, r, status, loginView{Error: message})
+	}
+
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcCookieName)
+	if err == nil {
+		var value []byte
+		if value, err = base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			err = json.Unmarshal(value, &login)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: secureCookies(r)})
+	state := r.URL.Query().Get("state")
+	if err != nil || login.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		failed(http.StatusBadRequest, "The sign-in expired or was started elsewhere. Please try again.")
+		return
+	}
+	if providerError := r.URL.Query().Get("error"); providerError != "" {
+		log.Printf("OIDC provider refused sign-in: %s: %s", providerError, r.URL.Query().Get("error_description"))
+		failed(http.StatusUnauthorized, "Sign-in was refused by "+config.Name+".")
+		return
+	}
+
+	provider, err := discoverOIDC(r.Context(), config.Issuer)
+	if err != nil {
+		log.Printf("Error discovering OIDC provider %s: %v", config.Issuer, err)
+		failed(http.StatusBadGateway, "Single sign-on is unavailable, please try again later.")
+		return
+	}
+	claims, err := exchangeOIDCCode(r.Context(), config, provider, r.URL.Query().Get("code"), config.redirectURL(r), login)
+	if err != nil {
+		log.Printf("OIDC sign-in failed: %v", err)
+		failed(http.StatusUnauthorized, "Signing in with "+config.Name+" failed, please try again.")
+		return
+	}
+	role, allowed := config.roleForGroups(claims.Groups)
+	if !allowed {
+		log.Printf("OIDC user %s is in none of the groups of OIDC_GROUP_ROLES", claims.Subject)
+		failed(http.StatusForbidden, "Your account may not use notex. Ask the administrator for access.")
+		return
+	}
+
+	user, err := oidcUser(config, claims, role)
+	if err != nil {
+		log.Printf("Error provisioning OIDC user %s: %v", claims.Subject, err)
+		failed(http.StatusInternalServerError, "Signing in failed, please try again.")
+		return
+	}
+	if err := startSession(w, r, user); err != nil {
+		log.Printf("Error starting session for %s: %v", user.Username, err)
+		failed(http.StatusInternalServerError, "Signing in failed, please try again.")
+		return
+	}
+	log.Printf("User %s signed in with %s (admin: %v)", user.Username, config.Name, user.Admin)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// exchangeOIDCCode redeems code at the provider's token endpoint, with
+// the PKCE verifier of login, and returns the claims of the verified ID
+// token
+func exchangeOIDCCode(ctx context.Context, config oidcConfig, provider *oidcProvider, code, redirectURL string, login oidcLogin) (idTokenClaims, error) {
+	if code == "" {
+		return idTokenClaims{}, errors.New("no code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {config.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return idTokenClaims{}, fmt.Errorf("token response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return idTokenClaims{}, fmt.Errorf("token request: %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	return verifyIDToken(ctx, provider, token.IDToken, config.ClientID, login.Nonce, config.GroupsClaim, time.Now())
+}
+
+// oidcUser returns the user of claims, creating them on their first
+// sign-in. With OIDC_GROUP_ROLES, whether they are an admin follows their
+// groups on every sign-in.
+func oidcUser(config oidcConfig, claims idTokenClaims, role string) (User, error) {
+	mapped := len(config.GroupRoles) > 0
+	user, err := GetUserByOIDC(claims.Issuer, claims.Subject)
+	if err == nil {
+		if mapped && user.Admin != (role == oidcRoleAdmin) {
+			user.Admin = role == oidcRoleAdmin
+			if err := SetUserAdmin(user.ID, user.Admin); err != nil {
+				return User{}, err
+			}
+		}
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return User{}, err
+	}
+
+	// Without a group mapping, the first account is the admin, as with
+	// passwords
+	base := oidcUsername(claims)
+	for i := 1; i <= 20; i++ {
+		username := base
+		if i > 1 {
+			suffix := fmt.Sprintf("-%d", i)
+			username = strings.TrimRight(base[:min(len(base), 32-len(suffix))], "-") + suffix
+		}
+		newUser := User{Username: username, Admin: role == oidcRoleAdmin, OIDCIssuer: claims.Issuer, OIDCSubject: claims.Subject}
+		user, err = createAccount(newUser, !mapped)
+		if err != errUsernameTaken {
+			if err == nil {
+				log.Printf("Created user %s for %s at %s", user.Username, claims.Subject, claims.Issuer)
+			}
+			return user, err
+		}
+		// The name is taken, or the same user signed in at the same time
+		if user, err := GetUserByOIDC(claims.Issuer, claims.Subject); err == nil {
+			return user, nil
+		}
+	}
+	return User{}, errUsernameTaken
+}
+
+// oidcUsername makes a username for a new user from their preferred
+// username, their email address or else their subject
+func oidcUsername(claims idTokenClaims) string {
+	for _, candidate := range []string{claims.PreferredUsername, strings.Split(claims.Email, "@")[0], "user-" + claims.Subject} {
+		var b strings.Builder
+		for _, r := range strings.ToLower(candidate) {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+				b.WriteRune(r)
+			case r == '@' || r == ' ' || r == '+':
+				b.WriteRune('-')
+			}
+		}
+		name := b.String()
+		if len(name) > 32 {
+			name = name[:32]
+		}
+		if username, err := normalizeUsername(name); err == nil {
+			return username
+		}
+	}
+	return "user-" + fmt.Sprintf("%x", sha256.Sum256([]byte(claims.Subject)))[:16]
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is a stand-in OIDC provider: it signs in whoever is set
+// as its user, checking client ID, redirect URI and PKCE like a real one
+type testProvider struct {
+	*httptest.Server
+	clientID string
+	key      *rsa.PrivateKey
+	kid      string
+
+	mu      sync.Mutex
+	claims  map[string]interface{} // Of the next sign-in, besides iss, aud, exp, iat and nonce
+	pending map[string]url.Values  // Authorization requests by code
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{clientID: "notex", key: key, kid: "key-1", pending: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": p.kid, "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != p.clientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken(16)
+		p.mu.Lock()
+		p.pending[code] = q
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		auth, ok := p.pending[r.FormValue("code")]
+		delete(p.pending, r.FormValue("code"))
+		p.mu.Unlock()
+		id, secret, _ := r.BasicAuth()
+		switch {
+		case !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != auth.Get("redirect_uri"):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		case pkceChallenge(r.FormValue("code_verifier")) != auth.Get("code_challenge"):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		case id != p.clientID || secret != "s3cret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(t, map[string]interface{}{"nonce": auth.Get("nonce")}), "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// signIn sets the user of the next sign-in
+func (p *testProvider) signIn(claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims = claims
+}
+
+// idToken returns an ID token of the provider's user, with extra claims
+func (p *testProvider) idToken(t *testing.T, extra map[string]interface{}) string {
+	claims := map[string]interface{}{"iss": p.URL, "aud": p.clientID, "exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix()}
+	p.mu.Lock()
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	p.mu.Unlock()
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return signTestJWT(t, map[string]string{"alg": "RS256", "kid": p.kid}, claims, p.key)
+}
+
+// signTestJWT signs claims with an RSA or EC key
+func signTestJWT(t *testing.T, header map[string]string, claims map[string]interface{}, key crypto.Signer) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest[:]); err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	p := newTestProvider(t)
+	p.signIn(map[string]interface{}{"sub": "u1", "groups": "staff"})
+	provider, err := discoverOIDC(context.Background(), p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(token string) (idTokenClaims, error) {
+		return verifyIDToken(context.Background(), provider, token, p.clientID, "n1", "groups", time.Now())
+	}
+
+	claims, err := verify(p.idToken(t, map[string]interface{}{"nonce": "n1"}))
+	if err != nil || claims.Subject != "u1" || len(claims.Groups) != 1 || claims.Groups[0] != "staff" {
+		t.Fatalf("valid token: %+v, %v", claims, err)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	good := map[string]interface{}{"iss": p.URL, "aud": p.clientID, "sub": "u1", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n1"}
+	with := func(k string, v interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for key, value := range good {
+			claims[key] = value
+		}
+		claims[k] = v
+		return claims
+	}
+	header := map[string]string{"alg": "RS256", "kid": p.kid}
+	unsigned := signTestJWT(t, map[string]string{"alg": "none"}, good, p.key)
+	unsigned = unsigned[:strings.LastIndex(unsigned, ".")+1]
+	for name, token := range map[string]string{
+		"other key":          signTestJWT(t, header, good, otherKey),
+		"EC key, RSA header": signTestJWT(t, header, good, ecKey),
+		"alg none":           unsigned,
+		"unknown kid":        signTestJWT(t, map[string]string{"alg": "RS256", "kid": "key-2"}, good, p.key),
+		"wrong issuer":       signTestJWT(t, header, with("iss", "https://evil.example"), p.key),
+		"wrong audience":     signTestJWT(t, header, with("aud", []string{"other"}), p.key),
+		"expired":            signTestJWT(t, header, with("exp", time.Now().Add(-time.Hour).Unix()), p.key),
+		"wrong nonce":        signTestJWT(t, header, with("nonce", "n2"), p.key),
+		"no subject":         signTestJWT(t, header, with("sub", ""), p.key),
+	} {
+		if _, err := verify(token); !errors.Is(err, errInvalidIDToken) {
+			t.Errorf("%s: %v, want errInvalidIDToken", name, err)
+		}
+	}
+
+	// After a key rotation, the new key is fetched
+	p.mu.Lock()
+	p.key, p.kid = otherKey, "key-2"
+	p.mu.Unlock()
+	provider.keysFetched = time.Time{}
+	if _, err := verify(p.idToken(t, map[string]interface{}{"nonce": "n1"})); err != nil {
+		t.Errorf("token of the rotated key: %v", err)
+	}
+}
+
+func TestJSONWebKeyEC(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk := jsonWebKey{Kty: "EC", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		Y: base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))}
+	key, err := jwk.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestJWT(t, map[string]string{"alg": "ES256"}, map[string]interface{}{"sub": "u1"}, ecKey)
+	parts := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := verifyJWTSignature("ES256", crypto.SHA256, key, parts[0]+"."+parts[1], signature); err != nil {
+		t.Errorf("ES256 signature: %v", err)
+	}
+	if err := verifyJWTSignature("RS256", crypto.SHA256, key, parts[0]+"."+parts[1], signature); err == nil {
+		t.Error("ES256 signature accepted as RS256")
+	}
+}
+
+func TestRoleForGroups(t *testing.T) {
+	config := oidcConfig{GroupRoles: map[string]string{"notex-admins": oidcRoleAdmin, "staff": oidcRoleUser}}
+	for _, tt := range []struct {
+		groups []string
+		role   string
+		ok     bool
+	}{
+		{[]string{"staff"}, oidcRoleUser, true},
+		{[]string{"staff", "notex-admins"}, oidcRoleAdmin, true},
+		{[]string{"contractors"}, "", false},
+		{nil, "", false},
+	} {
+		if role, ok := config.roleForGroups(tt.groups); role != tt.role || ok != tt.ok {
+			t.Errorf("roleForGroups(%v) = %q, %v, want %q, %v", tt.groups, role, ok, tt.role, tt.ok)
+		}
+	}
+	if role, ok := (oidcConfig{}).roleForGroups(nil); role != oidcRoleUser || !ok {
+		t.Errorf("without a mapping: %q, %v, want user", role, ok)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	for _, tt := range []struct {
+		claims idTokenClaims
+		want   string
+	}{
+		{idTokenClaims{PreferredUsername: "Alice.Smith", Email: "a@example.com"}, "alice.smith"},
+		{idTokenClaims{PreferredUsername: "Ω", Email: "bob+notes@example.com"}, "bob-notes"},
+		{idTokenClaims{Subject: "248289761001"}, "user-248289761001"},
+	} {
+		if got := oidcUsername(tt.claims); got != tt.want {
+			t.Errorf("oidcUsername(%+v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
+
+// setOIDCEnv configures single sign-on with p
+func setOIDCEnv(t *testing.T, p *testProvider) {
+	t.Setenv("OIDC_ISSUER", p.URL)
+	t.Setenv("OIDC_CLIENT_ID", p.clientID)
+	t.Setenv("OIDC_CLIENT_SECRET", "s3cret")
+	t.Setenv("OIDC_GROUP_ROLES", "notex-admins=admin,staff=user")
+	t.Setenv("OIDC_NAME", "Example SSO")
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	p := newTestProvider(t)
+	setOIDCEnv(t, p)
+	p.signIn(map[string]interface{}{"sub": "u1"})
+
+	// The login redirects to the provider with a PKCE challenge
+	rec := httptest.NewRecorder()
+	handleOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "http://notex.test/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), p.URL+"/authorize?") {
+		t.Fatalf("login: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookie := rec.Result().Cookies()[0]
+	value, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	var login oidcLogin
+	if err := json.Unmarshal(value, &login); err != nil {
+		t.Fatal(err)
+	}
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	if callback.Path != "/auth/oidc/callback" || callback.Query().Get("state") != login.State {
+		t.Fatalf("provider redirect: %q", callback)
+	}
+
+	config, _ := oidcConfigFromEnv()
+	provider, err := discoverOIDC(context.Background(), p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := callback.Query().Get("code")
+	if _, err := exchangeOIDCCode(context.Background(), config, provider, code, "http://notex.test/auth/oidc/callback", oidcLogin{Verifier: "guessed", Nonce: login.Nonce}); err == nil {
+		t.Error("exchange with the wrong PKCE verifier succeeded")
+	}
+
+	// A second authorization, now redeemed with the right verifier
+	resp, err = noRedirects.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+	claims, err := exchangeOIDCCode(context.Background(), config, provider, callback.Query().Get("code"), "http://notex.test/auth/oidc/callback", login)
+	if err != nil || claims.Subject != "u1" {
+		t.Errorf("exchange: %+v, %v", claims, err)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	p := newTestProvider(t)
+	setOIDCEnv(t, p)
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	// signIn goes through the whole flow in a new browser, and returns the
+	// final status and page
+	signIn := func(claims map[string]interface{}) (int, string) {
+		t.Helper()
+		p.signIn(claims)
+		jar, _ := cookiejar.New(nil)
+		resp, err := (&http.Client{Jar: jar}).Get(server.URL + "/auth/oidc/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		fmt.Fprint(&body, resp.Request.URL.Path, "\n")
+		buf := make([]byte, 64<<10)
+		n, _ := resp.Body.Read(buf)
+		body.Write(buf[:n])
+		return resp.StatusCode, body.String()
+	}
+
+	// A new admin is created on their first sign-in
+	status, page := signIn(map[string]interface{}{"sub": "u1", "preferred_username": "alice", "groups": []string{"staff", "notex-admins"}})
+	if status != http.StatusOK || !strings.HasPrefix(page, "/\n") {
+		t.Fatalf("first sign-in: status %d, page %.200s", status, page)
+	}
+	alice, err := GetUserByOIDC(p.URL, "u1")
+	if err != nil || alice.Username != "alice" || !alice.Admin || alice.PasswordHash != "" {
+		t.Fatalf("provisioned user: %+v, %v", alice, err)
+	}
+	if _, err := Authenticate("alice", ""); err != errInvalidLogin {
+		t.Errorf("password sign-in of an SSO user: %v, want errInvalidLogin", err)
+	}
+
+	// Leaving the admin group takes the admin role away
+	signIn(map[string]interface{}{"sub": "u1", "preferred_username": "alice", "groups": []string{"staff"}})
+	if alice, _ = GetUserByOIDC(p.URL, "u1"); alice.Admin {
+		t.Error("still an admin after leaving notex-admins")
+	}
+
+	// Another user with the same preferred username gets a new account
+	signIn(map[string]interface{}{"sub": "u2", "preferred_username": "alice", "groups": "staff"})
+	if other, err := GetUserByOIDC(p.URL, "u2"); err != nil || other.Username != "alice-2" {
+		t.Errorf("second alice: %+v, %v", other, err)
+	}
+
+	// Users in none of the mapped groups are turned away
+	if status, _ := signIn(map[string]interface{}{"sub": "u3", "groups": []string{"contractors"}}); status != http.StatusForbidden {
+		t.Errorf("unmapped group: status %d, want 403", status)
+	}
+	if _, err := GetUserByOIDC(p.URL, "u3"); err == nil {
+		t.Error("user of an unmapped group was created")
+	}
+
+	// A callback without the sign-in's state is refused
+	resp, err := http.Get(server.URL + "/auth/oidc/callback?code=x&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged callback: status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- Access Policy ---
+//
+// Notes, their settings and shares belong to a workspace. What a member
+// may do there depends on their role, and is decided here only: routes
+// declare the Permission they need with requirePermission, and handlers
+// changing memberships ask authorizeMemberChange. Requests work in the
+// current workspace, chosen with the X-Workspace header (for API
+// clients) or the workspace cookie, defaulting to the user's personal
+// workspace.
+
+// Role is a member's role in a workspace
+type Role string
+
+// Workspace roles, each allowed everything the ones before it are
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+// workspaceRoles lists the roles in increasing order of power
+var workspaceRoles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+// rank returns the position of the role in workspaceRoles, -1 if unknown
+func (r Role) rank() int {
+	for i, role := range workspaceRoles {
+		if role == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseRole returns the role named s
+func parseRole(s string) (Role, bool) {
+	role := Role(s)
+	return role, role.rank() >= 0
+}
+
+// Permission is something a member may be allowed to do in a workspace
+type Permission string
+
+// Permissions, with the least role they need in permissionRoles
+const (
+	PermViewNotes     Permission = "view-notes"     // Read notes, their reports, settings and members
+	PermEditNotes     Permission = "edit-notes"     // Upload, edit, delete, re-check and share notes
+	PermEditSettings  Permission = "edit-settings"  // Change the dictionary and disabled rules
+	PermManageMembers Permission = "manage-members" // Invite members, change their roles, remove them
+)
+
+// permissionRoles maps each permission to the least role that has it
+var permissionRoles = map[Permission]Role{
+	PermViewNotes:     RoleViewer,
+	PermEditNotes:     RoleEditor,
+	PermEditSettings:  RoleEditor,
+	PermManageMembers: RoleAdmin,
+}
+
+// permissionLabels describes the permissions in error messages
+var permissionLabels = map[Permission]string{
+	PermViewNotes:     "view notes",
+	PermEditNotes:     "change notes",
+	PermEditSettings:  "change the grammar settings",
+	PermManageMembers: "manage members",
+}
+
+// Allows reports whether the role has permission
+func (r Role) Allows(permission Permission) bool {
+	least, ok := permissionRoles[permission]
+	return ok && r.rank() >= least.rank()
+}
+
+// Access is what a user may do in a workspace: their role there, empty
+// for non-members
+type Access struct {
+	Workspace Workspace
+	Role      Role
+}
+
+// Can reports whether the access includes permission; templates use it
+// to hide controls, e.g. {{ if .Access.Can "edit-notes" }}
+func (a Access) Can(permission string) bool {
+	return a.Role.Allows(Permission(permission))
+}
+
+// accessTo returns the user's access to the workspace
+func accessTo(ws Workspace, userID primitive.ObjectID) Access {
+	access := Access{Workspace: ws}
+	if m, ok := ws.member(userID); ok {
+		access.Role = m.Role
+	}
+	return access
+}
+
+// member returns the membership of userID
+func (ws Workspace) member(userID primitive.ObjectID) (Member, bool) {
+	for _, m := range ws.Members {
+		if m.UserID == userID {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// Policy errors. A workspace the user isn't a member of is reported as
+// not found, as with notes of other workspaces.
+var (
+	errNotMember        = errors.New("workspace not found")
+	errNoSuchMember     = errors.New("member not found")
+	errLastAdmin        = errors.New("a workspace needs at least one admin")
+	errPersonalCreator  = errors.New("you can't leave your personal workspace or stop being its admin")
+	errAlreadyMember    = errors.New("already a member of the workspace")
+	errInvitationTarget = errors.New("invitation not found")
+)
+
+// PermissionError is returned for a member whose role lacks a permission
+type PermissionError struct {
+	Role       Role
+	Permission Permission
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%ss of this workspace can't %s", e.Role, permissionLabels[e.Permission])
+}
+
+// Authorize returns nil if the access includes permission
+func Authorize(access Access, permission Permission) error {
+	if access.Role == "" {
+		return errNotMember
+	}
+	if !access.Role.Allows(permission) {
+		return &PermissionError{Role: access.Role, Permission: permission}
+	}
+	return nil
+}
+
+// authorizeMemberChange checks that userID may be given newRole in the
+// access's workspace, or removed from it if newRole is empty. Members may
+// always leave; anything else needs PermManageMembers. Either way, the
+// workspace keeps an admin, and personal workspaces keep their creator.
+func authorizeMemberChange(access Access, actor, userID primitive.ObjectID, newRole Role) error {
+	if newRole != "" || actor != userID {
+		if err := Authorize(access, PermManageMembers); err != nil {
+			return err
+		}
+	} else if access.Role == "" {
+		return errNotMember
+	}
+
+	ws := access.Workspace
+	target, ok := ws.member(userID)
+	if !ok {
+		return errNoSuchMember
+	}
+	if ws.Personal && userID == ws.ID && newRole != RoleAdmin {
+		return errPersonalCreator
+	}
+	if target.Role == RoleAdmin && newRole != RoleAdmin {
+		admins := 0
+		for _, m := range ws.Members {
+			if m.Role == RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return errLastAdmin
+		}
+	}
+	return nil
+}
+
+// authorizeInvitation checks that the invitation is addressed to user
+func authorizeInvitation(user User, inv Invitation) error {
+	if inv.Username != user.Username {
+		return errInvitationTarget
+	}
+	return nil
+}
+
+// --- Current Workspace ---
+
+// workspaceCookieName is the cookie holding the current workspace
+const workspaceCookieName = "notex_workspace"
+
+type accessKey struct{}
+
+// currentAccess returns the user's access to the current workspace of a
+// request that went through requireWorkspace
+func currentAccess(r *http.Request) Access {
+	access, _ := r.Context().Value(accessKey{}).(Access)
+	return access
+}
+
+// currentWorkspace returns the ID of the current workspace
+func currentWorkspace(r *http.Request) primitive.ObjectID {
+	return currentAccess(r).Workspace.ID
+}
+
+// requireWorkspace finds the current workspace and the user's role
+// there, available to handlers through currentAccess. It must come after
+// requireUser. An X-Workspace header naming a workspace the user isn't a
+// member of is answered with 404; a stale cookie falls back to the
+// personal workspace.
+func requireWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		header := r.Header.Get("X-Workspace")
+		id := header
+		if id == "" {
+			if cookie, err := r.Cookie(workspaceCookieName); err == nil {
+				id = cookie.Value
+			}
+		}
+
+		access, err := workspaceAccess(user, id)
+		if err == errNotMember && header == "" {
+			access, err = workspaceAccess(user, "")
+		}
+		if err == errNotMember {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading workspace %q of %s: %v", id, user.Username, err)
+			http.Error(w, "Error loading workspace", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAccess(r.Context(), access)))
+	})
+}
+
+// withAccess adds the access to the current workspace to ctx
+func withAccess(ctx context.Context, access Access) context.Context {
+	return context.WithValue(ctx, accessKey{}, access)
+}
+
+// workspaceAccess returns the user's access to the workspace with the
+// given hex ID, or to their personal workspace if idHex is empty
+func workspaceAccess(user User, idHex string) (Access, error) {
+	if idHex == "" {
+		ws, err := EnsurePersonalWorkspace(user)
+		return accessTo(ws, user.ID), err
+	}
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return Access{}, errNotMember
+	}
+	ws, err := GetWorkspace(id)
+	if err == mongo.ErrNoDocuments {
+		return Access{}, errNotMember
+	}
+	if err != nil {
+		return Access{}, err
+	}
+	access := accessTo(ws, user.ID)
+	if access.Role == "" {
+		return Access{}, errNotMember
+	}
+	return access, nil
+}
+
+// requirePermission lets only members whose role has permission in the
+// current workspace through; it must come after requireWorkspace
+func requirePermission(permission Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := Authorize(currentAccess(r), permission); err != nil {
+				policyError(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// policyError answers a request the policy turned down
+func policyError(w http.ResponseWriter, err error) {
+	var permErr *PermissionError
+	switch {
+	case errors.As(err, &permErr):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+	case err == errNotMember || err == errNoSuchMember || err == errInvitationTarget:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// setWorkspaceCookie makes the workspace current for the browser; a nil
+// ID deletes the cookie
+func setWorkspaceCookie(w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	cookie := &http.Cookie{
+		Name:     workspaceCookieName,
+		Value:    id.Hex(),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if id.IsZero() {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
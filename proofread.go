@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	md "github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// textHighlight marks part of an ast.Text literal as (part of) an issue
+type textHighlight struct {
+	Start, End int  // Byte range in the text literal
+	Issue      int  // Index into the issues being highlighted
+	First      bool // The first part of the issue, which carries the popover
+}
+
+// RenderProofreadingHTML renders markdown like RenderMarkdownToHTML, with
+// the span of each issue wrapped in a <mark> colored by category. Hovering
+// or focusing the mark shows the issue's message and suggestions.
+//
+// Issue offsets are byte offsets into the markdown, while the renderer
+// only sees AST nodes. Text nodes are therefore located in the markdown
+// first (see locateTextNodes), and issues are mapped onto the text nodes
+// they overlap. An issue spanning formatting, such as "teh *cat*", gets
+// one mark per text node. Overlapping issues are highlighted once, for
+// the issue that starts first; issues that can't be located are only
+// listed in the issue panel.
+//
+// Unlike RenderMarkdownToHTML, whose output is only served sandboxed,
+// raw HTML in the markdown is escaped: the result is part of the app's
+// pages.
+func RenderProofreadingHTML(markdown string, issues []GrammarIssue) string {
+	doc := ParseMarkdown(markdown)
+	highlights := mapIssuesToText(doc, markdown, issues)
+
+	htmlFlags := html.CommonFlags | html.HrefTargetBlank // As in RenderMarkdownToHTML
+	smartypants := html.NewSmartypantsRenderer(htmlFlags)
+	opts := html.RendererOptions{
+		Flags: htmlFlags,
+		RenderNodeHook: func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+			switch n := node.(type) {
+			case *ast.HTMLSpan:
+				// The page is the app's own, so the note's raw HTML is
+				// shown as markup rather than rendered
+				html.EscapeHTML(w, n.Literal)
+				return ast.GoToNext, true
+			case *ast.HTMLBlock:
+				io.WriteString(w, "<pre class=\"raw-html\"><code>")
+				html.EscapeHTML(w, n.Literal)
+				io.WriteString(w, "</code></pre>\n")
+				return ast.GoToNext, true
+			case *ast.Text:
+				if len(highlights[n]) > 0 {
+					writeHighlightedText(w, smartypants, n.Literal, highlights[n], issues)
+					return ast.GoToNext, true
+				}
+			}
+			return ast.GoToNext, false
+		},
+	}
+
+	return string(md.Render(doc, html.NewRenderer(opts)))
+}
+
+// mapIssuesToText assigns the issues to the parts of the text nodes they
+// cover
+func mapIssuesToText(doc ast.Node, markdown string, issues []GrammarIssue) map[*ast.Text][]textHighlight {
+	texts, offsets := locateTextNodes(doc, markdown)
+
+	// Highlight in order of offset, skipping issues that overlap one
+	// already highlighted
+	order := make([]int, 0, len(issues))
+	for i, issue := range issues {
+		if issue.Length > 0 && issue.Offset >= 0 && issue.Offset+issue.Length <= len(markdown) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return issues[order[a]].Offset < issues[order[b]].Offset })
+
+	highlights := map[*ast.Text][]textHighlight{}
+	covered := 0 // End of the last highlighted issue
+	for _, i := range order {
+		start, end := issues[i].Offset, issues[i].Offset+issues[i].Length
+		if start < covered {
+			continue
+		}
+
+		first := true
+		for j, text := range texts {
+			textStart := offsets[j]
+			textEnd := textStart + len(text.Literal)
+			if textStart < 0 || textEnd <= start || textStart >= end {
+				continue
+			}
+			highlights[text] = append(highlights[text], textHighlight{
+				Start: max(start, textStart) - textStart,
+				End:   min(end, textEnd) - textStart,
+				Issue: i,
+				First: first,
+			})
+			first = false
+		}
+		if !first {
+			covered = end
+		}
+	}
+	return highlights
+}
+
+// locateTextNodes returns the text nodes of the document in order, with
+// the byte offset of each literal in the markdown (-1 if not found).
+//
+// Literals are searched for in document order, each after the previous
+// one. Code and raw HTML are searched for too, so that their content
+// can't be mistaken for a later text node. Text that differs from its
+// source, e.g. because of backslash escapes, is not found and left
+// unhighlighted.
+func locateTextNodes(doc ast.Node, markdown string) ([]*ast.Text, []int) {
+	var texts []*ast.Text
+	var offsets []int
+	cursor := 0
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		var literal []byte
+		switch n := node.(type) {
+		case *ast.Text:
+			literal = n.Literal
+		case *ast.Code, *ast.CodeBlock, *ast.HTMLSpan, *ast.HTMLBlock:
+			literal = n.AsLeaf().Literal
+		default:
+			return ast.GoToNext
+		}
+
+		offset := -1
+		if len(literal) > 0 {
+			if i := strings.Index(markdown[cursor:], string(literal)); i >= 0 {
+				offset = cursor + i
+				cursor = offset + len(literal)
+			}
+		}
+		if text, ok := node.(*ast.Text); ok {
+			texts = append(texts, text)
+			offsets = append(offsets, offset)
+		}
+		return ast.GoToNext
+	})
+	return texts, offsets
+}
+
+// writeHighlightedText writes a text literal the way the HTML renderer
+// does, with the highlighted parts wrapped in marks
+func writeHighlightedText(w io.Writer, smartypants *html.SPRenderer, literal []byte, highlights []textHighlight, issues []GrammarIssue) {
+	// Escaping and smart punctuation must see the whole text at once
+	// (quotes are paired up), so highlights are inserted as placeholders
+	// that survive both and are replaced afterwards
+	var marked bytes.Buffer
+	last := 0
+	for i, h := range highlights {
+		marked.Write(literal[last:h.Start])
+		fmt.Fprintf(&marked, "\x00%d\x01", i)
+		marked.Write(literal[h.Start:h.End])
+		marked.WriteString("\x00\x01")
+		last = h.End
+	}
+	marked.Write(literal[last:])
+
+	var escaped, rendered bytes.Buffer
+	html.EscapeHTML(&escaped, marked.Bytes())
+	smartypants.Process(&rendered, escaped.Bytes())
+
+	out := rendered.String()
+	for i, h := range highlights {
+		out = strings.Replace(out, fmt.Sprintf("\x00%d\x01", i), highlightOpenTag(issues[h.Issue], h), 1)
+	}
+	out = strings.ReplaceAll(out, "\x00\x01", "</mark>")
+	io.WriteString(w, out)
+}
+
+// highlightOpenTag returns the opening <mark> of a highlight, followed by
+// the popover for the first part of an issue
+func highlightOpenTag(issue GrammarIssue, h textHighlight) string {
+	category := issue.Category
+	if !isIssueCategory(category) {
+		category = "other"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<mark class="issue-highlight issue-category-%s severity-%s" tabindex="0">`,
+		category, classToken(issue.Severity))
+	if !h.First {
+		return b.String()
+	}
+
+	b.WriteString(`<span class="issue-popover" role="tooltip">`)
+	fmt.Fprintf(&b, `<span class="issue-popover-category">%s</span>`, category)
+	fmt.Fprintf(&b, `<strong>%s</strong>`, escapeText(issue.Message))
+	if len(issue.Suggestions) > 0 {
+		b.WriteString(`<span class="issue-popover-suggestions">`)
+		for i, s := range issue.Suggestions {
+			if i == 5 {
+				break
+			}
+			fmt.Fprintf(&b, `<span>%s</span>`, escapeText(s))
+		}
+		b.WriteString(`</span>`)
+	}
+	if issue.RuleID != "" {
+		fmt.Fprintf(&b, `<small>%s</small>`, escapeText(issue.RuleID))
+	}
+	b.WriteString(`</span>`)
+	return b.String()
+}
+
+// escapeText escapes s for use in HTML text
+func escapeText(s string) string {
+	var b bytes.Buffer
+	html.EscapeHTML(&b, []byte(s))
+	return b.String()
+}
+
+// classToken keeps only the characters of s allowed in the class names
+// used here
+func classToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gomarkdown/markdown/html"
+)
+
+func TestMapIssuesToText(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		issues   [][2]int // Offset and length of each issue
+		want     []string // Highlighted text, with the issue index and "*" on first parts
+	}{
+		{"plain text", "I saw teh cat.", [][2]int{{6, 3}}, []string{"teh#0*"}},
+		{"multi-byte text before", "Café: teh cat.", [][2]int{{7, 3}}, []string{"teh#0*"}},
+		{"after formatting", "Some **bold** and teh end.", [][2]int{{18, 3}}, []string{"teh#0*"}},
+		{"across formatting", "teh *cat* sat", [][2]int{{0, 8}}, []string{"teh #0*", "cat#0"}},
+		{"heading and list", "# Teh title\n\n- one teh\n", [][2]int{{2, 3}, {19, 3}}, []string{"Teh#0*", "teh#1*"}},
+		{"two in one text", "teh and teh", [][2]int{{8, 3}, {0, 3}}, []string{"teh#1*", "teh#0*"}},
+		{"overlapping", "a big teh cat", [][2]int{{2, 7}, {6, 3}, {8, 5}}, []string{"big teh#0*"}},
+		{"same start", "teh cat", [][2]int{{0, 3}, {0, 7}}, []string{"teh#0*"}},
+		{"in code", "`teh` and teh", [][2]int{{1, 3}, {10, 3}}, []string{"teh#1*"}},
+		{"same text in raw html", "<b title=\"teh\">teh</b>", [][2]int{{10, 3}, {15, 3}}, []string{"teh#1*"}},
+		{"out of range", "teh", [][2]int{{-1, 3}, {2, 5}, {0, 0}}, nil},
+	}
+	for _, tt := range tests {
+		issues := make([]GrammarIssue, len(tt.issues))
+		for i, span := range tt.issues {
+			issues[i] = GrammarIssue{Offset: span[0], Length: span[1]}
+		}
+		doc := ParseMarkdown(tt.markdown)
+		highlights := mapIssuesToText(doc, tt.markdown, issues)
+
+		var got []string
+		texts, _ := locateTextNodes(doc, tt.markdown)
+		for _, text := range texts {
+			for _, h := range highlights[text] {
+				first := ""
+				if h.First {
+					first = "*"
+				}
+				got = append(got, fmt.Sprintf("%s#%d%s", text.Literal[h.Start:h.End], h.Issue, first))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteHighlightedText(t *testing.T) {
+	issues := []GrammarIssue{
+		{Message: "Use <em> & \"quotes\"", Category: CategorySpelling, Severity: "error", Suggestions: []string{"<x>"}, RuleID: "R&D"},
+		{Message: "Second", Category: "bogus", Severity: "warn ing\"><script>"},
+	}
+	tests := []struct {
+		name       string
+		literal    string
+		highlights []textHighlight
+		want       string
+	}{
+		{
+			name:       "escaped span",
+			literal:    "a <b> & c",
+			highlights: []textHighlight{{Start: 2, End: 5, Issue: 0, First: true}},
+			want: `a <mark class="issue-highlight issue-category-spelling severity-error" tabindex="0">` +
+				`<span class="issue-popover" role="tooltip"><span class="issue-popover-category">spelling</span>` +
+				`<strong>Use &lt;em&gt; &amp; &quot;quotes&quot;</strong>` +
+				`<span class="issue-popover-suggestions"><span>&lt;x&gt;</span></span><small>R&amp;D</small></span>` +
+				`&lt;b&gt;</mark> &amp; c`,
+		},
+		{
+			name:       "continued part without popover",
+			literal:    "cat",
+			highlights: []textHighlight{{Start: 0, End: 3, Issue: 1}},
+			want:       `<mark class="issue-highlight issue-category-other severity-warningscript" tabindex="0">cat</mark>`,
+		},
+		{
+			// Quotes are paired across the highlight
+			name:       "smart quotes",
+			literal:    `say "hi" now`,
+			highlights: []textHighlight{{Start: 5, End: 7, Issue: 1}},
+			want:       `say &ldquo;<mark class="issue-highlight issue-category-other severity-warningscript" tabindex="0">hi</mark>&rdquo; now`,
+		},
+	}
+	smartypants := html.NewSmartypantsRenderer(html.CommonFlags)
+	for _, tt := range tests {
+		var b strings.Builder
+		writeHighlightedText(&b, smartypants, []byte(tt.literal), tt.highlights, issues)
+		if b.String() != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestRenderProofreadingHTMLEscapesRawHTML(t *testing.T) {
+	for _, markdown := range []string{
+		`Hi </div><div hx-post="/notes/x" hx-trigger="load">x</div> teh end`,
+		"<div hx-get=\"/x\" hx-trigger=\"load\">\n</div>\n\nteh <img src=x onerror=alert(1)>",
+	} {
+		out := RenderProofreadingHTML(markdown, []GrammarIssue{{Offset: strings.Index(markdown, "teh"), Length: 3, Message: "typo"}})
+		for _, raw := range []string{"<div", "</div", "<img", `hx-get="`, `hx-post="`, `hx-trigger="`} {
+			if strings.Contains(out, raw) {
+				t.Errorf("%q rendered with raw %q: %s", markdown, raw, out)
+			}
+		}
+		if !strings.Contains(out, "&lt;div hx-") || !strings.Contains(out, "teh</mark>") {
+			t.Errorf("%q: markup not shown escaped, or typo not highlighted: %s", markdown, out)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// wordsPerMinute is the reading speed used for ReadingTimeSeconds
+const wordsPerMinute = 230
+
+// sentenceLengthBuckets are the upper bounds (in words) of the sentence
+// length histogram; the last bucket is open-ended
+var sentenceLengthBuckets = []int{10, 20, 30, 40}
+
+// Writing-quality heuristics below are tuned for English. They still give
+// word counts and reading times for other languages, but the readability
+// formulas, passive voice and adverb detection are English-specific.
+
+var (
+	sentenceEndPattern = regexp.MustCompile(`[.!?]+["')\]]*(\s+|$)|\n{2,}`)
+	statsWordPattern   = regexp.MustCompile(`\p{L}[\p{L}\p{N}'’-]*|\p{N}+(?:[.,]\p{N}+)*`)
+	vowelGroupPattern  = regexp.MustCompile(`[aeiouy]+`)
+)
+
+// beVerbs are the forms of "to be" that start a passive construction
+var beVerbs = map[string]bool{
+	"am": true, "is": true, "are": true, "was": true, "were": true,
+	"be": true, "been": true, "being": true, "isn't": true, "aren't": true,
+	"wasn't": true, "weren't": true,
+}
+
+// irregularParticiples are common past participles not ending in "-ed"
+var irregularParticiples = map[string]bool{
+	"begun": true, "broken": true, "brought": true, "built": true, "bought": true,
+	"caught": true, "chosen": true, "done": true, "drawn": true, "driven": true,
+	"eaten": true, "fallen": true, "felt": true, "found": true, "forgotten": true,
+	"given": true, "gone": true, "grown": true, "heard": true, "held": true,
+	"hidden": true, "kept": true, "known": true, "laid": true, "led": true,
+	"left": true, "lost": true, "made": true, "meant": true, "met": true,
+	"paid": true, "put": true, "read": true, "run": true, "said": true,
+	"seen": true, "sent": true, "set": true, "shown": true, "shut": true,
+	"sold": true, "spent": true, "spoken": true, "stolen": true, "taken": true,
+	"taught": true, "thought": true, "thrown": true, "told": true, "understood": true,
+	"won": true, "worn": true, "written": true,
+}
+
+// notAdverbs are common "-ly" words that are not adverbs
+var notAdverbs = map[string]bool{
+	"ally": true, "apply": true, "belly": true, "bully": true, "family": true,
+	"fly": true, "friendly": true, "holy": true, "italy": true, "jelly": true,
+	"july": true, "lonely": true, "lovely": true, "only": true, "rely": true,
+	"reply": true, "silly": true, "supply": true, "ugly": true, "anomaly": true,
+	"assembly": true, "butterfly": true, "comply": true, "costly": true,
+	"curly": true, "early": true, "elderly": true, "likely": true, "multiply": true,
+	"lily": true, "monopoly": true, "rally": true, "imply": true, "orderly": true,
+}
+
+// stopWords are left out of the repeated-word ranking
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "can": true, "do": true, "for": true,
+	"from": true, "has": true, "have": true, "he": true, "her": true, "his": true,
+	"i": true, "if": true, "in": true, "into": true, "is": true, "it": true,
+	"its": true, "not": true, "of": true, "on": true, "or": true, "our": true,
+	"she": true, "so": true, "that": true, "the": true, "their": true, "them": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true,
+	"to": true, "was": true, "we": true, "were": true, "what": true, "when": true,
+	"which": true, "who": true, "will": true, "with": true, "would": true,
+	"you": true, "your": true,
+}
+
+// ComputeNoteStats computes the writing statistics of a markdown note.
+// Code, raw HTML and link targets are left out; headings and list items
+// count as sentences of their own.
+func ComputeNoteStats(markdown string) NoteStats {
+	text := markdownPlainText(ParseMarkdown(markdown))
+
+	var stats NoteStats
+	var syllables, letters, complexWords, passive, adverbs int
+	frequency := map[string]int{}
+	doubled := map[string]bool{}
+
+	stats.SentenceLengths = make([]SentenceLengthBucket, len(sentenceLengthBuckets)+1)
+	for i, limit := range sentenceLengthBuckets {
+		stats.SentenceLengths[i].MaxWords = limit
+	}
+
+	for _, sentence := range splitSentencesForStats(text) {
+		words := statsWordPattern.FindAllString(sentence, -1)
+		if len(words) == 0 {
+			continue
+		}
+		stats.SentenceCount++
+		stats.WordCount += len(words)
+		stats.SentenceLengths[sentenceBucket(len(words))].Count++
+
+		sentencePassive := false
+		for i, word := range words {
+			lower := strings.ToLower(strings.ReplaceAll(word, "’", "'"))
+			n := countSyllables(lower)
+			syllables += n
+			if n >= 3 && !strings.Contains(lower, "-") {
+				complexWords++
+			}
+			for _, r := range lower {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					letters++
+				}
+			}
+
+			if isAdverb(lower) {
+				adverbs++
+			}
+			if i+1 < len(words) && beVerbs[lower] && isPassiveFollower(words[i+1:]) {
+				sentencePassive = true
+			}
+			if i > 0 && strings.EqualFold(words[i-1], word) && unicode.IsLetter([]rune(lower)[0]) {
+				doubled[lower] = true
+			}
+			if !stopWords[lower] && len(lower) > 2 {
+				frequency[lower]++
+			}
+		}
+		if sentencePassive {
+			passive++
+		}
+	}
+
+	if stats.WordCount == 0 {
+		return stats
+	}
+
+	words := float64(stats.WordCount)
+	sentences := float64(stats.SentenceCount)
+	stats.ReadingTimeSeconds = int(math.Ceil(words / wordsPerMinute * 60))
+	stats.AvgSentenceLength = round1(words / sentences)
+	stats.FleschReadingEase = round1(206.835 - 1.015*(words/sentences) - 84.6*(float64(syllables)/words))
+	stats.FleschKincaidGrade = round1(0.39*(words/sentences) + 11.8*(float64(syllables)/words) - 15.59)
+	stats.GunningFog = round1(0.4 * ((words / sentences) + 100*(float64(complexWords)/words)))
+	stats.ColemanLiau = round1(0.0588*(float64(letters)/words*100) - 0.296*(sentences/words*100) - 15.8)
+	stats.AutomatedReadability = round1(4.71*(float64(letters)/words) + 0.5*(words/sentences) - 21.43)
+	stats.PassiveVoicePercent = round1(float64(passive) / sentences * 100)
+	stats.AdverbPercent = round1(float64(adverbs) / words * 100)
+	stats.RepeatedWords = topRepeatedWords(frequency, 5)
+	for word := range doubled {
+		stats.DoubledWords = append(stats.DoubledWords, word)
+	}
+	sort.Strings(stats.DoubledWords)
+
+	return stats
+}
+
+// markdownPlainText collects the prose of a markdown AST. Blocks are
+// separated by blank lines so they end sentences.
+func markdownPlainText(doc ast.Node) string {
+	var b strings.Builder
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch n := node.(type) {
+		case *ast.CodeBlock, *ast.HTMLBlock, *ast.Code, *ast.HTMLSpan, *ast.Math, *ast.MathBlock:
+			return ast.SkipChildren
+		case *ast.Text:
+			b.Write(n.Literal)
+		case *ast.Softbreak, *ast.Hardbreak:
+			b.WriteByte(' ')
+		case *ast.Paragraph, *ast.Heading, *ast.ListItem, *ast.TableCell, *ast.BlockQuote:
+			if !entering {
+				b.WriteString("\n\n")
+			}
+		}
+		return ast.GoToNext
+	})
+	return b.String()
+}
+
+// splitSentencesForStats splits plain text on sentence-ending punctuation
+// and blank lines
+func splitSentencesForStats(text string) []string {
+	var sentences []string
+	start := 0
+	for _, loc := range sentenceEndPattern.FindAllStringIndex(text, -1) {
+		sentences = append(sentences, text[start:loc[1]])
+		start = loc[1]
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
+
+// sentenceBucket returns the histogram bucket for a sentence length
+func sentenceBucket(words int) int {
+	for i, limit := range sentenceLengthBuckets {
+		if words <= limit {
+			return i
+		}
+	}
+	return len(sentenceLengthBuckets)
+}
+
+// countSyllables estimates the syllables of a lowercase English word by
+// counting vowel groups, ignoring a silent final "e"
+func countSyllables(word string) int {
+	word = strings.Trim(word, "'’-")
+	if word == "" || !unicode.IsLetter([]rune(word)[0]) {
+		return 1 // Numbers are read as one unit
+	}
+	count := len(vowelGroupPattern.FindAllString(word, -1))
+	if strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le") && count > 1 {
+		count--
+	}
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+// isAdverb guesses whether a lowercase word is an "-ly" adverb
+func isAdverb(word string) bool {
+	return len(word) > 4 && strings.HasSuffix(word, "ly") && !notAdverbs[word]
+}
+
+// isPassiveFollower reports whether the words after a form of "to be"
+// make a passive construction: a past participle, optionally after an adverb
+func isPassiveFollower(rest []string) bool {
+	for i, word := range rest {
+		if i > 1 {
+			break
+		}
+		lower := strings.ToLower(word)
+		if (strings.HasSuffix(lower, "ed") && len(lower) > 3) || irregularParticiples[lower] {
+			return true
+		}
+		if !isAdverb(lower) && lower != "not" {
+			break
+		}
+	}
+	return false
+}
+
+// topRepeatedWords returns the n most frequent words used at least 3 times
+func topRepeatedWords(frequency map[string]int, n int) []WordFrequency {
+	var repeated []WordFrequency
+	for word, count := range frequency {
+		if count >= 3 {
+			repeated = append(repeated, WordFrequency{Word: word, Count: count})
+		}
+	}
+	sort.Slice(repeated, func(i, j int) bool {
+		if repeated[i].Count != repeated[j].Count {
+			return repeated[i].Count > repeated[j].Count
+		}
+		return repeated[i].Word < repeated[j].Word
+	})
+	if len(repeated) > n {
+		repeated = repeated[:n]
+	}
+	return repeated
+}
+
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCountSyllables(t *testing.T) {
+	tests := []struct {
+		word string
+		want int
+	}{
+		{"cat", 1},
+		{"make", 1},  // Silent final e
+		{"table", 2}, // But not in "-le"
+		{"happy", 2}, // y is a vowel
+		{"queue", 1}, // One vowel group
+		{"beautiful", 3},
+		{"education", 4},
+		{"don't", 1},
+		{"well-known", 2},
+		{"42", 1}, // Numbers are one unit
+		{"", 1},
+	}
+	for _, tt := range tests {
+		if got := countSyllables(tt.word); got != tt.want {
+			t.Errorf("countSyllables(%q) = %d, want %d", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestSplitSentencesForStats(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"One. Two! Three?", []string{"One. ", "Two! ", "Three?"}},
+		{"Wait... what?! Yes", []string{"Wait... ", "what?! ", "Yes"}},
+		{`He said "hi." Then left.`, []string{`He said "hi." `, "Then left."}},
+		{"Version 1.2 is out.", []string{"Version 1.2 is out."}},
+		{"Heading\n\nParagraph", []string{"Heading\n\n", "Paragraph"}},
+	}
+	for _, tt := range tests {
+		if got := splitSentencesForStats(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSentencesForStats(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestComputeNoteStats(t *testing.T) {
+	// Expected scores follow from the published formulas with the counts
+	// given in each case's comment
+	tests := []struct {
+		name     string
+		markdown string
+		want     NoteStats // Only the fields below are compared
+	}{
+		{
+			// 6 words, 1 sentence, 6 syllables, 17 letters, no complex words
+			name:     "one simple sentence",
+			markdown: "The cat sat on the mat.",
+			want: NoteStats{
+				WordCount: 6, SentenceCount: 1, ReadingTimeSeconds: 2, AvgSentenceLength: 6,
+				FleschReadingEase: 116.1, FleschKincaidGrade: -1.4, GunningFog: 2.4,
+				ColemanLiau: -4.1, AutomatedReadability: -5.1,
+			},
+		},
+		{
+			// 3 words, 1 sentence, 8 syllables, 20 letters, 2 complex words
+			name:     "long words",
+			markdown: "Education is beautiful.",
+			want: NoteStats{
+				WordCount: 3, SentenceCount: 1, ReadingTimeSeconds: 1, AvgSentenceLength: 3,
+				FleschReadingEase: -21.8, FleschKincaidGrade: 17, GunningFog: 27.9,
+				ColemanLiau: 13.5, AutomatedReadability: 11.5,
+			},
+		},
+		{
+			// Code is left out; the heading is a sentence of its own.
+			// 6 words, 2 sentences, 6 syllables, 17 letters
+			name:     "markdown structure",
+			markdown: "# Cats\n\nI like cake a lot.\n\n```go\nfunc main() {}\n```\n",
+			want: NoteStats{
+				WordCount: 6, SentenceCount: 2, ReadingTimeSeconds: 2, AvgSentenceLength: 3,
+				FleschReadingEase: 119.2, FleschKincaidGrade: -2.6, GunningFog: 1.2,
+				ColemanLiau: -9, AutomatedReadability: -6.6,
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := ComputeNoteStats(tt.markdown)
+		got.SentenceLengths, got.PassiveVoicePercent, got.AdverbPercent, got.RepeatedWords, got.DoubledWords = nil, 0, 0, nil, nil
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComputeNoteStatsEmpty(t *testing.T) {
+	for _, markdown := range []string{"", "\n\n", "```\nonly code\n```"} {
+		stats := ComputeNoteStats(markdown)
+		scores := []float64{stats.AvgSentenceLength, stats.FleschReadingEase, stats.FleschKincaidGrade, stats.GunningFog,
+			stats.ColemanLiau, stats.AutomatedReadability, stats.PassiveVoicePercent, stats.AdverbPercent}
+		for _, score := range scores {
+			if score != 0 || math.IsNaN(score) {
+				t.Errorf("ComputeNoteStats(%q) = %+v, want zero scores", markdown, stats)
+				break
+			}
+		}
+		if stats.WordCount != 0 || stats.SentenceCount != 0 || stats.ReadingTimeSeconds != 0 {
+			t.Errorf("ComputeNoteStats(%q) counts %d words in %d sentences", markdown, stats.WordCount, stats.SentenceCount)
+		}
+	}
+}
+
+func TestComputeNoteStatsStyle(t *testing.T) {
+	stats := ComputeNoteStats("The ball was thrown by him. He threw it really quickly. The the cat is not finished. " +
+		"Cats cats cats love food food food food.")
+	if stats.PassiveVoicePercent != 50 {
+		t.Errorf("passive voice = %v%%, want 50%% (2 of 4 sentences)", stats.PassiveVoicePercent)
+	}
+	if stats.AdverbPercent != 8 {
+		t.Errorf("adverbs = %v%%, want 8%% (2 of 25 words)", stats.AdverbPercent)
+	}
+	if want := []string{"cats", "food", "the"}; !reflect.DeepEqual(stats.DoubledWords, want) {
+		t.Errorf("doubled words = %q, want %q", stats.DoubledWords, want)
+	}
+	if want := []WordFrequency{{"food", 4}, {"cats", 3}}; !reflect.DeepEqual(stats.RepeatedWords, want) {
+		t.Errorf("repeated words = %+v, want %+v", stats.RepeatedWords, want)
+	}
+	wantBuckets := []SentenceLengthBucket{{MaxWords: 10, Count: 4}, {MaxWords: 20}, {MaxWords: 30}, {MaxWords: 40}, {}}
+	if !reflect.DeepEqual(stats.SentenceLengths, wantBuckets) {
+		t.Errorf("sentence lengths = %+v, want %+v", stats.SentenceLengths, wantBuckets)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CheckNote runs the grammar check, the markdown lint and the writing
+// statistics on a note's markdown and stores the results on the note.
+// A failed grammar check is also recorded as an issue, so the lint and
+// statistics are still saved.
+func CheckNote(ctx context.Context, note *Note, settings GrammarSettings, knownFiles map[string]bool) error {
+	opts := settings.CheckOptions(note.Language)
+
+	grammar, err := CheckGrammar(ctx, note.MarkdownContent, opts)
+	if err != nil {
+		grammar.Issues = append(grammar.Issues, GrammarIssue{Message: "Grammar check process failed: " + err.Error()})
+	}
+
+	// Lint the markdown itself, reported alongside the grammar issues
+	grammar.Issues = append(grammar.Issues, LintMarkdown(note.MarkdownContent, LintOptions{
+		Check:      opts,
+		KnownFiles: knownFiles,
+	})...)
+	sortIssues(grammar.Issues)
+
+	note.GrammarIssues = grammar.Issues
+	note.DetectedLanguage = grammar.DetectedLanguage
+	note.LanguageConfidence = grammar.LanguageConfidence
+	note.GrammarIncomplete = grammar.Incomplete
+	note.CheckerVersion = grammar.CheckerVersion
+	note.CheckedAt = time.Now()
+	note.Stats = ComputeNoteStats(note.MarkdownContent)
+	return err
+}
+
+// RecheckProgress reports on a bulk re-check of all notes
+type RecheckProgress struct {
+	Running    bool
+	Total      int // Notes to check
+	Done       int // Notes checked so far, including failures
+	Failed     int // Notes whose grammar check or save failed
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Err        string // Why the re-check stopped early, if it did
+}
+
+// Percent returns how much of the re-check is done, from 0 to 100
+func (p RecheckProgress) Percent() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Done) / float64(p.Total) * 100
+}
+
+// The background bulk re-checks, by workspace; at most one runs per
+// workspace
+var (
+	recheckMu   sync.Mutex
+	recheckJobs = map[primitive.ObjectID]*RecheckProgress{}
+)
+
+// CurrentRecheckProgress returns the state of the workspace's latest bulk
+// re-check
+func CurrentRecheckProgress(workspace primitive.ObjectID) RecheckProgress {
+	recheckMu.Lock()
+	defer recheckMu.Unlock()
+	if job, ok := recheckJobs[workspace]; ok {
+		return *job
+	}
+	return RecheckProgress{}
+}
+
+// StartRecheckAll starts re-checking all notes of the workspace in the
+// background, calling audit with each note re-checked. It returns false
+// if a re-check is already running.
+func StartRecheckAll(workspace primitive.ObjectID, audit func(Note)) bool {
+	recheckMu.Lock()
+	defer recheckMu.Unlock()
+	if job, ok := recheckJobs[workspace]; ok && job.Running {
+		return false
+	}
+	job := &RecheckProgress{Running: true, StartedAt: time.Now()}
+	recheckJobs[workspace] = job
+
+	go func() {
+		err := RecheckAll(context.Background(), workspace, audit, func(p RecheckProgress) {
+			recheckMu.Lock()
+			job.Total, job.Done, job.Failed = p.Total, p.Done, p.Failed
+			recheckMu.Unlock()
+		})
+
+		recheckMu.Lock()
+		defer recheckMu.Unlock()
+		job.Running = false
+		job.FinishedAt = time.Now()
+		if err != nil {
+			job.Err = err.Error()
+		}
+		log.Printf("Re-check of the notes of workspace %s finished: %d/%d notes, %d failed", workspace.Hex(), job.Done, job.Total, job.Failed)
+	}()
+	return true
+}
+
+// RecheckAll re-checks all notes of the workspace with its current
+// settings and the current checker, calling progress after each note and
+// audit, unless nil, with each note whose new check was saved. A note that
+// fails is counted and skipped; only errors that stop the whole run
+// (including ctx being canceled) are returned. Grammar checks go through
+// the background lane of grammarQueue, behind those of users.
+func RecheckAll(ctx context.Context, workspace primitive.ObjectID, audit func(Note), progress func(RecheckProgress)) error {
+	ctx = withCheckLane(ctx, laneBackground)
+	ids, err := GetNoteIDs(workspace)
+	if err != nil {
+		return fmt.Errorf("listing notes: %w", err)
+	}
+	settings, err := GetGrammarSettings(workspace)
+	if err != nil {
+		return fmt.Errorf("loading grammar settings: %w", err)
+	}
+	knownFiles, err := GetNoteFilenames(workspace)
+	if err != nil {
+		log.Printf("Error fetching note filenames: %v", err)
+		knownFiles = nil // Skip the broken relative link check
+	}
+
+	p := RecheckProgress{Running: true, Total: len(ids)}
+	progress(p)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if note, err := recheckNote(ctx, workspace, id.Hex(), settings, knownFiles); err != nil {
+			log.Printf("Re-check of note %s failed: %v", id.Hex(), err)
+			p.Failed++
+		} else if audit != nil {
+			audit(note)
+		}
+		p.Done++
+		progress(p)
+	}
+	return nil
+}
+
+// recheckNote re-checks one stored note, saves the results and returns
+// the note
+func recheckNote(ctx context.Context, workspace primitive.ObjectID, idHex string, settings GrammarSettings, knownFiles map[string]bool) (Note, error) {
+	note, err := GetNoteByID(workspace, idHex)
+	if err != nil {
+		return note, err
+	}
+	checkErr := CheckNote(ctx, &note, settings, knownFiles)
+	if ctx.Err() != nil {
+		return note, ctx.Err() // Don't save a check that was cut short
+	}
+	if checkErr != nil {
+		return note, checkErr // Nor one that failed: the last good results stay
+	}
+	return note, UpdateNoteCheck(note)
+}
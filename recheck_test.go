@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRecheckProgressPercent(t *testing.T) {
+	for _, tt := range []struct {
+		p    RecheckProgress
+		want float64
+	}{
+		{RecheckProgress{}, 0}, // No notes: not a division by zero
+		{RecheckProgress{Total: 4}, 0},
+		{RecheckProgress{Total: 4, Done: 1}, 25},
+		{RecheckProgress{Total: 4, Done: 4, Failed: 2}, 100},
+	} {
+		if got := tt.p.Percent(); got != tt.want {
+			t.Errorf("%+v.Percent() = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+// createRecheckNotes stores n notes with one typo each in the workspace
+func createRecheckNotes(t *testing.T, owner primitive.ObjectID, n int) []primitive.ObjectID {
+	t.Helper()
+	var ids []primitive.ObjectID
+	for i := range n {
+		// Distinct texts, so none is answered from the paragraph cache
+		id, err := CreateNote(Note{OwnerID: owner, OriginalFilename: fmt.Sprintf("note%d.md", i),
+			Language: "en-US", MarkdownContent: fmt.Sprintf("Note %d has teh typo.", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// blockingTypoHandler answers like typoHandler once release is closed, and
+// sends on started when each request arrives
+func blockingTypoHandler(started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+			typoHandler(w, r)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func TestRecheckAll(t *testing.T) {
+	useTestDB(t)
+	alice, _ := createTestUsers(t)
+	ids := createRecheckNotes(t, alice.ID, 3)
+	fake, _ := newFakeLanguageTool(t, typoHandler)
+
+	var progress []string
+	err := RecheckAll(context.Background(), alice.ID, nil, func(p RecheckProgress) {
+		progress = append(progress, fmt.Sprintf("%d/%d", p.Done, p.Total))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(progress, " "); got != "0/3 1/3 2/3 3/3" {
+		t.Errorf("progress = %s, want 0/3 1/3 2/3 3/3", got)
+	}
+	if n := fake.requests.Load(); n != 3 {
+		t.Errorf("%d LanguageTool requests, want 3", n)
+	}
+	for _, id := range ids {
+		note, err := GetNoteByID(alice.ID, id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if note.CheckedAt.IsZero() || len(note.GrammarIssues) != 1 || note.GrammarIssues[0].Word != "teh" {
+			t.Errorf("%s: checked at %v, issues %+v", note.OriginalFilename, note.CheckedAt, note.GrammarIssues)
+		}
+	}
+}
+
+func TestRecheckAllKeepsChecksOnFailure(t *testing.T) {
+	useTestDB(t)
+	alice, _ := createTestUsers(t)
+	ids := createRecheckNotes(t, alice.ID, 2)
+	newFakeLanguageTool(t, typoHandler)
+	if err := RecheckAll(context.Background(), alice.ID, nil, func(RecheckProgress) {}); err != nil {
+		t.Fatal(err)
+	}
+	var before []Note
+	for _, id := range ids {
+		note, err := GetNoteByID(alice.ID, id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		before = append(before, note)
+	}
+
+	newFakeLanguageTool(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	})
+	var last RecheckProgress
+	if err := RecheckAll(context.Background(), alice.ID, nil, func(p RecheckProgress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != 2 || last.Failed != 2 {
+		t.Errorf("progress = %+v, want 2 of 2 failed", last)
+	}
+	// A failed check doesn't replace the last good one
+	for i, id := range ids {
+		note, err := GetNoteByID(alice.ID, id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !note.CheckedAt.Equal(before[i].CheckedAt) || len(note.GrammarIssues) != 1 || note.GrammarIssues[0].Word != "teh" {
+			t.Errorf("%s after a failed re-check: checked at %v, issues %+v", note.OriginalFilename, note.CheckedAt, note.GrammarIssues)
+		}
+	}
+}
+
+func TestRecheckAllCanceled(t *testing.T) {
+	useTestDB(t)
+	alice, _ := createTestUsers(t)
+	ids := createRecheckNotes(t, alice.ID, 3)
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	fake, _ := newFakeLanguageTool(t, blockingTypoHandler(started, release))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started // The first note is being checked
+		cancel()
+	}()
+	var last RecheckProgress
+	err := RecheckAll(ctx, alice.ID, nil, func(p RecheckProgress) { last = p })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RecheckAll error %v, want context.Canceled", err)
+	}
+	if last.Total != 3 || last.Done > 1 {
+		t.Errorf("progress after cancel = %+v, want at most 1 of 3 done", last)
+	}
+	if n := fake.requests.Load(); n != 1 {
+		t.Errorf("%d LanguageTool requests, want 1", n)
+	}
+	// The note being checked keeps its stored check rather than a partial one
+	for _, id := range ids {
+		if note, err := GetNoteByID(alice.ID, id.Hex()); err != nil || !note.CheckedAt.IsZero() {
+			t.Errorf("%s: checked at %v, %v; want never", note.OriginalFilename, note.CheckedAt, err)
+		}
+	}
+}
+
+func TestRecheckAllConcurrentStart(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, _ := createTestUsers(t)
+	createRecheckNotes(t, alice.ID, 2)
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	fake, _ := newFakeLanguageTool(t, blockingTypoHandler(started, release))
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	rec := httptest.NewRecorder()
+	if err := startSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), alice); err != nil {
+		t.Fatal(err)
+	}
+	session := rec.Result().Cookies()[0]
+	startRecheck := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/notes/recheck", nil)
+		req.Header.Set("HX-Request", "true")
+		req.AddCookie(session)
+		resp, err := http.DefaultClient.Do(withCSRF(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /notes/recheck: status %d, %s", resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	if body := startRecheck(); !strings.Contains(body, `hx-get="/notes/recheck"`) {
+		t.Errorf("first POST doesn't poll the running re-check: %s", body)
+	}
+	<-started
+
+	// A second start while the first runs reports on the running one
+	body := startRecheck()
+	if !strings.Contains(body, "Re-checking notes: 0 / 2") {
+		t.Errorf("second POST: %s, want the progress of the running re-check", body)
+	}
+	if p := CurrentRecheckProgress(alice.ID); !p.Running || p.Done != 0 {
+		t.Errorf("progress while blocked = %+v", p)
+	}
+
+	close(release)
+	waitFor(t, func() bool { return !CurrentRecheckProgress(alice.ID).Running })
+	p := CurrentRecheckProgress(alice.ID)
+	if p.Done != 2 || p.Total != 2 || p.Failed != 0 || p.Err != "" || p.FinishedAt.IsZero() {
+		t.Errorf("finished progress = %+v", p)
+	}
+	if n := fake.requests.Load(); n != 2 {
+		t.Errorf("%d LanguageTool requests, want 2 (one re-check)", n)
+	}
+	if body := startRecheck(); !strings.Contains(body, "Re-checking notes") {
+		t.Errorf("POST after the re-check finished doesn't start another: %s", body)
+	}
+	waitFor(t, func() bool { return !CurrentRecheckProgress(alice.ID).Running })
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+// --- Security Headers ---
+//
+// Every response gets a Content-Security-Policy that only runs the app's
+// own scripts, tagged with a nonce that is new for each response, and
+// only applies the app's own styles. Note HTML comes from user markdown
+// and may contain anything; in the app's pages the policy keeps it inert,
+// and where it is shown on its own (?type=html, share links) it gets
+// untrustedHTMLPolicy instead, which sandboxes it in an origin of its own.
+
+// untrustedHTMLPolicy is the CSP of responses holding nothing but note
+// HTML: it may show images and use inline styles, but never run scripts,
+// submit forms or reach the app's origin
+const untrustedHTMLPolicy = "sandbox; default-src 'none'; img-src * data:; style-src 'unsafe-inline'; base-uri 'none'; form-action 'none'"
+
+// appPolicy returns the CSP of the app's pages with the response's nonce
+func appPolicy(nonce string) string {
+	return "default-src 'self'; " +
+		"script-src 'nonce-" + nonce + "'; " +
+		"style-src 'self' 'nonce-" + nonce + "'; " +
+		"img-src * data:; " +
+		"object-src 'none'; " +
+		"base-uri 'none'; " +
+		"form-action 'self'; " +
+		"frame-src 'self'; " +
+		"frame-ancestors 'none'"
+}
+
+type cspNonceKey struct{}
+
+// cspNonce returns the nonce of the response to r; pages pass it to
+// base.html, which tags its <script> and <style> elements with it
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// securityHeaders sets the CSP and the other security headers of every
+// response. Handlers may replace the CSP, e.g. with untrustedHTMLPolicy.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Printf("Error creating CSP nonce: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		nonce := base64.RawURLEncoding.EncodeToString(b) // Nothing for templates to escape
+
+		h := w.Header()
+		h.Set("Content-Security-Policy", appPolicy(nonce))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY") // For browsers without frame-ancestors
+		h.Set("Referrer-Policy", "same-origin")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		h.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=()")
+		if secureCookies(r) {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+	})
+}
+
+// allowFraming lets the app's own pages frame the response, e.g. the
+// sandboxed frame of a note's HTML
+func allowFraming(w http.ResponseWriter) {
+	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	LoadTemplates()
+	handler := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, "login.html", loginView{Title: "Sign in", CSPNonce: cspNonce(r)})
+	}))
+	get := func() (http.Header, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+		return rec.Header(), rec.Body.String()
+	}
+	header, body := get()
+
+	for name, want := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "same-origin",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	policy := header.Get("Content-Security-Policy")
+	match := regexp.MustCompile(`script-src 'nonce-([^']+)'`).FindStringSubmatch(policy)
+	if match == nil || !strings.Contains(policy, "frame-ancestors 'none'") || strings.Contains(policy, "unsafe-inline") {
+		t.Fatalf("CSP %q", policy)
+	}
+	nonce := match[1]
+	if strings.Count(body, "<script") != strings.Count(body, `<script nonce="`+nonce+`"`) || !strings.Contains(body, `<style nonce="`+nonce+`"`) {
+		t.Error("page has scripts or styles without the response's nonce")
+	}
+	if next, _ := get(); strings.Contains(next.Get("Content-Security-Policy"), nonce) {
+		t.Error("nonce reused for the next response")
+	}
+}
+
+// The CSP blocks inline event handlers, scripts and style attributes, so
+// templates must not have any
+func TestTemplatesWithoutInlineCode(t *testing.T) {
+	inline := regexp.MustCompile(`<script>|\son[a-z]+="|\sstyle="|javascript:`)
+	files, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := inline.Find(b); m != nil {
+			t.Errorf("%s: inline code %q", file, m)
+		}
+	}
+}
+
+func TestNoteViewsWithoutNoteHTML(t *testing.T) {
+	LoadTemplates()
+	markdown := "Hello</div><div hx-post=\"/notes/x\" hx-trigger=\"load\">pwned</div>\n"
+	note := Note{MarkdownContent: markdown, HTMLContent: RenderMarkdownToHTML(markdown)}
+	if !strings.Contains(note.HTMLContent, `hx-post="/notes/x"`) {
+		t.Fatalf("the note's own HTML lost the attribute, the test proves nothing: %s", note.HTMLContent)
+	}
+	liveHTMX := regexp.MustCompile(`<[^>]*\shx-(post|trigger)=`)
+
+	for _, name := range []string{"_note_detail.html", "_note_proofread.html", "_note_markdown.html"} {
+		rec := httptest.NewRecorder()
+		renderTemplate(rec, name, noteDetailView{Note: note})
+		if m := liveHTMX.FindString(rec.Body.String()); m != "" {
+			t.Errorf("%s has the note's htmx attributes live: %s", name, m)
+		}
+	}
+
+	// The markdown view shows the markup as text
+	rec := httptest.NewRecorder()
+	renderTemplate(rec, "_note_markdown.html", noteDetailView{Note: note})
+	if body := rec.Body.String(); strings.Contains(body, "<div hx-post") || !strings.Contains(body, "&lt;div hx-post=") {
+		t.Errorf("markdown view doesn't escape the note:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	renderTemplate(rec, "_note_detail.html", noteDetailView{Note: note})
+	if !strings.Contains(rec.Body.String(), `sandbox`+"\n"+`  src="/notes/000000000000000000000000?type=html"`) {
+		t.Errorf("details don't frame the note's HTML:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// settingsList describes one of the editable grammar settings lists
+type settingsList struct {
+	Field string // bson field in GrammarSettings
+	Label string // Human-readable name used in responses
+}
+
+// settingsLists maps the {list} URL parameter to its settings list
+var settingsLists = map[string]settingsList{
+	"dictionary": {Field: "dictionary", Label: "dictionary"},
+	"rules":      {Field: "disabledRules", Label: "disabled rules"},
+	"categories": {Field: "disabledCategories", Label: "disabled categories"},
+}
+
+// handleGetSettings renders the grammar settings panel
+func handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	renderSettings(w, r)
+}
+
+// handleAddSetting adds the "value" form field to a settings list.
+// Requests from an issue's action button get a short confirmation instead
+// of the whole settings panel.
+func handleAddSetting(w http.ResponseWriter, r *http.Request) {
+	list, ok := settingsLists[chi.URLParam(r, "list")]
+	if !ok {
+		http.Error(w, "Unknown settings list", http.StatusNotFound)
+		return
+	}
+
+	value := strings.TrimSpace(r.FormValue("value"))
+	if value == "" {
+		http.Error(w, "Missing value", http.StatusBadRequest)
+		return
+	}
+
+	if err := AddGrammarSetting(currentWorkspace(r), list.Field, value); err != nil {
+		log.Printf("Error adding %q to %s: %v", value, list.Field, err)
+		http.Error(w, "Failed to save setting", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Added %q to %s", value, list.Field)
+
+	if r.FormValue("source") == "issue" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		renderTemplate(w, "_settings_ack.html", map[string]string{"Value": value, "List": list.Label})
+		return
+	}
+	renderSettings(w, r)
+}
+
+// handleRemoveSetting removes the "value" query parameter from a settings list
+func handleRemoveSetting(w http.ResponseWriter, r *http.Request) {
+	list, ok := settingsLists[chi.URLParam(r, "list")]
+	if !ok {
+		http.Error(w, "Unknown settings list", http.StatusNotFound)
+		return
+	}
+
+	value := r.URL.Query().Get("value")
+	if err := RemoveGrammarSetting(currentWorkspace(r), list.Field, value); err != nil {
+		log.Printf("Error removing %q from %s: %v", value, list.Field, err)
+		http.Error(w, "Failed to save setting", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Removed %q from %s", value, list.Field)
+
+	renderSettings(w, r)
+}
+
+// handleSetLanguage sets the default grammar language of the workspace to
+// the "language" form field; empty for the server default
+func handleSetLanguage(w http.ResponseWriter, r *http.Request) {
+	lang := normalizeLanguage(r.FormValue("language"))
+	if lang != "" && !offeredLanguage(lang) {
+		http.Error(w, "Unknown language", http.StatusBadRequest)
+		return
+	}
+
+	if err := SetGrammarLanguage(currentWorkspace(r), lang); err != nil {
+		log.Printf("Error setting the grammar language to %q: %v", lang, err)
+		http.Error(w, "Failed to save setting", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Set the grammar language to %q", lang)
+
+	renderSettings(w, r)
+}
+
+// renderSettings renders the settings panel with the settings of the
+// current workspace
+func renderSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := GetGrammarSettings(currentWorkspace(r))
+	if err != nil {
+		log.Printf("Error loading grammar settings: %v", err)
+		http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+
+	view := settingsView{
+		GrammarSettings: settings,
+		Languages:       grammarLanguages,
+		ServerLanguage:  DefaultGrammarLanguage(),
+		LintRules:       LintRules,
+		Access:          currentAccess(r),
+	}
+	if hasScope(r, ScopeAdmin) {
+		view.ShowAPITokens = true
+		view.APITokens = loadAPITokens(r, apiTokensView{})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_settings.html", view)
+}
+
+// settingsView is the data for the settings panel
+type settingsView struct {
+	GrammarSettings
+	Languages      []GrammarLanguage
+	ServerLanguage string // Default language of workspaces that chose none
+	LintRules      []LintRule
+	Access         Access // Viewers see the settings, but can't change them
+	ShowAPITokens  bool   // Hidden from API tokens without the admin scope
+	APITokens      apiTokensView
+}
+
+// RuleDisabled reports whether a rule ID is in the disabled rules
+func (v settingsView) RuleDisabled(id string) bool {
+	return v.CheckOptions("").ignores(GrammarIssue{RuleID: id})
+}
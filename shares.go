@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- Share Links ---
+//
+// A share link (/s/<token>) shows one rendered note to anyone who has
+// it, without signing in: a standalone read-only page, with nothing to
+// edit and no way to other notes. A share may need a password and may
+// expire. Editors of the note's workspace can list and revoke its shares
+// at any time. Deleting the note deletes its shares.
+
+// shareExpiry is one of the lifetimes to choose from for a new share
+type shareExpiry struct {
+	Label    string
+	Duration time.Duration // 0 for a share that never expires
+}
+
+// shareExpiries lists the lifetimes offered when creating a share
+var shareExpiries = []shareExpiry{
+	{"Never", 0},
+	{"1 hour", time.Hour},
+	{"1 day", 24 * time.Hour},
+	{"1 week", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+}
+
+// Value returns the form value of the expiry
+func (e shareExpiry) Value() string {
+	if e.Duration == 0 {
+		return ""
+	}
+	return e.Duration.String()
+}
+
+// parseShareExpiry returns the expiry with the given form value
+func parseShareExpiry(value string) (shareExpiry, bool) {
+	for _, e := range shareExpiries {
+		if e.Value() == value {
+			return e, true
+		}
+	}
+	return shareExpiry{}, false
+}
+
+// shareUnlockCookie is the cookie set once a share's password is entered;
+// its path limits it to that share
+const shareUnlockCookie = "notex_share"
+
+// newShareToken returns a random, unguessable token for a share link
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// unlockKey returns the value of the cookie that unlocks a password
+// protected share. It changes with the password, and can't be computed
+// without the stored hash.
+func (s Share) unlockKey() string {
+	return sessionKey(s.Token + ":" + s.PasswordHash)
+}
+
+// Expires reports whether the share expires at all
+func (s Share) Expires() bool {
+	return !s.ExpiresAt.IsZero()
+}
+
+// Path returns the path of the share link
+func (s Share) Path() string {
+	return "/s/" + s.Token
+}
+
+// publicURL returns the address the app is reached at, for links shown
+// to users: PUBLIC_URL if set (e.g. behind a proxy), else the address of
+// the request
+func publicURL(r *http.Request) string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// --- Owner Handlers ---
+
+// sharesView is the data for the list of the shares of the current
+// workspace, of one note or of all notes
+type sharesView struct {
+	NoteID   string // Empty when listing the shares of all notes
+	BaseURL  string // Prepended to Share.Path for the full link
+	Shares   []shareItem
+	Expiries []shareExpiry
+	Created  string // Link of the share just created
+	Error    string
+}
+
+// shareItem is a share along with the name of its note
+type shareItem struct {
+	Share
+	Filename string
+}
+
+// handleListShares renders the active shares of all notes of the current
+// workspace
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	renderShares(w, r, sharesView{})
+}
+
+// handleNoteShares renders the active shares of note {id}, with the form
+// to create one
+func handleNoteShares(w http.ResponseWriter, r *http.Request) {
+	note, err := GetNoteByID(currentWorkspace(r), chi.URLParam(r, "id"))
+	if err != nil {
+		noteLookupError(w, err)
+		return
+	}
+	renderShares(w, r, sharesView{NoteID: note.ID.Hex()})
+}
+
+// handleCreateShare creates a share of note {id} with the optional
+// "password" and the "expires" (a shareExpiries value) form fields
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	note, err := GetNoteByID(currentWorkspace(r), chi.URLParam(r, "id"))
+	if err != nil {
+		noteLookupError(w, err)
+		return
+	}
+	view := sharesView{NoteID: note.ID.Hex()}
+
+	expiry, ok := parseShareExpiry(r.FormValue("expires"))
+	if !ok {
+		view.Error = "Choose when the link expires."
+		renderShares(w, r, view)
+		return
+	}
+	share := Share{NoteID: note.ID, WorkspaceID: note.workspace(), OwnerID: user.ID, CreatedAt: time.Now()}
+	if expiry.Duration > 0 {
+		share.ExpiresAt = share.CreatedAt.Add(expiry.Duration)
+	}
+	if password := r.FormValue("password"); password != "" {
+		if share.PasswordHash, err = hashPassword(password); err != nil {
+			view.Error = loginMessages[err]
+			renderShares(w, r, view)
+			return
+		}
+	}
+	if share.Token, err = newShareToken(); err == nil {
+		share.ID, err = CreateShare(share)
+	}
+	if err != nil {
+		log.Printf("Error creating share of note %s: %v", note.ID.Hex(), err)
+		http.Error(w, "Failed to create the link", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s shared note %s", user.Username, note.ID.Hex())
+	detail := "share " + share.ID.Hex() + ", expires: " + expiry.Label
+	if share.PasswordHash != "" {
+		detail += ", password protected"
+	}
+	recordAudit(r, AuditShare, note, detail)
+
+	view.Created = publicURL(r) + share.Path()
+	renderShares(w, r, view)
+}
+
+// handleRevokeShare deletes the share {shareID} of the current workspace,
+// then renders the shares of the "note" query param (or of all notes)
+func handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	shareID := chi.URLParam(r, "shareID")
+	share, err := DeleteShare(currentWorkspace(r), shareID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Error revoking share %s: %v", shareID, err)
+		http.Error(w, "Failed to revoke the link", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		log.Printf("User %s revoked share %s", user.Username, shareID)
+		note, err := GetNoteByID(share.WorkspaceID, share.NoteID.Hex())
+		if err != nil {
+			log.Printf("Error fetching note %s of revoked share %s: %v", share.NoteID.Hex(), shareID, err)
+			note = Note{ID: share.NoteID, WorkspaceID: share.WorkspaceID} // Recorded without its filename
+		}
+		recordAudit(r, AuditShare, note, "revoke share "+shareID)
+	}
+	renderShares(w, r, sharesView{NoteID: r.URL.Query().Get("note")})
+}
+
+// renderShares renders the shares fragment, filling in the shares of
+// view.NoteID (or all shares of the workspace) and their notes' names
+func renderShares(w http.ResponseWriter, r *http.Request, view sharesView) {
+	workspace := currentWorkspace(r)
+	view.BaseURL = publicURL(r)
+	view.Expiries = shareExpiries
+
+	noteID := primitive.NilObjectID
+	if view.NoteID != "" {
+		var err error
+		if noteID, err = primitive.ObjectIDFromHex(view.NoteID); err != nil {
+			http.Error(w, "Invalid note ID", http.StatusBadRequest)
+			return
+		}
+	}
+	shares, err := GetShares(workspace, noteID)
+	if err != nil {
+		log.Printf("Error fetching shares: %v", err)
+		view.Error = "Failed to load the links."
+	}
+	ids := make([]primitive.ObjectID, len(shares))
+	for i, share := range shares {
+		ids[i] = share.NoteID
+	}
+	names, err := GetNoteNames(workspace, ids)
+	if err != nil {
+		log.Printf("Error fetching names of shared notes: %v", err)
+	}
+	for _, share := range shares {
+		view.Shares = append(view.Shares, shareItem{Share: share, Filename: names[share.NoteID]})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, "_shares.html", view)
+}
+
+// noteLookupError answers a failed GetNoteByID
+func noteLookupError(w http.ResponseWriter, err error) {
+	if err == mongo.ErrNoDocuments || err == primitive.ErrInvalidHex {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Error fetching note: %v", err)
+	http.Error(w, "Error fetching note", http.StatusInternalServerError)
+}
+
+// --- Public Handlers ---
+
+// sharePageView is the data for share.html
+type sharePageView struct {
+	Title        string
+	Share        Share
+	Note         *Note // Nil until the share is unlocked
+	NeedPassword bool
+	Error        string
+	CSRFToken    string
+	CSPNonce     string
+}
+
+// handleSharePage shows a shared note, or the password form of a
+// protected share that isn't unlocked yet
+func handleSharePage(w http.ResponseWriter, r *http.Request) {
+	share, note, ok := loadShare(w, r)
+	if !ok {
+		return
+	}
+	if share.PasswordHash != "" {
+		cookie, err := r.Cookie(shareUnlockCookie)
+		if err != nil || cookie.Value != share.unlockKey() {
+			renderSharePage(w, r, http.StatusOK, sharePageView{Title: "Protected note", Share: share, NeedPassword: true})
+			return
+		}
+	}
+
+	// The note's HTML comes from user markdown; the page is all note, so
+	// it gets the policy of untrusted HTML, and may not be framed at all
+	w.Header().Set("Content-Security-Policy", untrustedHTMLPolicy+"; frame-ancestors 'none'")
+	recordAudit(r, AuditView, note, "share link "+share.ID.Hex())
+	renderSharePage(w, r, http.StatusOK, sharePageView{Title: note.OriginalFilename, Share: share, Note: &note})
+}
+
+// handleUnlockShare checks the "password" form field of a protected
+// share, and sets the cookie that unlocks it
+func handleUnlockShare(w http.ResponseWriter, r *http.Request) {
+	share, _, ok := loadShare(w, r)
+	if !ok {
+		return
+	}
+	if share.PasswordHash == "" {
+		http.Redirect(w, r, share.Path(), http.StatusSeeOther)
+		return
+	}
+	if !checkPassword(share.PasswordHash, r.FormValue("password")) {
+		renderSharePage(w, r, http.StatusUnauthorized, sharePageView{Title: "Protected note", Share: share, NeedPassword: true, Error: "Wrong password."})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookie,
+		Value:    share.unlockKey(),
+		Path:     share.Path(),
+		Expires:  share.ExpiresAt, // A session cookie for shares that don't expire
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, share.Path(), http.StatusSeeOther)
+}
+
+// loadShare returns the active share {token} and its note, answering 404
+// if either is gone
+func loadShare(w http.ResponseWriter, r *http.Request) (Share, Note, bool) {
+	share, err := GetShareByToken(chi.URLParam(r, "token"))
+	var note Note
+	if err == nil {
+		note, err = GetNoteByID(share.WorkspaceID, share.NoteID.Hex())
+	}
+	if err == mongo.ErrNoDocuments {
+		renderSharePage(w, r, http.StatusNotFound, sharePageView{Title: "Link not found", Error: "This link doesn't exist, has expired or was revoked."})
+		return Share{}, Note{}, false
+	}
+	if err != nil {
+		log.Printf("Error fetching share: %v", err)
+		http.Error(w, "Error fetching the shared note", http.StatusInternalServerError)
+		return Share{}, Note{}, false
+	}
+	return share, note, true
+}
+
+// renderSharePage renders share.html. Share pages are kept out of search
+// engines and caches, and don't leak their link through the Referer of
+// links in the note.
+func renderSharePage(w http.ResponseWriter, r *http.Request, status int, view sharePageView) {
+	view.CSRFToken = csrfToken(w, r)
+	view.CSPNonce = cspNonce(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.WriteHeader(status)
+	renderPage(w, "share.html", view)
+}
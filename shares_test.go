@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinks(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, _ := createTestUsers(t)
+	id, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "shared.md", HTMLContent: "<p>Shared text</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNote(Note{OwnerID: alice.ID, OriginalFilename: "private.md", HTMLContent: "<p>Private text</p>"}); err != nil {
+		t.Fatal(err)
+	}
+	newShare := func(password string, expiresAt time.Time) Share {
+		t.Helper()
+		token, err := newShareToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		share := Share{Token: token, NoteID: id, WorkspaceID: alice.ID, OwnerID: alice.ID, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+		if password != "" {
+			if share.PasswordHash, err = hashPassword(password); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if share.ID, err = CreateShare(share); err != nil {
+			t.Fatal(err)
+		}
+		return share
+	}
+	open := newShare("", time.Time{})
+	protected := newShare("share password", time.Now().Add(time.Hour))
+	expired := newShare("", time.Now().Add(-time.Minute))
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(path string, cookies ...*http.Cookie) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	// Anyone can read it without signing in, but nothing else
+	status, body := get(open.Path())
+	if status != http.StatusOK || !strings.Contains(body, "Shared text") {
+		t.Fatalf("open share: status %d, body without the note", status)
+	}
+	for _, leak := range []string{"Private text", "private.md", "hx-delete", "/notes/"} {
+		if strings.Contains(body, leak) {
+			t.Errorf("share page contains %q", leak)
+		}
+	}
+
+	// Expired and unknown links are not found
+	for _, path := range []string{expired.Path(), "/s/unknown"} {
+		if status, body := get(path); status != http.StatusNotFound || strings.Contains(body, "Shared text") {
+			t.Errorf("GET %s: status %d, want 404 without the note", path, status)
+		}
+	}
+
+	// A password is needed for the protected one
+	if status, body := get(protected.Path()); status != http.StatusOK || strings.Contains(body, "Shared text") {
+		t.Errorf("protected share without password: status %d, note shown: %v", status, strings.Contains(body, "Shared text"))
+	}
+	unlock := func(password string) *http.Response {
+		t.Helper()
+		resp, err := postForm(client, server.URL+protected.Path(), url.Values{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := unlock("wrong password"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong share password: status %d, want 401", resp.StatusCode)
+	}
+	resp := unlock("share password")
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 {
+		t.Fatalf("right share password: status %d, %d cookies", resp.StatusCode, len(resp.Cookies()))
+	}
+	if status, body := get(protected.Path(), resp.Cookies()[0]); status != http.StatusOK || !strings.Contains(body, "Shared text") {
+		t.Errorf("unlocked share: status %d, note shown: %v", status, strings.Contains(body, "Shared text"))
+	}
+
+	// Revoked shares, and those of deleted notes, are gone
+	if _, err := DeleteShare(alice.ID, open.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(open.Path()); status != http.StatusNotFound {
+		t.Errorf("revoked share: status %d, want 404", status)
+	}
+	if err := DeleteNoteByID(alice.ID, id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if shares, err := GetShares(alice.ID, id); err != nil || len(shares) != 0 {
+		t.Errorf("shares of the deleted note: %d, %v; want none", len(shares), err)
+	}
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// SpellChecker is a pure-Go spell checker using Hunspell-format .dic/.aff
+// dictionaries. It is the fallback when LanguageTool is unavailable, so it
+// only knows about spelling, not grammar.
+type SpellChecker struct {
+	language string              // Dictionary name, e.g. "en_US"
+	words    map[string]struct{} // Every accepted word form
+	byLength map[int][]string    // Accepted words by rune count, for suggestions
+	reps     [][2]string         // REP table: common misspelling -> fix
+
+	mu          sync.Mutex
+	suggestions map[string][]string // Suggestions already computed, by word
+}
+
+// hunspellRuleID is the RuleID of issues produced by SpellChecker
+const hunspellRuleID = "HUNSPELL_RULE"
+
+// hunspellCheckerVersion is the CheckerVersion of SpellChecker results
+const hunspellCheckerVersion = "Hunspell"
+
+// maxSuggestionDistance is the largest edit distance of a suggestion
+const maxSuggestionDistance = 2
+
+// maxSuggestions is the number of suggestions kept per issue
+const maxSuggestions = 5
+
+// spellCheckers caches the loaded dictionaries by dictionary name
+var (
+	spellCheckersMu sync.Mutex
+	spellCheckers   = map[string]*SpellChecker{}
+)
+
+// hunspellDictDir is the directory holding <name>.dic/<name>.aff files,
+// read from HUNSPELL_DICT_DIR
+func hunspellDictDir() string {
+	if dir := os.Getenv("HUNSPELL_DICT_DIR"); dir != "" {
+		return dir
+	}
+	return "external/dictionaries"
+}
+
+// fallbackSpellChecker returns the spell checker for a LanguageTool
+// language code, loading its dictionary on first use. "auto" uses
+// HUNSPELL_LANGUAGE (default en_US), since the fallback can't detect
+// languages.
+func fallbackSpellChecker(lang string) (*SpellChecker, error) {
+	name := strings.ReplaceAll(lang, "-", "_")
+	if lang == "" || lang == LanguageAuto {
+		name = os.Getenv("HUNSPELL_LANGUAGE")
+		if name == "" {
+			name = "en_US"
+		}
+	}
+
+	spellCheckersMu.Lock()
+	defer spellCheckersMu.Unlock()
+
+	if sc, ok := spellCheckers[name]; ok {
+		return sc, nil
+	}
+
+	base := filepath.Join(hunspellDictDir(), name)
+	if _, err := os.Stat(base + ".dic"); err != nil && !strings.Contains(name, "_") {
+		// A bare language such as "fr": use the first regional dictionary
+		if matches, _ := filepath.Glob(base + "_*.dic"); len(matches) > 0 {
+			base = strings.TrimSuffix(matches[0], ".dic")
+		}
+	}
+
+	sc, err := LoadHunspell(base+".aff", base+".dic")
+	if err != nil {
+		return nil, err
+	}
+	spellCheckers[name] = sc
+	log.Printf("Loaded Hunspell dictionary %s (%d word forms)", base, len(sc.words))
+	return sc, nil
+}
+
+// --- Dictionary Loading ---
+
+// affixRule is one PFX or SFX rule line
+type affixRule struct {
+	strip     string
+	add       string
+	condition []charClass
+}
+
+// affixClass is all rules sharing one PFX/SFX flag
+type affixClass struct {
+	prefix       bool
+	crossProduct bool
+	rules        []affixRule
+}
+
+// charClass is one position of an affix condition: ".", "x", "[xy]" or "[^xy]"
+type charClass struct {
+	any    bool
+	negate bool
+	chars  string
+}
+
+// affixFile holds the parts of a .aff file the checker uses
+type affixFile struct {
+	encoding      string
+	flagType      string // "", "long", "num" or "UTF-8"
+	aliases       [][]string
+	affixes       map[string]*affixClass
+	reps          [][2]string
+	needAffix     string
+	forbiddenWord string
+}
+
+// LoadHunspell loads a Hunspell dictionary and expands every entry with
+// its prefix and suffix rules into the set of accepted word forms
+func LoadHunspell(affPath, dicPath string) (*SpellChecker, error) {
+	aff, err := parseAffixFile(affPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", affPath, err)
+	}
+
+	dic, err := os.Open(dicPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dic.Close()
+
+	lines, err := decodedLines(dic, aff.encoding)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dicPath, err)
+	}
+
+	sc := &SpellChecker{
+		language:    strings.TrimSuffix(filepath.Base(dicPath), ".dic"),
+		words:       make(map[string]struct{}),
+		byLength:    make(map[int][]string),
+		reps:        aff.reps,
+		suggestions: make(map[string][]string),
+	}
+	forbidden := map[string]struct{}{}
+
+	for i, line := range lines {
+		if i == 0 {
+			continue // Approximate word count
+		}
+		word, flags := aff.parseDicLine(line)
+		if word == "" {
+			continue
+		}
+		if aff.forbiddenWord != "" && hasFlag(flags, aff.forbiddenWord) {
+			forbidden[word] = struct{}{}
+			continue
+		}
+		for _, form := range aff.expand(word, flags) {
+			sc.words[form] = struct{}{}
+		}
+	}
+
+	for word := range forbidden {
+		delete(sc.words, word)
+	}
+	for word := range sc.words {
+		n := utf8.RuneCountInString(word)
+		sc.byLength[n] = append(sc.byLength[n], word)
+	}
+	for _, words := range sc.byLength {
+		sort.Strings(words) // Deterministic suggestion order
+	}
+	return sc, nil
+}
+
+// parseAffixFile reads the directives of a .aff file
+func parseAffixFile(path string) (*affixFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// SET must come before any non-ASCII text, so find it first
+	aff := &affixFile{encoding: "UTF-8", affixes: map[string]*affixClass{}}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "SET" {
+			aff.encoding = fields[1]
+			break
+		}
+	}
+
+	lines, err := decodedLines(strings.NewReader(string(raw)), aff.encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "FLAG":
+			aff.flagType = fields[1]
+		case "NEEDAFFIX", "PSEUDOROOT":
+			aff.needAffix = fields[1]
+		case "FORBIDDENWORD":
+			aff.forbiddenWord = fields[1]
+		case "AF":
+			if _, err := strconv.Atoi(fields[1]); err == nil && len(aff.aliases) == 0 {
+				continue // Header line with the alias count
+			}
+			aff.aliases = append(aff.aliases, aff.splitFlags(fields[1]))
+		case "REP":
+			if len(fields) >= 3 {
+				from := strings.ReplaceAll(fields[1], "_", " ")
+				to := strings.ReplaceAll(fields[2], "_", " ")
+				aff.reps = append(aff.reps, [2]string{from, to})
+			}
+		case "PFX", "SFX":
+			aff.parseAffixLine(fields)
+		}
+	}
+	return aff, nil
+}
+
+// parseAffixLine handles a PFX/SFX header ("SFX D Y 4") or rule
+// ("SFX D y ied [^aeiou]y") line
+func (aff *affixFile) parseAffixLine(fields []string) {
+	flag := fields[1]
+	class, exists := aff.affixes[flag]
+	if !exists {
+		// Header: type, flag, cross product, rule count
+		if len(fields) < 4 {
+			return
+		}
+		aff.affixes[flag] = &affixClass{prefix: fields[0] == "PFX", crossProduct: fields[2] == "Y"}
+		return
+	}
+	if len(fields) < 4 {
+		return
+	}
+
+	rule := affixRule{strip: fields[2], add: fields[3]}
+	if rule.strip == "0" {
+		rule.strip = ""
+	}
+	if i := strings.IndexByte(rule.add, '/'); i >= 0 {
+		rule.add = rule.add[:i] // Continuation classes are not supported
+	}
+	if rule.add == "0" {
+		rule.add = ""
+	}
+	condition := "."
+	if len(fields) >= 5 {
+		condition = fields[4]
+	}
+	rule.condition = parseCondition(condition)
+	class.rules = append(class.rules, rule)
+}
+
+// parseCondition splits an affix condition into character classes
+func parseCondition(condition string) []charClass {
+	var classes []charClass
+	runes := []rune(condition)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '.':
+			classes = append(classes, charClass{any: true})
+		case '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			class := charClass{chars: string(runes[i+1 : min(end, len(runes))])}
+			if strings.HasPrefix(class.chars, "^") {
+				class.negate = true
+				class.chars = class.chars[1:]
+			}
+			classes = append(classes, class)
+			i = end
+		default:
+			classes = append(classes, charClass{chars: string(runes[i])})
+		}
+	}
+	if len(classes) == 1 && classes[0].any {
+		return nil // "." matches everything
+	}
+	return classes
+}
+
+// matches reports whether r fits the character class
+func (c charClass) matches(r rune) bool {
+	if c.any {
+		return true
+	}
+	return strings.ContainsRune(c.chars, r) != c.negate
+}
+
+// splitFlags splits a flag field according to the FLAG type
+func (aff *affixFile) splitFlags(field string) []string {
+	var flags []string
+	switch aff.flagType {
+	case "long":
+		runes := []rune(field)
+		for i := 0; i+1 < len(runes); i += 2 {
+			flags = append(flags, string(runes[i:i+2]))
+		}
+	case "num":
+		for _, f := range strings.Split(field, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				flags = append(flags, f)
+			}
+		}
+	default: // One character per flag
+		for _, r := range field {
+			flags = append(flags, string(r))
+		}
+	}
+	return flags
+}
+
+// parseDicLine splits a .dic line into the word and its flags
+func (aff *affixFile) parseDicLine(line string) (string, []string) {
+	// Morphological fields follow a tab or a space
+	if i := strings.IndexAny(line, "\t "); i >= 0 {
+		line = line[:i]
+	}
+
+	// The flags follow the first unescaped slash
+	slash := -1
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '/' {
+			slash = i
+			break
+		}
+	}
+	if slash < 0 {
+		return strings.ReplaceAll(line, `\/`, "/"), nil
+	}
+
+	word := strings.ReplaceAll(line[:slash], `\/`, "/")
+	field := line[slash+1:]
+	if len(aff.aliases) > 0 {
+		if n, err := strconv.Atoi(field); err == nil && n >= 1 && n <= len(aff.aliases) {
+			return word, aff.aliases[n-1]
+		}
+	}
+	return word, aff.splitFlags(field)
+}
+
+// expand returns the word forms of a dictionary entry: the root (unless
+// it needs an affix), each prefix and suffix form, and the cross products
+func (aff *affixFile) expand(word string, flags []string) []string {
+	var forms []string
+	if aff.needAffix == "" || !hasFlag(flags, aff.needAffix) {
+		forms = append(forms, word)
+	}
+
+	var suffixed []string // Suffix forms that may also take a prefix
+	for _, flag := range flags {
+		class, ok := aff.affixes[flag]
+		if !ok || class.prefix {
+			continue
+		}
+		for _, rule := range class.rules {
+			if form, ok := rule.applySuffix(word); ok {
+				forms = append(forms, form)
+				if class.crossProduct {
+					suffixed = append(suffixed, form)
+				}
+			}
+		}
+	}
+
+	for _, flag := range flags {
+		class, ok := aff.affixes[flag]
+		if !ok || !class.prefix {
+			continue
+		}
+		for _, rule := range class.rules {
+			if form, ok := rule.applyPrefix(word); ok {
+				forms = append(forms, form)
+			}
+			if !class.crossProduct {
+				continue
+			}
+			for _, s := range suffixed {
+				if form, ok := rule.applyPrefix(s); ok {
+					forms = append(forms, form)
+				}
+			}
+		}
+	}
+	return forms
+}
+
+// applySuffix applies a suffix rule if the word ends in the condition
+func (rule affixRule) applySuffix(word string) (string, bool) {
+	runes := []rune(word)
+	if len(runes) < len(rule.condition) || !strings.HasSuffix(word, rule.strip) {
+		return "", false
+	}
+	tail := runes[len(runes)-len(rule.condition):]
+	for i, class := range rule.condition {
+		if !class.matches(tail[i]) {
+			return "", false
+		}
+	}
+	return strings.TrimSuffix(word, rule.strip) + rule.add, true
+}
+
+// applyPrefix applies a prefix rule if the word starts with the condition
+func (rule affixRule) applyPrefix(word string) (string, bool) {
+	runes := []rune(word)
+	if len(runes) < len(rule.condition) || !strings.HasPrefix(word, rule.strip) {
+		return "", false
+	}
+	for i, class := range rule.condition {
+		if !class.matches(runes[i]) {
+			return "", false
+		}
+	}
+	return rule.add + strings.TrimPrefix(word, rule.strip), true
+}
+
+// hasFlag reports whether flags contains flag
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// decodedLines reads r as text in the given Hunspell SET encoding and
+// returns its lines without line endings
+func decodedLines(r io.Reader, encoding string) ([]string, error) {
+	if !strings.EqualFold(encoding, "UTF-8") {
+		// Hunspell writes "ISO8859-1"; the WHATWG name is "ISO-8859-1"
+		name := strings.Replace(encoding, "ISO8859", "ISO-8859", 1)
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported dictionary encoding %q", encoding)
+		}
+		r = enc.NewDecoder().Reader(r)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(strings.TrimPrefix(scanner.Text(), "\ufeff"), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+// --- Checking ---
+
+// Markdown that must not be spell checked: fenced code blocks, inline
+// code, link targets, autolinks, bare URLs, e-mail addresses and HTML tags
+var spellSkipPattern = regexp.MustCompile("(?s)```.*?(```|$)|~~~.*?(~~~|$)|`[^`\n]*`|\\]\\([^)]*\\)|<[^>\n]*>|https?://\\S+|www\\.\\S+|[\\w.+-]+@[\\w-]+\\.[\\w.]+")
+
+// spellWordPattern matches words, including inner apostrophes
+var spellWordPattern = regexp.MustCompile(`\p{L}+(?:['’]\p{L}+)*`)
+
+// Check finds misspelled words in text. Offsets are byte offsets into text.
+func (sc *SpellChecker) Check(text string) []GrammarIssue {
+	// Blank out skipped regions, keeping offsets intact
+	masked := []byte(text)
+	for _, loc := range spellSkipPattern.FindAllStringIndex(text, -1) {
+		for i := loc[0]; i < loc[1]; i++ {
+			if masked[i] != '\n' {
+				masked[i] = ' '
+			}
+		}
+	}
+
+	var issues []GrammarIssue
+	for _, loc := range spellWordPattern.FindAllIndex(masked, -1) {
+		start, end := loc[0], loc[1]
+		word := text[start:end]
+		if sc.IsCorrect(word) {
+			continue
+		}
+		if end < len(text) && (text[end] == '_' || unicode.IsDigit(rune(text[end]))) ||
+			start > 0 && (text[start-1] == '_' || unicode.IsDigit(rune(text[start-1]))) {
+			continue // Part of an identifier
+		}
+
+		issues = append(issues, GrammarIssue{
+			Message:      "Possible spelling mistake found.",
+			ShortMessage: "Spelling mistake",
+			Context:      spellContext(text, start, end),
+			Offset:       start,
+			Length:       end - start,
+			Suggestions:  sc.Suggest(word),
+			Word:         word,
+
+			RuleID:          hunspellRuleID,
+			RuleDescription: "Possible spelling mistake (" + sc.language + " dictionary)",
+			RuleCategory:    "TYPOS",
+			IssueType:       "misspelling",
+			Category:        CategorySpelling,
+			Severity:        SeverityError,
+			Source:          SourceHunspell,
+		})
+	}
+	return issues
+}
+
+// IsCorrect reports whether word is in the dictionary. As in Hunspell, a
+// lowercase dictionary word is also accepted capitalized or in all caps.
+func (sc *SpellChecker) IsCorrect(word string) bool {
+	word = strings.ReplaceAll(word, "’", "'")
+	if _, ok := sc.words[word]; ok {
+		return true
+	}
+	if isAllUpper(word) && utf8.RuneCountInString(word) <= 5 {
+		return true // Acronyms
+	}
+	lower := strings.ToLower(word)
+	if _, ok := sc.words[lower]; ok {
+		return true
+	}
+	if isAllUpper(word) {
+		if _, ok := sc.words[capitalize(lower)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Suggest returns up to maxSuggestions dictionary words closest to word
+// by edit distance, preferring REP table corrections
+func (sc *SpellChecker) Suggest(word string) []string {
+	sc.mu.Lock()
+	if cached, ok := sc.suggestions[word]; ok {
+		sc.mu.Unlock()
+		return cached
+	}
+	sc.mu.Unlock()
+
+	lower := strings.ToLower(word)
+	seen := map[string]bool{}
+	var suggestions []string
+	add := func(s string) {
+		if !seen[s] && len(suggestions) < maxSuggestions {
+			seen[s] = true
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	for _, rep := range sc.reps {
+		if strings.Contains(lower, rep[0]) {
+			fixed := strings.Replace(lower, rep[0], rep[1], 1)
+			correct := true
+			for _, w := range strings.Fields(fixed) { // REP may split a word
+				correct = correct && sc.IsCorrect(w)
+			}
+			if correct {
+				add(fixed)
+			}
+		}
+	}
+
+	type candidate struct {
+		word     string
+		distance int
+	}
+	var candidates []candidate
+	n := utf8.RuneCountInString(lower)
+	target := []rune(lower)
+	for length := n - maxSuggestionDistance; length <= n+maxSuggestionDistance; length++ {
+		for _, w := range sc.byLength[length] {
+			if d := editDistance(target, []rune(strings.ToLower(w)), maxSuggestionDistance); d <= maxSuggestionDistance {
+				candidates = append(candidates, candidate{w, d})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+	for _, c := range candidates {
+		add(c.word)
+	}
+
+	// Match the capitalization of the misspelled word
+	for i, s := range suggestions {
+		switch {
+		case isAllUpper(word) && utf8.RuneCountInString(word) > 1:
+			suggestions[i] = strings.ToUpper(s)
+		case startsUpper(word):
+			suggestions[i] = capitalize(s)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.suggestions[word] = suggestions
+	sc.mu.Unlock()
+	return suggestions
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment)
+// distance between a and b. It returns limit+1 as soon as the distance
+// is known to exceed limit.
+func editDistance(a, b []rune, limit int) int {
+	if abs(len(a)-len(b)) > limit {
+		return limit + 1
+	}
+
+	prevPrev := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prevPrev[j-2]+1) // Transposition
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prevPrev, prev, cur = prev, cur, prevPrev
+	}
+	return prev[len(b)]
+}
+
+// spellContext returns up to 40 bytes of text on either side of a word,
+// cut at rune boundaries
+func spellContext(text string, start, end int) string {
+	from := max(0, start-40)
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	to := min(len(text), end+40)
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+	return strings.Join(strings.Fields(text[from:to]), " ")
+}
+
+func isAllUpper(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) && !unicode.IsUpper(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func startsUpper(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsUpper(r)
+}
+
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// CheckSpelling is the fallback for CheckGrammar when LanguageTool is
+// unavailable. It only reports spelling issues.
+func CheckSpelling(text string, opts CheckOptions) (GrammarResult, error) {
+	sc, err := fallbackSpellChecker(opts.Language)
+	if err != nil {
+		return GrammarResult{}, fmt.Errorf("grammar checker not initialized and no fallback dictionary: %w", err)
+	}
+
+	result := GrammarResult{
+		Language:       strings.ReplaceAll(sc.language, "_", "-"),
+		CheckerVersion: hunspellCheckerVersion,
+	}
+	for _, issue := range sc.Check(text) {
+		if !opts.ignores(issue) {
+			result.Issues = append(result.Issues, issue)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// loadTestDictionary loads testdata/hunspell/en_TEST, a small dictionary
+// with prefix and suffix rules, NEEDAFFIX and FORBIDDENWORD
+func loadTestDictionary(t *testing.T) *SpellChecker {
+	t.Helper()
+	sc, err := LoadHunspell("testdata/hunspell/en_TEST.aff", "testdata/hunspell/en_TEST.dic")
+	if err != nil {
+		t.Fatalf("LoadHunspell: %v", err)
+	}
+	return sc
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      []charClass
+	}{
+		{".", nil},
+		{"e", []charClass{{chars: "e"}}},
+		{"[^aeiou]y", []charClass{{negate: true, chars: "aeiou"}, {chars: "y"}}},
+		{"[aeiou]y", []charClass{{chars: "aeiou"}, {chars: "y"}}},
+		{".[^ey]", []charClass{{any: true}, {negate: true, chars: "ey"}}},
+		{"[éè]", []charClass{{chars: "éè"}}},
+		{"[ab", []charClass{{chars: "ab"}}}, // Unclosed class
+	}
+	for _, tt := range tests {
+		if got := parseCondition(tt.condition); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCondition(%q) = %+v, want %+v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestAffixRules(t *testing.T) {
+	rule := func(strip, add, condition string) affixRule {
+		return affixRule{strip: strip, add: add, condition: parseCondition(condition)}
+	}
+	tests := []struct {
+		name   string
+		rule   affixRule
+		prefix bool
+		word   string
+		want   string // Empty if the rule does not apply
+	}{
+		{"suffix without strip", rule("", "ed", "[^ey]"), false, "walk", "walked"},
+		{"suffix condition fails", rule("", "ed", "[^ey]"), false, "love", ""},
+		{"suffix strips", rule("y", "ied", "[^aeiou]y"), false, "try", "tried"},
+		{"suffix negated class fails", rule("y", "ied", "[^aeiou]y"), false, "play", ""},
+		{"strip must match", rule("y", "ied", "."), false, "walk", ""},
+		{"condition longer than word", rule("", "s", "[^aeiou]y"), false, "y", ""},
+		{"multi-byte condition", rule("é", "ées", "é"), false, "café", "cafées"},
+		{"prefix", rule("", "un", "."), true, "play", "unplay"},
+		{"prefix strips", rule("e", "in", "e"), true, "exact", "inxact"},
+		{"prefix condition fails", rule("", "un", "[^p]"), true, "play", ""},
+	}
+	for _, tt := range tests {
+		apply := tt.rule.applySuffix
+		if tt.prefix {
+			apply = tt.rule.applyPrefix
+		}
+		got, ok := apply(tt.word)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%s: %q becomes %q (%v), want %q", tt.name, tt.word, got, ok, tt.want)
+		}
+	}
+}
+
+func TestLoadHunspell(t *testing.T) {
+	sc := loadTestDictionary(t)
+	for _, word := range []string{
+		"try", "tried", "tries", // Suffixes with strip
+		"play", "played", "plays", "unplay", "unplayed", "unplays", // Cross products
+		"love", "loved", "walk", "walked", "rewalk",
+		"coloured", // Root needs an affix
+		"km/h",     // Escaped slash
+		"café",     // Morphological field after a tab
+	} {
+		if _, ok := sc.words[word]; !ok {
+			t.Errorf("%q is missing", word)
+		}
+	}
+	for _, word := range []string{
+		"tryed", "plaied", "lovedd",
+		"rewalked", // R has no cross product
+		"untry",    // try has no U flag
+		"colour",   // NEEDAFFIX
+		"teh",      // FORBIDDENWORD
+		"km",
+	} {
+		if _, ok := sc.words[word]; ok {
+			t.Errorf("%q is accepted", word)
+		}
+	}
+}
+
+func TestSpellCheckerIsCorrect(t *testing.T) {
+	sc := loadTestDictionary(t)
+	tests := []struct {
+		word string
+		want bool
+	}{
+		{"tried", true},
+		{"Tried", true},   // Capitalized
+		{"TRIED", true},   // All caps
+		{"NASA", true},    // Short acronym
+		{"ABCDEF", false}, // Too long for an acronym
+		{"unplay’s", false},
+		{"Teh", false},
+	}
+	for _, tt := range tests {
+		if got := sc.IsCorrect(tt.word); got != tt.want {
+			t.Errorf("IsCorrect(%q) = %v, want %v", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestSpellCheckerSuggest(t *testing.T) {
+	sc := loadTestDictionary(t)
+	tests := []struct {
+		word string
+		want []string
+	}{
+		{"fone", []string{"phone", "love"}},            // REP table first
+		{"tryed", []string{"tried", "try", "tries"}},   // Closest first
+		{"Walkd", []string{"Walk", "Walked"}},          // Capitalized like the word
+		{"PLAYD", []string{"PLAY", "PLAYS", "PLAYED"}}, // All caps like the word
+		{"teh", []string{"try"}},                       // Never the forbidden word
+		{"colour", []string{"coloured"}},               // Nor the bare root
+		{"xyzzyq", nil},
+	}
+	for _, tt := range tests {
+		if got := sc.Suggest(tt.word); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Suggest(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestSpellCheckerCheck(t *testing.T) {
+	sc := loadTestDictionary(t)
+	tests := []struct {
+		name        string
+		text        string
+		wantWords   []string
+		wantOffsets []int
+	}{
+		{"prose", "I tryed to walk", []string{"tryed", "to"}, []int{2, 8}},
+		{"multi-byte offsets", "café tryed", []string{"tryed"}, []int{6}},
+		{"fenced code", "walk\n```\ntryed\n```\nwalkd", []string{"walkd"}, []int{19}},
+		{"inline code", "walk `tryed` walk", nil, nil},
+		{"link target, but not link text", "[walkd](http://tryed.example)", []string{"walkd"}, []int{1}},
+		{"identifiers", "x_tryed tryed2 2tryed", nil, nil},
+		{"e-mail address", "tryed@example.com", nil, nil},
+		{"HTML tag", "<tryed class=walkd>", nil, nil},
+	}
+	for _, tt := range tests {
+		var words []string
+		var offsets []int
+		for _, issue := range sc.Check(tt.text) {
+			words = append(words, issue.Word)
+			offsets = append(offsets, issue.Offset)
+			if tt.text[issue.Offset:issue.Offset+issue.Length] != issue.Word || issue.Source != SourceHunspell || issue.Category != CategorySpelling {
+				t.Errorf("%s: unexpected issue %+v", tt.name, issue)
+			}
+		}
+		if !reflect.DeepEqual(words, tt.wantWords) || !reflect.DeepEqual(offsets, tt.wantOffsets) {
+			t.Errorf("%s: issues %q at %v, want %q at %v", tt.name, words, offsets, tt.wantWords, tt.wantOffsets)
+		}
+	}
+}
+
+func TestCheckSpelling(t *testing.T) {
+	t.Setenv("HUNSPELL_DICT_DIR", "testdata/hunspell")
+	t.Cleanup(func() {
+		spellCheckersMu.Lock()
+		delete(spellCheckers, "en_TEST")
+		delete(spellCheckers, "en")
+		spellCheckersMu.Unlock()
+	})
+
+	// A bare language falls back to its first regional dictionary
+	for _, lang := range []string{"en-TEST", "en"} {
+		result, err := CheckSpelling("walkd and tryed", CheckOptions{Language: lang, Dictionary: []string{"Tryed"}})
+		if err != nil {
+			t.Fatalf("CheckSpelling in %s: %v", lang, err)
+		}
+		if result.Language != "en-TEST" || result.CheckerVersion != hunspellCheckerVersion {
+			t.Errorf("%s: checked in %q by %q", lang, result.Language, result.CheckerVersion)
+		}
+		if len(result.Issues) != 2 || result.Issues[0].Word != "walkd" || result.Issues[1].Word != "and" {
+			t.Errorf("%s: issues %+v, want walkd and and (tryed is in the user dictionary)", lang, result.Issues)
+		}
+	}
+	if _, err := CheckSpelling("walk", CheckOptions{Language: "de-DE"}); err == nil {
+		t.Error("CheckSpelling without a dictionary succeeded")
+	}
+}
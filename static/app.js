@@ -0,0 +1,44 @@
+// htmx leaves error responses unswapped. Responses asking the user to come
+// back later (429, 503) carry a message fragment, so show it; so do
+// requests turned down with a message for another target (e.g. a missing
+// CSRF token in #request-error, a full quota in #upload-error).
+document.addEventListener("htmx:beforeSwap", (event) => {
+  const status = event.detail.xhr.status;
+  const retarget = event.detail.xhr.getResponseHeader("HX-Retarget");
+  if (status === 429 || status === 503 || retarget) {
+    event.detail.shouldSwap = true;
+    event.detail.isError = false;
+  }
+});
+
+// Clear the last request error once a request succeeds
+document.addEventListener("htmx:afterRequest", (event) => {
+  const error = document.getElementById("request-error");
+  if (error && event.detail.successful) {
+    error.innerHTML = "";
+  }
+});
+
+// Clear the last upload error when uploading again
+document.addEventListener("htmx:beforeRequest", (event) => {
+  if (event.detail.elt.id === "upload-form") {
+    document.getElementById("upload-error").innerHTML = "";
+  }
+});
+
+// Open and close the grammar issues of a note
+document.addEventListener("click", (event) => {
+  const header = event.target.closest(".grammar-dropdown-header");
+  if (!header) {
+    return;
+  }
+  const content = document.getElementById("grammar-issues");
+  content.classList.toggle("open");
+
+  const arrow = header.querySelector(".dropdown-arrow");
+  if (content.classList.contains("open")) {
+    arrow.textContent = "▲";
+  } else {
+    arrow.textContent = "▼";
+  }
+});
@@ -0,0 +1,233 @@
+// Live grammar checking for the note editor (templates/_editor.html).
+//
+// After a pause in typing, the text is split into paragraphs and the ones
+// without known issues are posted to /editor/check, which streams back one
+// JSON line per paragraph. Issues are remembered by paragraph text, so
+// unchanged paragraphs are never sent again. A newer check aborts the one
+// in flight; the server cancels its work for the superseded request too.
+(function () {
+  "use strict";
+
+  const DEBOUNCE_MS = 600;
+
+  // splitParagraphs mirrors splitParagraphs in grammar_chunks.go: text is
+  // split on blank lines, which belong to no paragraph
+  function splitParagraphs(text) {
+    const paragraphs = [];
+    let start = -1;
+    let lineStart = 0;
+    while (lineStart < text.length) {
+      let lineEnd = text.indexOf("\n", lineStart);
+      if (lineEnd < 0) lineEnd = text.length;
+
+      if (text.slice(lineStart, lineEnd).trim() === "") {
+        if (start >= 0) {
+          paragraphs.push({
+            offset: start,
+            text: text.slice(start, lineStart).replace(/[\r\n]+$/, ""),
+          });
+          start = -1;
+        }
+      } else if (start < 0) {
+        start = lineStart;
+      }
+      lineStart = lineEnd + 1;
+    }
+    if (start >= 0) {
+      paragraphs.push({
+        offset: start,
+        text: text.slice(start).replace(/[\r\n]+$/, ""),
+      });
+    }
+    return paragraphs;
+  }
+
+  function initEditor(form) {
+    if (form.dataset.liveEditorReady) return;
+    form.dataset.liveEditorReady = "1";
+
+    const input = form.querySelector("[data-editor-input]");
+    const language = form.querySelector("[data-editor-language]");
+    const status = form.querySelector("[data-editor-status]");
+    const list = form.querySelector("[data-editor-issues]");
+    const session = form.dataset.session;
+
+    let results = new Map(); // Paragraph text -> issues
+    let timer = null;
+    let inFlight = null; // AbortController of the running check
+    let lastError = "";
+
+    function schedule() {
+      clearTimeout(timer);
+      timer = setTimeout(check, DEBOUNCE_MS);
+    }
+
+    async function check() {
+      if (!form.isConnected) return; // Editor was swapped out
+      const paragraphs = splitParagraphs(input.value);
+      const pending = [];
+      const seen = new Set();
+      for (const p of paragraphs) {
+        if (!results.has(p.text) && !seen.has(p.text)) {
+          seen.add(p.text);
+          pending.push({ id: String(pending.length), text: p.text });
+        }
+      }
+      render();
+      if (pending.length === 0) return;
+
+      if (inFlight) inFlight.abort();
+      const controller = new AbortController();
+      inFlight = controller;
+      status.textContent = "Checking " + pending.length + " paragraph(s)...";
+
+      try {
+        const response = await fetch("/editor/check", {
+          method: "POST",
+          headers: {
+            "Content-Type": "application/json",
+            "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]')
+              .content,
+          },
+          body: JSON.stringify({
+            session: session,
+            language: language.value,
+            paragraphs: pending,
+          }),
+          signal: controller.signal,
+        });
+        if (!response.ok) {
+          throw new Error((await response.text()).trim() || response.statusText);
+        }
+        await readLines(response.body, (line) => {
+          const result = JSON.parse(line);
+          const paragraph = pending[Number(result.id)];
+          if (!paragraph) return;
+          if (result.error) {
+            lastError = result.error;
+          } else {
+            lastError = "";
+            results.set(paragraph.text, result.issues);
+          }
+          render();
+        });
+        if (inFlight === controller) {
+          inFlight = null;
+          render();
+        }
+      } catch (err) {
+        if (err.name !== "AbortError") {
+          lastError = err.message;
+          render();
+        }
+      }
+    }
+
+    // readLines calls onLine for each line of a streamed response body
+    async function readLines(body, onLine) {
+      const reader = body.getReader();
+      const decoder = new TextDecoder();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += decoder.decode(value, { stream: true });
+        let newline;
+        while ((newline = buffer.indexOf("\n")) >= 0) {
+          const line = buffer.slice(0, newline).trim();
+          buffer = buffer.slice(newline + 1);
+          if (line) onLine(line);
+        }
+      }
+      if (buffer.trim()) onLine(buffer.trim());
+    }
+
+    // render lists the issues of the current text, in document order
+    function render() {
+      const paragraphs = splitParagraphs(input.value);
+      const issues = [];
+      let unchecked = 0;
+      for (const p of paragraphs) {
+        const found = results.get(p.text);
+        if (!found) {
+          unchecked++;
+          continue;
+        }
+        for (const issue of found) {
+          issues.push(Object.assign({}, issue, { offset: p.offset + issue.offset }));
+        }
+      }
+
+      // Forget paragraphs that are gone, so the map doesn't grow forever
+      const current = new Set(paragraphs.map((p) => p.text));
+      for (const text of results.keys()) {
+        if (!current.has(text)) results.delete(text);
+      }
+
+      list.replaceChildren(...issues.map(issueItem));
+      if (lastError) {
+        status.textContent = "Check failed: " + lastError;
+      } else if (unchecked > 0) {
+        status.textContent = "Checking " + unchecked + " paragraph(s)...";
+      } else {
+        status.textContent =
+          issues.length === 0 ? "No issues found." : issues.length + " issue(s)";
+      }
+    }
+
+    function issueItem(issue) {
+      const item = document.createElement("li");
+      item.className = "grammar-issue editor-issue severity-" + (issue.severity || "info");
+      item.tabIndex = 0;
+
+      const message = document.createElement("strong");
+      message.textContent = issue.message;
+      const word = document.createElement("code");
+      word.textContent = input.value.substr(issue.offset, issue.length);
+      item.append(message, " ", word);
+
+      if (issue.suggestions && issue.suggestions.length > 0) {
+        const suggestions = document.createElement("div");
+        suggestions.className = "suggestions";
+        for (const s of issue.suggestions.slice(0, 5)) {
+          const button = document.createElement("button");
+          button.type = "button";
+          button.textContent = s;
+          button.title = "Replace with this suggestion";
+          button.addEventListener("click", (e) => {
+            e.stopPropagation();
+            input.setRangeText(s, issue.offset, issue.offset + issue.length, "end");
+            input.focus();
+            schedule();
+          });
+          suggestions.append(button);
+        }
+        item.append(suggestions);
+      }
+
+      // Select the issue in the text
+      item.addEventListener("click", () => {
+        input.focus();
+        input.setSelectionRange(issue.offset, issue.offset + issue.length);
+      });
+      return item;
+    }
+
+    input.addEventListener("input", schedule);
+    language.addEventListener("change", () => {
+      if (inFlight) inFlight.abort();
+      results = new Map(); // Issues depend on the language
+      schedule();
+    });
+    check();
+  }
+
+  // Editors arrive in htmx swaps, so look for them on every swap
+  document.addEventListener("htmx:load", (event) => {
+    const root = event.detail.elt;
+    if (root.matches && root.matches("[data-live-editor]")) initEditor(root);
+    if (root.querySelectorAll) {
+      root.querySelectorAll("[data-live-editor]").forEach(initEditor);
+    }
+  });
+})();
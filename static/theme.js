@@ -0,0 +1,37 @@
+// Light and dark themes: the saved choice, else the OS preference
+document.addEventListener("DOMContentLoaded", () => {
+  // Pages without the switch (e.g. login) still get the theme
+  const toggleSwitch =
+    document.querySelector("#checkbox") ||
+    document.createElement("input");
+  const currentTheme = localStorage.getItem("theme");
+
+  // Check for saved theme preference or use OS preference
+  if (currentTheme) {
+    document.documentElement.setAttribute("data-theme", currentTheme);
+    if (currentTheme === "dark") {
+      toggleSwitch.checked = true;
+    }
+  } else {
+    // Use OS preference as default
+    if (
+      window.matchMedia &&
+      window.matchMedia("(prefers-color-scheme: dark)").matches
+    ) {
+      document.documentElement.setAttribute("data-theme", "dark");
+      toggleSwitch.checked = true;
+      localStorage.setItem("theme", "dark");
+    }
+  }
+
+  // Listen for toggle switch change
+  toggleSwitch.addEventListener("change", function (e) {
+    if (this.checked) {
+      document.documentElement.setAttribute("data-theme", "dark");
+      localStorage.setItem("theme", "dark");
+    } else {
+      document.documentElement.setAttribute("data-theme", "light");
+      localStorage.setItem("theme", "light");
+    }
+  });
+});
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// --- Workspaces ---
+//
+// Handlers for switching between workspaces, creating them and managing
+// their members. Who may do what is up to policy.go.
+
+// invitationTTL is how long an invitation can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+// maxWorkspaceName is the longest workspace name, in bytes
+const maxWorkspaceName = 100
+
+// workspacesView is the data for the workspaces panel
+type workspacesView struct {
+	Access      Access             // The current workspace
+	UserID      primitive.ObjectID // The user, to tell them apart from other members
+	Workspaces  []workspaceItem    // All of the user's workspaces
+	Invitations []Invitation       // Pending invitations to the user
+	Pending     []Invitation       // Pending invitations to the current workspace, for its admins
+	Roles       []Role
+	Error       string
+}
+
+// workspaceItem is one of the user's workspaces
+type workspaceItem struct {
+	Workspace
+	Role    Role
+	Current bool
+}
+
+// handleWorkspaces renders the workspaces panel
+func handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	renderWorkspaces(w, r, "")
+}
+
+// handleCreateWorkspace creates a workspace named by the "name" form
+// field, with the user as its admin, and switches to it
+func handleCreateWorkspace(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > maxWorkspaceName {
+		renderWorkspaces(w, r, "Give the workspace a name of at most 100 characters.")
+		return
+	}
+
+	ws := Workspace{
+		Name:    name,
+		Members: []Member{{UserID: user.ID, Username: user.Username, Role: RoleAdmin, JoinedAt: time.Now()}},
+	}
+	id, err := CreateWorkspace(ws)
+	if err != nil {
+		log.Printf("Error creating workspace %q: %v", name, err)
+		http.Error(w, "Failed to create the workspace", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s created workspace %q", user.Username, name)
+	switchWorkspace(w, r, id)
+}
+
+// handleSwitchWorkspace makes the workspace in the "workspace" form field
+// the current one
+func handleSwitchWorkspace(w http.ResponseWriter, r *http.Request) {
+	access, err := workspaceAccess(currentUser(r), r.FormValue("workspace"))
+	if err != nil {
+		if err != errNotMember {
+			log.Printf("Error loading workspace: %v", err)
+			http.Error(w, "Error loading workspace", http.StatusInternalServerError)
+			return
+		}
+		policyError(w, err)
+		return
+	}
+	switchWorkspace(w, r, access.Workspace.ID)
+}
+
+// switchWorkspace sets the current workspace and reloads the page
+func switchWorkspace(w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	setWorkspaceCookie(w, r, id)
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/")
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleInvite invites the user named by the "username" form field to the
+// current workspace, with the "role" form field
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	access := currentAccess(r)
+	role, ok := parseRole(r.FormValue("role"))
+	if !ok {
+		renderWorkspaces(w, r, "Choose a role.")
+		return
+	}
+	username, err := normalizeUsername(r.FormValue("username"))
+	if err != nil {
+		renderWorkspaces(w, r, loginMessages[err])
+		return
+	}
+	invitee, err := GetUserByUsername(username)
+	if err == mongo.ErrNoDocuments {
+		renderWorkspaces(w, r, "There is no user named "+username+".")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching user %s: %v", username, err)
+		http.Error(w, "Failed to invite", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := access.Workspace.member(invitee.ID); ok {
+		renderWorkspaces(w, r, username+" is already a member.")
+		return
+	}
+
+	now := time.Now()
+	err = CreateInvitation(Invitation{
+		WorkspaceID:   access.Workspace.ID,
+		WorkspaceName: access.Workspace.Name,
+		Username:      username,
+		Role:          role,
+		InvitedBy:     currentUser(r).Username,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(invitationTTL),
+	})
+	if err == errAlreadyInvited {
+		renderWorkspaces(w, r, username+" is already invited.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error inviting %s: %v", username, err)
+		http.Error(w, "Failed to invite", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s invited %s to workspace %q as %s", currentUser(r).Username, username, access.Workspace.Name, role)
+	renderWorkspaces(w, r, "")
+}
+
+// handleCancelInvitation deletes the pending invitation {id} to the
+// current workspace
+func handleCancelInvitation(w http.ResponseWriter, r *http.Request) {
+	inv, err := GetInvitation(chi.URLParam(r, "id"))
+	if err == nil && inv.WorkspaceID != currentWorkspace(r) {
+		err = mongo.ErrNoDocuments
+	}
+	if err == nil {
+		err = DeleteInvitation(inv.ID)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Error canceling invitation: %v", err)
+		http.Error(w, "Failed to cancel the invitation", http.StatusInternalServerError)
+		return
+	}
+	renderWorkspaces(w, r, "")
+}
+
+// handleAcceptInvitation makes the user a member of the workspace of the
+// invitation {id}, and switches to it
+func handleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	inv, ok := userInvitation(w, r)
+	if !ok {
+		return
+	}
+	err := AddMember(inv.WorkspaceID, Member{UserID: user.ID, Username: user.Username, Role: inv.Role, JoinedAt: time.Now()})
+	if err != nil && err != errAlreadyMember {
+		log.Printf("Error adding %s to workspace %s: %v", user.Username, inv.WorkspaceID.Hex(), err)
+		http.Error(w, "Failed to accept the invitation", http.StatusInternalServerError)
+		return
+	}
+	if err := DeleteInvitation(inv.ID); err != nil {
+		log.Printf("Error deleting accepted invitation %s: %v", inv.ID.Hex(), err)
+	}
+	log.Printf("User %s joined workspace %q as %s", user.Username, inv.WorkspaceName, inv.Role)
+	switchWorkspace(w, r, inv.WorkspaceID)
+}
+
+// handleDeclineInvitation deletes the user's invitation {id}
+func handleDeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	inv, ok := userInvitation(w, r)
+	if !ok {
+		return
+	}
+	if err := DeleteInvitation(inv.ID); err != nil {
+		log.Printf("Error declining invitation %s: %v", inv.ID.Hex(), err)
+		http.Error(w, "Failed to decline the invitation", http.StatusInternalServerError)
+		return
+	}
+	renderWorkspaces(w, r, "")
+}
+
+// userInvitation returns the invitation {id}, if it is addressed to the
+// user
+func userInvitation(w http.ResponseWriter, r *http.Request) (Invitation, bool) {
+	inv, err := GetInvitation(chi.URLParam(r, "id"))
+	if err == nil {
+		err = authorizeInvitation(currentUser(r), inv)
+	}
+	if err == mongo.ErrNoDocuments || err == errInvitationTarget {
+		http.Error(w, "Invitation not found or expired", http.StatusNotFound)
+		return Invitation{}, false
+	}
+	if err != nil {
+		log.Printf("Error fetching invitation: %v", err)
+		http.Error(w, "Error fetching the invitation", http.StatusInternalServerError)
+		return Invitation{}, false
+	}
+	return inv, true
+}
+
+// handleSetMemberRole gives the member {userID} of the current workspace
+// the "role" form field
+func handleSetMemberRole(w http.ResponseWriter, r *http.Request) {
+	role, ok := parseRole(r.FormValue("role"))
+	if !ok {
+		renderWorkspaces(w, r, "Choose a role.")
+		return
+	}
+	changeMember(w, r, role)
+}
+
+// handleRemoveMember removes the member {userID} from the current
+// workspace; members may remove themselves to leave it
+func handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	changeMember(w, r, "")
+}
+
+// changeMember gives the member {userID} a new role, or removes them if
+// role is empty, as far as the policy allows
+func changeMember(w http.ResponseWriter, r *http.Request, role Role) {
+	user := currentUser(r)
+	access := currentAccess(r)
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "userID"))
+	if err != nil {
+		policyError(w, errNoSuchMember)
+		return
+	}
+	if err := authorizeMemberChange(access, user.ID, userID, role); err != nil {
+		if err == errLastAdmin || err == errPersonalCreator {
+			renderWorkspaces(w, r, capitalize(err.Error())+".")
+			return
+		}
+		policyError(w, err)
+		return
+	}
+
+	if role == "" {
+		err = RemoveMember(access.Workspace.ID, userID)
+	} else {
+		err = SetMemberRole(access.Workspace.ID, userID, role)
+	}
+	if err != nil {
+		log.Printf("Error changing member %s of workspace %s: %v", userID.Hex(), access.Workspace.ID.Hex(), err)
+		http.Error(w, "Failed to change the member", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s changed member %s of workspace %q to %q", user.Username, userID.Hex(), access.Workspace.Name, role)
+
+	if userID == user.ID && role == "" {
+		switchWorkspace(w, r, user.ID) // Left it; back to the personal workspace
+		return
+	}
+	// Reload the workspace, so the panel shows the change
+	if access, err = workspaceAccess(user, access.Workspace.ID.Hex()); err != nil {
+		switchWorkspace(w, r, user.ID)
+		return
+	}
+	renderWorkspaces(w, r.WithContext(withAccess(r.Context(), access)), "")
+}
+
+// renderWorkspaces renders the workspaces panel, with message as an
+// error if not empty
+func renderWorkspaces(w http.ResponseWriter, r *http.Request, message string) {
+	user := currentUser(r)
+	access := currentAccess(r)
+	view := workspacesView{Access: access, UserID: user.ID, Roles: workspaceRoles, Error: message}
+
+	workspaces, err := GetUserWorkspaces(user.ID)
+	if err != nil {
+		log.Printf("Error fetching workspaces of %s: %v", user.Username, err)
+		view.Error = "Failed to load your workspaces."
+	}
+	for _, ws := range workspaces {
+		view.Workspaces = append(view.Workspaces, workspaceItem{
+			Workspace: ws,
+			Role:      accessTo(ws, user.ID).Role,
+			Current:   ws.ID == access.Workspace.ID,
+		})
+	}
+	if view.Invitations, err = GetInvitations(user.Username, primitive.NilObjectID); err != nil {
+		log.Printf("Error fetching invitations of %s: %v", user.Username, err)
+	}
+	if access.Role.Allows(PermManageMembers) {
+		if view.Pending, err = GetInvitations("", access.Workspace.ID); err != nil {
+			log.Printf("Error fetching invitations to workspace %s: %v", access.Workspace.ID.Hex(), err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderTemplate(w, "_workspaces.html", view)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRolePermissions(t *testing.T) {
+	for _, tt := range []struct {
+		role Role
+		want map[Permission]bool
+	}{
+		{RoleViewer, map[Permission]bool{PermViewNotes: true, PermEditNotes: false, PermEditSettings: false, PermManageMembers: false}},
+		{RoleEditor, map[Permission]bool{PermViewNotes: true, PermEditNotes: true, PermEditSettings: true, PermManageMembers: false}},
+		{RoleAdmin, map[Permission]bool{PermViewNotes: true, PermEditNotes: true, PermEditSettings: true, PermManageMembers: true}},
+		{"", map[Permission]bool{PermViewNotes: false}},
+		{RoleAdmin, map[Permission]bool{"bogus": false}},
+	} {
+		for perm, want := range tt.want {
+			if got := tt.role.Allows(perm); got != want {
+				t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, perm, got, want)
+			}
+		}
+	}
+
+	err := Authorize(Access{Role: RoleViewer}, PermEditNotes)
+	if _, ok := err.(*PermissionError); !ok || err.Error() != "viewers of this workspace can't change notes" {
+		t.Errorf("viewer editing: %v", err)
+	}
+	if err := Authorize(Access{}, PermViewNotes); err != errNotMember {
+		t.Errorf("non-member viewing: %v, want errNotMember", err)
+	}
+}
+
+func TestAuthorizeMemberChange(t *testing.T) {
+	alice, bob, carol := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	team := Workspace{Members: []Member{{UserID: alice, Role: RoleAdmin}, {UserID: bob, Role: RoleViewer}}}
+	personal := Workspace{ID: alice, Personal: true, Members: []Member{{UserID: alice, Role: RoleAdmin}, {UserID: bob, Role: RoleAdmin}}}
+
+	for _, tt := range []struct {
+		name          string
+		ws            Workspace
+		actor, target primitive.ObjectID
+		role          Role
+		want          error
+	}{
+		{"admin promotes", team, alice, bob, RoleEditor, nil},
+		{"admin removes", team, alice, bob, "", nil},
+		{"viewer leaves", team, bob, bob, "", nil},
+		{"viewer promotes self", team, bob, bob, RoleAdmin, &PermissionError{}},
+		{"viewer removes admin", team, bob, alice, "", &PermissionError{}},
+		{"last admin leaves", team, alice, alice, "", errLastAdmin},
+		{"last admin demoted", team, alice, alice, RoleEditor, errLastAdmin},
+		{"not a member", team, alice, carol, RoleEditor, errNoSuchMember},
+		{"outsider leaves", team, carol, carol, "", errNotMember},
+		{"creator leaves personal", personal, alice, alice, "", errPersonalCreator},
+		{"creator demoted", personal, bob, alice, RoleViewer, errPersonalCreator},
+		{"second admin leaves personal", personal, bob, bob, "", nil},
+	} {
+		err := authorizeMemberChange(accessTo(tt.ws, tt.actor), tt.actor, tt.target, tt.role)
+		if _, want := tt.want.(*PermissionError); want {
+			if _, ok := err.(*PermissionError); !ok {
+				t.Errorf("%s: %v, want a PermissionError", tt.name, err)
+			}
+		} else if err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	useTestDB(t)
+	LoadTemplates()
+	alice, bob := createTestUsers(t)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	session := func(user User) *http.Cookie {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := startSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), user); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()[0]
+	}
+	aliceSession, bobSession := session(alice), session(bob)
+	var workspace string
+	do := func(session *http.Cookie, method, path string, form url.Values) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("X-Workspace", workspace)
+		req.AddCookie(session)
+		resp, err := http.DefaultClient.Do(withCSRF(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	// Alice creates a team workspace with a note, and invites bob to read it
+	id, err := CreateWorkspace(Workspace{Name: "Team", Members: []Member{{UserID: alice.ID, Username: alice.Username, Role: RoleAdmin}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace = id.Hex()
+	noteID, err := CreateNote(Note{OwnerID: alice.ID, WorkspaceID: id, OriginalFilename: "team.md", MarkdownContent: "Team plans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notePath := "/notes/" + noteID.Hex()
+	if status, _ := do(bobSession, http.MethodGet, notePath+"?type=markdown", nil); status != http.StatusNotFound {
+		t.Errorf("bob reading before joining: status %d, want 404", status)
+	}
+	if status, body := do(aliceSession, http.MethodPost, "/invitations", url.Values{"username": {"bob"}, "role": {"viewer"}}); status != http.StatusOK || !strings.Contains(body, "Pending Invitations") {
+		t.Fatalf("inviting bob: status %d", status)
+	}
+	invitations, err := GetInvitations(bob.Username, primitive.NilObjectID)
+	if err != nil || len(invitations) != 1 {
+		t.Fatalf("bob's invitations: %v, %v", invitations, err)
+	}
+	invitationPath := "/invitations/" + invitations[0].ID.Hex()
+	if status, _ := do(aliceSession, http.MethodPost, invitationPath+"/accept", nil); status != http.StatusNotFound {
+		t.Errorf("alice accepting bob's invitation: status %d, want 404", status)
+	}
+	workspace = ""
+	if status, _ := do(bobSession, http.MethodPost, invitationPath+"/accept", nil); status != http.StatusOK {
+		t.Fatalf("bob accepting: status %d", status)
+	}
+	workspace = id.Hex()
+
+	// As a viewer, bob reads but can't change anything
+	if status, body := do(bobSession, http.MethodGet, notePath+"?type=markdown", nil); status != http.StatusOK || body != "Team plans" {
+		t.Errorf("viewer reading: status %d, body %q", status, body)
+	}
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodDelete, notePath},
+		{http.MethodPost, notePath + "/recheck"},
+		{http.MethodPost, "/settings/dictionary"},
+		{http.MethodPost, "/invitations"},
+		{http.MethodPut, "/members/" + bob.ID.Hex()},
+	} {
+		if status, _ := do(bobSession, tt.method, tt.path, url.Values{"value": {"x"}, "role": {"admin"}}); status != http.StatusForbidden {
+			t.Errorf("viewer %s %s: status %d, want 403", tt.method, tt.path, status)
+		}
+	}
+	if _, body := do(bobSession, http.MethodGet, "/", nil); strings.Contains(body, "hx-delete=\"/notes/") {
+		t.Error("viewer's page has delete buttons")
+	}
+
+	// Promoted to editor, bob can change notes
+	if status, _ := do(aliceSession, http.MethodPut, "/members/"+bob.ID.Hex(), url.Values{"role": {"editor"}}); status != http.StatusOK {
+		t.Fatalf("promoting bob: status %d", status)
+	}
+	if status, _ := do(bobSession, http.MethodDelete, notePath, nil); status != http.StatusOK {
+		t.Errorf("editor deleting: status %d", status)
+	}
+	if _, err := GetNoteByID(id, noteID.Hex()); err == nil {
+		t.Error("note still there after the editor's delete")
+	}
+
+	// Alice is the only admin, so she can't leave; bob can
+	if status, body := do(aliceSession, http.MethodDelete, "/members/"+alice.ID.Hex(), nil); status != http.StatusOK || !strings.Contains(body, "at least one admin") {
+		t.Errorf("last admin leaving: status %d", status)
+	}
+	if status, _ := do(bobSession, http.MethodDelete, "/members/"+bob.ID.Hex(), nil); status != http.StatusOK {
+		t.Errorf("bob leaving: status %d", status)
+	}
+	if status, _ := do(bobSession, http.MethodGet, "/notes", nil); status != http.StatusNotFound {
+		t.Errorf("bob after leaving: status %d, want 404", status)
+	}
+}